@@ -0,0 +1,612 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"scrp/client/handlers"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Room conversations are named after the room with this prefix, so that
+// they can not be confused with contacts
+const roomPrefix = "#"
+
+// commandUI is what a command needs from the UI it runs in
+type commandUI interface {
+	// show prints an informational line in the current conversation
+	show(line string)
+	// open makes a contact or "#room" the current conversation
+	open(name string)
+	// current returns the current conversation, empty if there is none
+	current() string
+	// send sends text to a contact or "#room" and shows it as sent
+	send(name string, text string)
+	// post is send for any content type
+	post(name string, content handlers.Content)
+	// clear empties a conversation and deletes its local history
+	clear(name string) error
+	// localHistory returns the local history, nil when it is turned off
+	localHistory() *handlers.History
+	// jump opens the conversation of a search result around the message
+	jump(result handlers.SearchResult)
+	// edit and remove change a message in a conversation and its history,
+	// if it was sent by sender
+	edit(name string, sender string, id string, text string)
+	remove(name string, sender string, id string)
+	// message returns the back-th newest message of a conversation, 1 for
+	// the newest one
+	message(name string, back int) (handlers.HistoryEntry, bool)
+	// reply sends text in the thread of a message and shows it as sent
+	reply(name string, parent string, text string)
+	// react records a reaction of sender to a message and shows it
+	react(name string, sender string, id string, reaction string)
+	// timer keeps the disappearing message timer sender set for a
+	// conversation and shows it
+	timer(name string, sender string, timer time.Duration)
+	// quit ends the session and exits
+	quit()
+}
+
+// command is a slash command typed on the input line
+type command struct {
+	name  string
+	usage string
+	help  string
+	run   func(ui commandUI, client *handlers.Client, args []string) error
+}
+
+var commands = make(map[string]*command)
+
+// Results shown by the last /search, for /goto
+var lastSearch struct {
+	mutex   sync.Mutex
+	results []handlers.SearchResult
+}
+
+// Most search results shown
+const maxSearchResults = 20
+
+// IDs of the messages sent in each conversation this session, newest last,
+// for /edit and /delete
+var sentMessages = struct {
+	mutex sync.Mutex
+	ids   map[string][]string
+}{ids: make(map[string][]string)}
+
+// registerCommand makes a command available as /name
+func registerCommand(cmd *command) {
+	commands[cmd.name] = cmd
+}
+
+func init() {
+	registerCommand(&command{name: "to", usage: "/to <contact|#room>", help: "switch to a conversation", run: cmdTo})
+	registerCommand(&command{name: "rooms", usage: "/rooms", help: "list the rooms on the server", run: cmdRooms})
+	registerCommand(&command{name: "join", usage: "/join <room>", help: "join a room, creating it if needed", run: cmdJoin})
+	registerCommand(&command{name: "leave", usage: "/leave [room]", help: "leave a room, the current one by default", run: cmdLeave})
+	registerCommand(&command{name: "who", usage: "/who", help: "list the members of the current room or the online contacts", run: cmdWho})
+	registerCommand(&command{name: "verify", usage: "/verify <contact> [fingerprint]", help: "show or check the key fingerprint of a contact", run: cmdVerify})
+	registerCommand(&command{name: "send", usage: "/send <contact|#room> <text>", help: "send a message without switching conversation", run: cmdSend})
+	registerCommand(&command{name: "file", usage: "/file <path> [caption]", help: "send a reference to a file with its size and SHA-256, not the file itself", run: cmdFile})
+	registerCommand(&command{name: "edit", usage: "/edit <text>", help: "replace the text of your last message in the conversation", run: cmdEdit})
+	registerCommand(&command{name: "delete", usage: "/delete", help: "delete your last message in the conversation", run: cmdDelete})
+	registerCommand(&command{name: "reply", usage: "/reply [^n] <text>", help: "reply in the thread of the last message, or of the n-th last", run: cmdReply})
+	registerCommand(&command{name: "react", usage: "/react [^n] <emoji>", help: "react to the last message, or to the n-th last", run: cmdReact})
+	registerCommand(&command{name: "timer", usage: "/timer [duration|off]", help: "show or set after how long messages in the conversation disappear, e.g. 1h", run: cmdTimer})
+	registerCommand(&command{name: "search", usage: "/search [from:<contact>] [with:<contact>] [room:<room>] [after:<date>] [before:<date>] <words>", help: "search the local history, dates as 2006-01-02", run: cmdSearch})
+	registerCommand(&command{name: "goto", usage: "/goto <result>", help: "open the conversation of a search result at the message", run: cmdGoto})
+	registerCommand(&command{name: "clear", usage: "/clear [contact|#room]", help: "delete the history of a conversation, the current one by default", run: cmdClear})
+	registerCommand(&command{name: "quit", usage: "/quit", help: "disconnect and exit", run: cmdQuit})
+	registerCommand(&command{name: "help", usage: "/help", help: "list the commands", run: cmdHelp})
+}
+
+// isCommand reports whether an input line is a command rather than a
+// message
+func isCommand(line string) bool {
+	return strings.HasPrefix(line, "/")
+}
+
+// runCommand runs an input line starting with "/" and shows what went wrong
+func runCommand(ui commandUI, client *handlers.Client, line string) {
+	fields := strings.Fields(strings.TrimPrefix(line, "/"))
+	if len(fields) == 0 {
+		ui.show("Type /help for the list of commands")
+		return
+	}
+
+	cmd, ok := commands[fields[0]]
+	if !ok {
+		ui.show(fmt.Sprintf("Unknown command /%s, type /help for the list of commands", fields[0]))
+		return
+	}
+
+	if err := cmd.run(ui, client, fields[1:]); err != nil {
+		ui.show(fmt.Sprintf("/%s: %v", cmd.name, err))
+	}
+}
+
+// sendTo sends a message to a contact or, for a "#room" name, to a room and
+// returns its ID. A message with a parent is a reply in its thread.
+func sendTo(client *handlers.Client, name string, parent string, content handlers.Content) (string, error) {
+	var id string
+	var err error
+	if room, ok := strings.CutPrefix(name, roomPrefix); ok {
+		id, err = client.PostRoomContent(room, parent, content)
+	} else {
+		id, err = client.PostContent(name, parent, content)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	sentMessages.mutex.Lock()
+	sentMessages.ids[name] = append(sentMessages.ids[name], id)
+	sentMessages.mutex.Unlock()
+	return id, nil
+}
+
+// lastSent returns the ID of the user's newest message in a conversation,
+// looking in the history for messages from earlier sessions
+func lastSent(ui commandUI, client *handlers.Client, name string) (string, error) {
+	sentMessages.mutex.Lock()
+	ids := sentMessages.ids[name]
+	sentMessages.mutex.Unlock()
+	if len(ids) > 0 {
+		return ids[len(ids)-1], nil
+	}
+
+	if history := ui.localHistory(); history != nil {
+		entries, err := history.Load(name)
+		if err != nil {
+			return "", err
+		}
+		for i := len(entries) - 1; i >= 0; i-- {
+			if entries[i].Sender == ownName(client) && entries[i].ID != "" {
+				return entries[i].ID, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("you have not sent anything to %s", name)
+}
+
+// forgetSent drops a deleted message from the ones /edit and /delete use
+func forgetSent(name string, id string) {
+	sentMessages.mutex.Lock()
+	defer sentMessages.mutex.Unlock()
+
+	ids := sentMessages.ids[name]
+	for i := range ids {
+		if ids[i] == id {
+			sentMessages.ids[name] = append(ids[:i], ids[i+1:]...)
+			return
+		}
+	}
+}
+
+func ownName(client *handlers.Client) string {
+	return string(bytes.Trim(client.Username[:], "\x00"))
+}
+
+func errUsage(cmd string) error {
+	return fmt.Errorf("usage: %s", commands[cmd].usage)
+}
+
+func cmdTo(ui commandUI, client *handlers.Client, args []string) error {
+	if len(args) != 1 {
+		return errUsage("to")
+	}
+	ui.open(args[0])
+	return nil
+}
+
+func cmdRooms(ui commandUI, client *handlers.Client, args []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	rooms, err := client.ListRooms(ctx)
+	if err != nil {
+		return err
+	}
+	if len(rooms) == 0 {
+		ui.show("There are no rooms, create one with /join <room>")
+		return nil
+	}
+
+	joined := make(map[string]bool)
+	for _, room := range client.Rooms() {
+		joined[room] = true
+	}
+	for i, room := range rooms {
+		if joined[room] {
+			rooms[i] += " (joined)"
+		}
+	}
+	ui.show("Rooms: " + strings.Join(rooms, ", "))
+	return nil
+}
+
+func cmdJoin(ui commandUI, client *handlers.Client, args []string) error {
+	if len(args) != 1 {
+		return errUsage("join")
+	}
+	room := strings.TrimPrefix(args[0], roomPrefix)
+	if err := client.JoinRoom(room); err != nil {
+		return err
+	}
+	ui.open(roomPrefix + room)
+	return nil
+}
+
+func cmdLeave(ui commandUI, client *handlers.Client, args []string) error {
+	var room string
+	switch {
+	case len(args) == 1:
+		room = strings.TrimPrefix(args[0], roomPrefix)
+	case len(args) == 0 && strings.HasPrefix(ui.current(), roomPrefix):
+		room = strings.TrimPrefix(ui.current(), roomPrefix)
+	default:
+		return errUsage("leave")
+	}
+	return client.LeaveRoom(room)
+}
+
+func cmdWho(ui commandUI, client *handlers.Client, args []string) error {
+	if room, ok := strings.CutPrefix(ui.current(), roomPrefix); ok {
+		members := client.RoomMembers(room)
+		if len(members) == 0 {
+			return fmt.Errorf("not a member of room %s", room)
+		}
+		ui.show(fmt.Sprintf("Members of %s: %s", ui.current(), strings.Join(members, ", ")))
+		return nil
+	}
+
+	contacts := client.Contacts()
+	if len(contacts) == 0 {
+		ui.show("Nobody else is online")
+		return nil
+	}
+	names := make([]string, 0, len(contacts))
+	for _, contact := range contacts {
+		names = append(names, contact.Username)
+	}
+	ui.show("Online: " + strings.Join(names, ", "))
+	return nil
+}
+
+func cmdVerify(ui commandUI, client *handlers.Client, args []string) error {
+	if len(args) < 1 || len(args) > 2 {
+		return errUsage("verify")
+	}
+
+	var fingerprint string
+	for _, contact := range client.Contacts() {
+		if contact.Username == args[0] {
+			fingerprint = contact.Fingerprint
+		}
+	}
+	if fingerprint == "" {
+		return fmt.Errorf("%s is not online", args[0])
+	}
+
+	if len(args) == 1 {
+		ui.show(fmt.Sprintf("Your fingerprint: %s", handlers.Fingerprint(client.OwnPublicKey)))
+		ui.show(fmt.Sprintf("Fingerprint of %s: %s", args[0], fingerprint))
+		ui.show("Compare it with the one they see over another channel")
+		return nil
+	}
+
+	if args[1] != fingerprint {
+		return fmt.Errorf("MISMATCH, the key of %s has fingerprint %s", args[0], fingerprint)
+	}
+	ui.show(fmt.Sprintf("The fingerprint of %s matches", args[0]))
+	return nil
+}
+
+func cmdSend(ui commandUI, client *handlers.Client, args []string) error {
+	if len(args) < 2 {
+		return errUsage("send")
+	}
+	ui.send(args[0], strings.Join(args[1:], " "))
+	return nil
+}
+
+func cmdFile(ui commandUI, client *handlers.Client, args []string) error {
+	name := ui.current()
+	if len(args) == 0 || name == "" || name == systemConversation {
+		return errUsage("file")
+	}
+
+	file, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	digest := sha256.New()
+	size, err := io.Copy(digest, file)
+	if err != nil {
+		return err
+	}
+
+	ui.post(name, handlers.Content{
+		Type: handlers.ContentFile,
+		Text: strings.Join(args[1:], " "),
+		Meta: map[string]string{
+			handlers.MetaFileName:   filepath.Base(args[0]),
+			handlers.MetaFileSize:   strconv.FormatInt(size, 10),
+			handlers.MetaFileSHA256: hex.EncodeToString(digest.Sum(nil)),
+		},
+	})
+	return nil
+}
+
+func cmdEdit(ui commandUI, client *handlers.Client, args []string) error {
+	name := ui.current()
+	if len(args) == 0 || name == "" {
+		return errUsage("edit")
+	}
+	id, err := lastSent(ui, client, name)
+	if err != nil {
+		return err
+	}
+
+	text := strings.Join(args, " ")
+	if room, ok := strings.CutPrefix(name, roomPrefix); ok {
+		err = client.EditRoomMessage(room, id, text)
+	} else {
+		err = client.EditMessage(name, id, text)
+	}
+	if err != nil {
+		return err
+	}
+	ui.edit(name, ownName(client), id, text)
+	return nil
+}
+
+func cmdDelete(ui commandUI, client *handlers.Client, args []string) error {
+	name := ui.current()
+	if len(args) != 0 || name == "" {
+		return errUsage("delete")
+	}
+	id, err := lastSent(ui, client, name)
+	if err != nil {
+		return err
+	}
+
+	if room, ok := strings.CutPrefix(name, roomPrefix); ok {
+		err = client.DeleteRoomMessage(room, id)
+	} else {
+		err = client.DeleteMessage(name, id)
+	}
+	if err != nil {
+		return err
+	}
+	forgetSent(name, id)
+	ui.remove(name, ownName(client), id)
+	return nil
+}
+
+// pickMessage returns the message a "^n" argument selects in the current
+// conversation, the newest one without it, and the remaining arguments
+func pickMessage(ui commandUI, args []string) (handlers.HistoryEntry, []string, error) {
+	name := ui.current()
+	if name == "" {
+		return handlers.HistoryEntry{}, args, errors.New("no conversation is open")
+	}
+
+	back := 1
+	if len(args) > 0 && strings.HasPrefix(args[0], "^") {
+		n, err := strconv.Atoi(args[0][1:])
+		if err != nil || n < 1 {
+			return handlers.HistoryEntry{}, args, fmt.Errorf("invalid message %s, expected ^1 for the last one", args[0])
+		}
+		back, args = n, args[1:]
+	}
+
+	entry, ok := ui.message(name, back)
+	if !ok || entry.ID == "" {
+		return handlers.HistoryEntry{}, args, fmt.Errorf("no such message in %s", name)
+	}
+	return entry, args, nil
+}
+
+func cmdReply(ui commandUI, client *handlers.Client, args []string) error {
+	entry, args, err := pickMessage(ui, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errUsage("reply")
+	}
+
+	// Threads are one level deep, replies to a reply go to its thread
+	parent := entry.ID
+	if entry.ReplyTo != "" {
+		parent = entry.ReplyTo
+	}
+	ui.reply(entry.Conversation, parent, strings.Join(args, " "))
+	return nil
+}
+
+func cmdReact(ui commandUI, client *handlers.Client, args []string) error {
+	entry, args, err := pickMessage(ui, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errUsage("react")
+	}
+
+	reaction := args[0]
+	if room, ok := strings.CutPrefix(entry.Conversation, roomPrefix); ok {
+		err = client.ReactRoom(room, entry.ID, reaction)
+	} else {
+		err = client.React(entry.Conversation, entry.ID, reaction)
+	}
+	if err != nil {
+		return err
+	}
+	ui.react(entry.Conversation, ownName(client), entry.ID, reaction)
+	return nil
+}
+
+func cmdTimer(ui commandUI, client *handlers.Client, args []string) error {
+	name := ui.current()
+	if len(args) > 1 || name == "" || name == systemConversation {
+		return errUsage("timer")
+	}
+
+	if len(args) == 0 {
+		if timer := conversationTimer(client, name); timer > 0 {
+			ui.show(fmt.Sprintf("Messages in %s disappear after %v", name, timer))
+		} else {
+			ui.show(fmt.Sprintf("Messages in %s do not disappear", name))
+		}
+		return nil
+	}
+
+	var timer time.Duration
+	if args[0] != "off" {
+		var err error
+		timer, err = time.ParseDuration(args[0])
+		if err != nil || timer < time.Second {
+			return fmt.Errorf("invalid duration %q, use e.g. 30s, 10m or 1h", args[0])
+		}
+		timer = timer.Truncate(time.Second)
+	}
+
+	var err error
+	if room, ok := strings.CutPrefix(name, roomPrefix); ok {
+		err = client.SetRoomTimer(room, timer)
+	} else {
+		err = client.SetTimer(name, timer)
+	}
+	if err != nil {
+		return err
+	}
+	ui.timer(name, ownName(client), timer)
+	return nil
+}
+
+func cmdClear(ui commandUI, client *handlers.Client, args []string) error {
+	name := ui.current()
+	switch {
+	case len(args) == 1:
+		name = args[0]
+	case len(args) > 1 || name == "":
+		return errUsage("clear")
+	}
+
+	if err := ui.clear(name); err != nil {
+		return err
+	}
+	ui.show(fmt.Sprintf("Deleted the history of %s", name))
+	return nil
+}
+
+func cmdSearch(ui commandUI, client *handlers.Client, args []string) error {
+	history := ui.localHistory()
+	if history == nil {
+		return fmt.Errorf("the local history is turned off")
+	}
+
+	var query handlers.SearchQuery
+	for _, arg := range args {
+		key, value, ok := strings.Cut(arg, ":")
+		if !ok || value == "" {
+			query.Terms = append(query.Terms, arg)
+			continue
+		}
+
+		switch key {
+		case "from":
+			query.Sender = value
+		case "with":
+			query.Conversation = value
+		case "room":
+			query.Conversation = roomPrefix + strings.TrimPrefix(value, roomPrefix)
+		case "after", "before":
+			day, err := time.ParseInLocation("2006-01-02", value, time.Local)
+			if err != nil {
+				return fmt.Errorf("invalid date %q, use 2006-01-02", value)
+			}
+			if key == "after" {
+				query.After = day
+			} else {
+				// The whole day is included
+				query.Before = day.AddDate(0, 0, 1)
+			}
+		default:
+			query.Terms = append(query.Terms, arg)
+		}
+	}
+
+	results, err := history.Search(query)
+	if err != nil {
+		return err
+	}
+	if len(results) == 0 {
+		ui.show("No messages found")
+		return nil
+	}
+
+	if len(results) > maxSearchResults {
+		ui.show(fmt.Sprintf("%d messages found, showing the newest %d", len(results), maxSearchResults))
+		results = results[len(results)-maxSearchResults:]
+	}
+
+	lastSearch.mutex.Lock()
+	lastSearch.results = results
+	lastSearch.mutex.Unlock()
+
+	for i, result := range results {
+		ui.show(fmt.Sprintf("[%d] %s %s", i+1, result.Conversation, formatEntry(result.HistoryEntry)))
+	}
+	ui.show("Use /goto <result> to open the conversation at a message")
+	return nil
+}
+
+func cmdGoto(ui commandUI, client *handlers.Client, args []string) error {
+	if len(args) != 1 {
+		return errUsage("goto")
+	}
+
+	lastSearch.mutex.Lock()
+	results := lastSearch.results
+	lastSearch.mutex.Unlock()
+
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n < 1 || n > len(results) {
+		return fmt.Errorf("no search result %s", args[0])
+	}
+	ui.jump(results[n-1])
+	return nil
+}
+
+func cmdQuit(ui commandUI, client *handlers.Client, args []string) error {
+	ui.quit()
+	return nil
+}
+
+func cmdHelp(ui commandUI, client *handlers.Client, args []string) error {
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		ui.show(fmt.Sprintf("%-32s %s", commands[name].usage, commands[name].help))
+	}
+	return nil
+}
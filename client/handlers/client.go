@@ -1,21 +1,36 @@
 package handlers
 
 import (
-	"bufio"
 	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
 	"net"
-	"os"
 	"scrp/models"
 	"scrp/variables"
-	"strconv"
 	"sync"
+	"time"
+)
+
+var (
+	// ErrAuthFailed is returned when the server rejects a login
+	ErrAuthFailed = errors.New("authentication failed")
+	// ErrCodeRequired is returned when the server asks for a second factor,
+	// the login is completed with SendAuthCode
+	ErrCodeRequired = errors.New("two factor code required")
+	// ErrClosed is returned when the session has ended
+	ErrClosed = errors.New("session closed")
+	// ErrProtocolVersion is returned when the server speaks another version
+	// of the protocol
+	ErrProtocolVersion = errors.New("server speaks another protocol version")
+	// ErrSessionReplaced ends the session when the user logs in from
+	// somewhere else, the client does not reconnect
+	ErrSessionReplaced = errors.New("logged in from another session")
 )
 
 type State int
@@ -33,23 +48,73 @@ const (
 
 type Client struct {
 	Username        [32]byte
-	Password        [32]byte
 	OwnPublicKey    [512]byte
 	OwnPrivateKey   *rsa.PrivateKey
 	OtherPublicKeys map[string][512]byte
 	Conn            net.Conn
-	Mode            string
-	State           State
 	mutex           sync.Mutex
+
+	// Read with State, the reader goroutine changes it while the
+	// application sends
+	state State
+
+	// Fingerprints of the keys seen so far, they are kept when a contact
+	// goes offline to notice key changes
+	fingerprints map[string]string
+	// Keys of contacts that went offline. Messages to them are encrypted to
+	// these and kept in the server's mailbox until they log in again.
+	lastKeys map[string][512]byte
+	// Members of the rooms the user is in
+	rooms map[string][]string
+	// Disappearing message timers of the conversations that have one
+	timers map[timerKey]time.Duration
+
+	// A PING is sent every HeartbeatInterval and the server is considered
+	// gone when nothing arrives for HeartbeatInterval+HeartbeatTimeout
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+
+	// A received message whose sender's clock differs from the server's by
+	// more than MaxClockSkew is reported with its ClockSkew
+	MaxClockSkew time.Duration
+
+	// Padding decides how long messages are made before they are encrypted,
+	// DefaultPadding unless changed. Nil pads nothing.
+	Padding PaddingPolicy
+
+	// Dial opens a new connection to the server. When set, the client
+	// reconnects with exponential backoff whenever the connection drops.
+	Dial              func() (net.Conn, error)
+	ReconnectMinDelay time.Duration
+	ReconnectMaxDelay time.Duration
+
+	writeMutex    sync.Mutex
+	session       session
+	twoFactorAcks chan models.TwoFactorAckPayload
+	roomLists     chan models.RoomListPayload
+
+	// Set once the reader goroutine started. stopped is closed when it
+	// ends.
+	reading bool
+	events  chan Event
+	stopped chan struct{}
 }
 
-func NewClient(username string, password string) (*Client, error) {
+// NewClient returns a client with a key generated for this run only.
+// Messages kept for the user while away are encrypted to the key the user
+// had then, NewClientWithKey keeps them readable.
+func NewClient(username string) (*Client, error) {
 	// Generate RSA keys
-	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	privateKey, err := rsa.GenerateKey(rand.Reader, identityKeyBits)
 	if err != nil {
 		return nil, fmt.Errorf("could not generate private key: %v", err)
 	}
+	return NewClientWithKey(username, privateKey)
+}
 
+// NewClientWithKey returns a client using a kept identity key, e.g. from
+// History.IdentityKey
+func NewClientWithKey(username string, privateKey *rsa.PrivateKey) (*Client, error) {
 	// Convert public key to PKIX, ASN.1 DER form
 	pubBytes, err := x509.MarshalPKIXPublicKey(&privateKey.PublicKey)
 	if err != nil {
@@ -62,11 +127,34 @@ func NewClient(username string, password string) (*Client, error) {
 
 	return &Client{
 		Username:        stringToByteArray32(username),
-		Password:        stringToByteArray32(password),
 		OwnPublicKey:    pubKeyArr,
 		OwnPrivateKey:   privateKey,
 		OtherPublicKeys: make(map[string][512]byte),
-		State:           INIT,
+		state:           INIT,
+
+		fingerprints: make(map[string]string),
+		lastKeys:     make(map[string][512]byte),
+		rooms:        make(map[string][]string),
+		timers:       make(map[timerKey]time.Duration),
+
+		HeartbeatInterval: 30 * time.Second,
+		HeartbeatTimeout:  30 * time.Second,
+
+		MaxClockSkew: 5 * time.Minute,
+		Padding:      DefaultPadding,
+
+		ReconnectMinDelay: time.Second,
+		ReconnectMaxDelay: time.Minute,
+
+		session: session{
+			pending: make(map[uint32]*pendingMessage),
+			seen:    make(map[string]struct{}),
+		},
+		twoFactorAcks: make(chan models.TwoFactorAckPayload, 1),
+		roomLists:     make(chan models.RoomListPayload, 1),
+
+		events:  make(chan Event, 64),
+		stopped: make(chan struct{}),
 	}, nil
 }
 
@@ -76,345 +164,602 @@ func stringToByteArray32(s string) [32]byte {
 	return byteArray
 }
 
-func (c *Client) SendAuthRequest() {
+// writePDU writes a header and payload to the server as a single write so
+// that PDUs from concurrent senders never interleave
+func (c *Client) writePDU(msgType uint8, sequence uint32, payload interface{}) error {
 	header := models.Header{
 		Version:  variables.Version,
-		Type:     variables.AuthRequest,
-		Length:   uint16(binary.Size(c.Username) + binary.Size(c.Password)),
-		Sequence: 0, // Sequence number, update this as needed
+		Type:     msgType,
+		Length:   uint16(binary.Size(payload)),
+		Sequence: sequence,
 	}
 
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, &header); err != nil {
+		return err
+	}
+	if err := binary.Write(&buf, binary.BigEndian, payload); err != nil {
+		return err
+	}
+
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+
+	_, err := c.Conn.Write(buf.Bytes())
+	return err
+}
+
+// Connect opens a TLS connection to addr. When the connection drops the
+// client reconnects to the same address with the same configuration.
+func (c *Client) Connect(ctx context.Context, addr string, config *tls.Config) error {
+	dialer := &tls.Dialer{Config: config}
+	c.Dial = func() (net.Conn, error) {
+		return dialer.Dial("tcp", addr)
+	}
+
+	conn, err := dialer.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	c.Conn = conn
+	return nil
+}
+
+// Login authenticates with a password and sends the client's public key.
+// The password is not kept, later logins use the session token returned by
+// the server. Once logged in the client processes PDUs from the server in
+// the background and reports them on Events.
+func (c *Client) Login(password string) error {
 	payload := models.AuthRequestPayload{
 		Username: c.Username,
-		Password: c.Password,
+		Password: stringToByteArray32(password),
 	}
 
 	// Write header and payload
-	err := binary.Write(c.Conn, binary.BigEndian, &header)
+	err := c.writePDU(variables.AuthRequest, 0, &payload)
 	if err != nil {
-		log.Printf("Failed to write header to server: %v", err)
-		return
+		return fmt.Errorf("failed to write AUTH_REQUEST to server: %v", err)
+	}
+	return c.readAuthResponse()
+}
+
+// LoginWithCertificate authenticates with the TLS client certificate the
+// connection was made with. The server takes the username from the
+// certificate, no password is sent.
+func (c *Client) LoginWithCertificate() error {
+	payload := models.AuthRequestPayload{
+		Username: c.Username,
 	}
 
-	err = binary.Write(c.Conn, binary.BigEndian, &payload)
+	// Write header and payload
+	err := c.writePDU(variables.AuthRequest, 0, &payload)
 	if err != nil {
-		log.Printf("Failed to write payload to server: %v", err)
+		return fmt.Errorf("failed to write AUTH_REQUEST to server: %v", err)
 	}
+	return c.readAuthResponse()
 }
 
-func (c *Client) HandleServerMessages() {
-	go func() {
-		for {
-			// Read the header
-			var header models.Header
-			err := binary.Read(c.Conn, binary.BigEndian, &header)
-			if err != nil {
-				log.Printf("Failed to read header from server: %v", err)
-				return
-			}
+// LoginWithToken authenticates with a session token from an earlier login
+func (c *Client) LoginWithToken(token [64]byte) error {
+	payload := models.TokenAuthPayload{
+		Username: c.Username,
+		Token:    token,
+	}
 
-			// Read the payload based on the message type
-			switch header.Type {
-			case variables.AuthResponse:
-				// Handle AUTH_RESPONSE based on the current state
-				switch c.State {
-				case INIT:
-					var payload models.AuthResponsePayload
-					err = binary.Read(c.Conn, binary.BigEndian, &payload)
-					if err != nil {
-						log.Printf("Failed to read AUTH_RESPONSE payload from server: %v", err)
-						return
-					}
-					if payload.Status == variables.AuthSuccess {
-						// Authentication successful, transition to the next state
-						c.State = AUTHENTICATED
-						c.SendPublicKey()
-						c.State = PUBLIC_KEY_SENT
-					} else {
-						log.Println("Authentication failed.")
-						return
-					}
-				default:
-					log.Printf("Received AUTH_RESPONSE in an unexpected state: %v", c.State)
-					return
-				}
+	// Write header and payload
+	err := c.writePDU(variables.TokenAuth, 0, &payload)
+	if err != nil {
+		return fmt.Errorf("failed to write TOKEN_AUTH to server: %v", err)
+	}
+	return c.readAuthResponse()
+}
 
-			case variables.KeyExchange:
-				// Handle KEY_EXCHANGE based on the current state
-				switch c.State {
-				case PUBLIC_KEY_SENT, CHAT, PUBLIC_KEY_RECVD:
-					var payload models.PublicKeyPayload
-					err = binary.Read(c.Conn, binary.BigEndian, &payload)
-					if err != nil {
-						log.Printf("Failed to read KEY_EXCHANGE payload from server: %v", err)
-						return
-					}
+// SendAuthCode answers an AuthChallenge with a TOTP or recovery code. It
+// returns ErrCodeRequired again if the code was wrong and the server allows
+// another attempt.
+func (c *Client) SendAuthCode(code string) error {
+	payload := models.AuthCodePayload{}
+	copy(payload.Code[:], code)
 
-					// Handle other Client disconnect
-					if c.State == PUBLIC_KEY_RECVD || c.State == CHAT {
-						var checker [512]byte
-						username := string(bytes.Trim(payload.Username[:], "\x00"))
-						if payload.Key == checker {
-							c.mutex.Lock()
-							delete(c.OtherPublicKeys, username)
-							c.mutex.Unlock()
-							c.Mode = "Select"
-							c.State = PUBLIC_KEY_RECVD
-							c.DisplayParticipants()
-						} else {
-							// Add public key to map
-							c.mutex.Lock()
-							username := string(bytes.Trim(payload.Username[:], "\x00"))
-							c.OtherPublicKeys[username] = payload.Key
-							c.mutex.Unlock()
-
-							// Transition to the next state
-							c.State = PUBLIC_KEY_RECVD
-
-							// Display the list of participants
-							c.DisplayParticipants()
-						}
-					} else {
-						// Add public key to map
-						c.mutex.Lock()
-						username := string(bytes.Trim(payload.Username[:], "\x00"))
-						c.OtherPublicKeys[username] = payload.Key
-						c.mutex.Unlock()
-
-						// Transition to the next state
-						c.State = PUBLIC_KEY_RECVD
-
-						// Display the list of participants
-						c.DisplayParticipants()
-					}
+	// Write header and payload
+	err := c.writePDU(variables.AuthCode, 0, &payload)
+	if err != nil {
+		return fmt.Errorf("failed to write AUTH_CODE to server: %v", err)
+	}
+	return c.readAuthResponse()
+}
 
-				default:
-					log.Printf("Received KEY_EXCHANGE in an unexpected state: %v", c.State)
-					return
-				}
+// readHeader reads the header of the next PDU from the server
+func (c *Client) readHeader() (models.Header, error) {
+	var header models.Header
+	if err := binary.Read(c.Conn, binary.BigEndian, &header); err != nil {
+		return header, fmt.Errorf("failed to read header from server: %v", err)
+	}
+	if header.Version != variables.Version {
+		return header, fmt.Errorf("%w: %d, expected %d", ErrProtocolVersion, header.Version, variables.Version)
+	}
+	return header, nil
+}
 
-			case variables.Message:
-				// Handle MESSAGE based on the current state
-				switch c.State {
-				case CHAT, PUBLIC_KEY_RECVD:
-					c.State = CHAT
-					var payload models.MessagePayload
-					err = binary.Read(c.Conn, binary.BigEndian, &payload)
-					if err != nil {
-						log.Printf("Failed to read MESSAGE payload from server: %v", err)
-						return
-					}
+// readAuthResponse waits for the AUTH_RESPONSE to a login attempt
+func (c *Client) readAuthResponse() error {
+	header, err := c.readHeader()
+	if err != nil {
+		return err
+	}
+	if header.Type != variables.AuthResponse {
+		return fmt.Errorf("expected AUTH_RESPONSE, received message type %d", header.Type)
+	}
 
-					// Decrypt the data using own private key
-					decryptedData, err := c.DecryptData(bytes.Trim(payload.Data[:], "\x00")) // Implement DecryptData function
-					if err != nil {
-						log.Printf("Failed to decrypt payload: %v", err)
-						return
-					}
+	var payload models.AuthResponsePayload
+	err = binary.Read(c.Conn, binary.BigEndian, &payload)
+	if err != nil {
+		return fmt.Errorf("failed to read AUTH_RESPONSE payload from server: %v", err)
+	}
+	switch payload.Status {
+	case variables.AuthSuccess:
+	case variables.AuthChallenge:
+		return ErrCodeRequired
+	default:
+		return ErrAuthFailed
+	}
 
-					// Show the message
-					clearLine()
-					fmt.Printf("%s: %s", payload.Sender, decryptedData)
-					fmt.Printf("\nYour Message: ")
+	// Authentication successful, transition to the next state
+	c.setState(AUTHENTICATED)
+	c.session.setToken(payload.Token)
+	if err := c.SendPublicKey(); err != nil {
+		return err
+	}
+	c.setState(PUBLIC_KEY_SENT)
 
-				default:
-					log.Printf("Received MESSAGE in an unexpected state: %v", c.State)
-					return
-				}
+	c.start()
+	return nil
+}
 
-			default:
-				log.Printf("Unknown message type received from server: %d", header.Type)
+// SessionToken returns the session token issued at the last login
+func (c *Client) SessionToken() [64]byte {
+	c.session.mutex.Lock()
+	defer c.session.mutex.Unlock()
+
+	return c.session.token
+}
+
+// Logout revokes the current session token on the server and ends the
+// connection
+func (c *Client) Logout() error {
+	return c.RevokeToken(c.SessionToken())
+}
+
+// RevokeToken revokes a session token on the server and ends the connection.
+// No login is needed, the token itself proves who is logging out.
+func (c *Client) RevokeToken(token [64]byte) error {
+	c.setState(TERMINATED)
+
+	payload := models.LogoutPayload{
+		Username: c.Username,
+		Token:    token,
+	}
+	err := c.writePDU(variables.Logout, 0, &payload)
+	if err != nil {
+		return fmt.Errorf("failed to write LOGOUT to server: %v", err)
+	}
+	return nil
+}
+
+// heartbeat sends a PING every HeartbeatInterval until done is closed
+func (c *Client) heartbeat(done chan struct{}) {
+	ticker := time.NewTicker(c.HeartbeatInterval)
+	defer ticker.Stop()
+
+	var nonce uint32
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			nonce++
+			payload := models.HeartbeatPayload{Nonce: nonce}
+			// A failed write shows up as a failed read as well
+			if err := c.writePDU(variables.Ping, 0, &payload); err != nil {
 				return
 			}
 		}
-	}()
+	}
+}
+
+// start runs the reader goroutine unless it is already running
+func (c *Client) start() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.reading {
+		return
+	}
+	c.reading = true
+	go c.run()
 }
 
-func (c *Client) DisplayParticipants() {
-	if c.Mode == "Select" {
-		clearScreen()
-		fmt.Println("Participant List:")
-		fmt.Println("=================")
-		i := 1
-		for username := range c.OtherPublicKeys {
-			fmt.Printf("%d. %s\n", i, username)
-			i++
+// run processes PDUs from the server. If the connection drops and Dial is
+// set, the client reconnects and resumes its session.
+func (c *Client) run() {
+	defer close(c.events)
+	defer close(c.stopped)
+
+	for {
+		err := c.readServerMessages()
+		if err == ErrSessionReplaced || errors.Is(err, ErrProtocolVersion) {
+			c.emit(Event{Type: Disconnected, Err: err})
+		}
+		if c.State() == TERMINATED {
+			return
+		}
+
+		c.emit(Event{Type: Disconnected, Err: err})
+		if c.Dial == nil {
+			return
 		}
-		fmt.Printf("=================\n\n")
 
-		fmt.Printf("Enter participant number to chat: ")
+		if err := c.reconnect(); err != nil {
+			c.emit(Event{Type: Disconnected, Err: err})
+			return
+		}
+		c.emit(Event{Type: Reconnected})
 	}
 }
 
-func (c *Client) StartMessagingUI() {
+// Connected reports whether the client is logged in and the connection is
+// up
+func (c *Client) Connected() bool {
+	return c.connected()
+}
 
-	scanner := bufio.NewScanner(os.Stdin)
+// State returns the state of the session
+func (c *Client) State() State {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-	for {
-		c.Mode = "Select"
+	return c.state
+}
+
+func (c *Client) setState(state State) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.state = state
+}
 
-		c.DisplayParticipants()
+// advance moves the session to state if it is in one of from, so a session
+// ended meanwhile stays TERMINATED
+func (c *Client) advance(state State, from ...State) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
 
-		scanner.Scan()
-		input := scanner.Text()
+	for _, s := range from {
+		if c.state == s {
+			c.state = state
+			return
+		}
+	}
+}
 
-		participantNumber, err := strconv.Atoi(input)
+// readServerMessages reads PDUs until the connection fails or the session
+// ends
+func (c *Client) readServerMessages() error {
+	done := make(chan struct{})
+	defer close(done)
+	go c.heartbeat(done)
 
+	for {
+		// Any PDU, including a PONG, proves the server is still there
+		c.Conn.SetReadDeadline(time.Now().Add(c.HeartbeatInterval + c.HeartbeatTimeout))
+
+		// Read the header
+		header, err := c.readHeader()
+		if errors.Is(err, ErrProtocolVersion) {
+			c.setState(TERMINATED)
+			return err
+		}
 		if err != nil {
-			fmt.Println("Invalid participant number. Please try again.")
-			continue
+			return err
 		}
 
-		i := 1
-		var recipientUsername string
-		for username := range c.OtherPublicKeys {
-			if i == participantNumber {
-				recipientUsername = username
-				break
+		// Read the payload based on the message type
+		switch header.Type {
+		case variables.KeyExchange:
+			// Handle KEY_EXCHANGE based on the current state
+			switch state := c.State(); state {
+			case PUBLIC_KEY_SENT, CHAT, PUBLIC_KEY_RECVD:
+				var payload models.PublicKeyPayload
+				err = binary.Read(c.Conn, binary.BigEndian, &payload)
+				if err != nil {
+					return fmt.Errorf("failed to read KEY_EXCHANGE payload from server: %v", err)
+				}
+
+				c.handlePublicKey(payload)
+
+				// Transition to the next state
+				c.advance(PUBLIC_KEY_RECVD, PUBLIC_KEY_SENT)
+
+			default:
+				return fmt.Errorf("received KEY_EXCHANGE in an unexpected state: %v", state)
 			}
-			i++
-		}
 
-		if recipientUsername == "" {
-			fmt.Println("Invalid participant number. Please try again.")
-			continue
-		}
+		case variables.Message:
+			// Handle MESSAGE based on the current state. Messages kept in
+			// the mailbox may come before any key when nobody else is online.
+			switch state := c.State(); state {
+			case CHAT, PUBLIC_KEY_RECVD, PUBLIC_KEY_SENT:
+				c.advance(CHAT, PUBLIC_KEY_RECVD, PUBLIC_KEY_SENT)
+				var payload models.MessagePayload
+				err = binary.Read(c.Conn, binary.BigEndian, &payload)
+				if err != nil {
+					return fmt.Errorf("failed to read MESSAGE payload from server: %v", err)
+				}
 
-		for {
-			c.Mode = "Message"
-			c.State = CHAT
+				sender := string(bytes.Trim(payload.Sender[:], "\x00"))
+				room := string(bytes.Trim(payload.Room[:], "\x00"))
 
-			fmt.Print("Your Message: ")
-			scanner.Scan()
-			message := scanner.Text()
+				// Decrypt the data using own private key
+				ciphertext, err := unpackData(payload.Data)
+				if err != nil {
+					c.emit(Event{Type: Error, Contact: sender, Err: err})
+					continue
+				}
+				env, err := c.openEnvelope(ciphertext, sender, room)
+				if err != nil {
+					c.emit(Event{Type: Error, Contact: sender, Err: err})
+					continue
+				}
+				// Sent again by the sender or the mailbox after a
+				// connection dropped
+				if c.session.received(sender, env.ID) {
+					continue
+				}
 
-			if message == "" || c.State == PUBLIC_KEY_RECVD {
-				break
+				// The server's time orders the messages, the sender's is only
+				// compared with it
+				received := time.Now()
+				if payload.Received != 0 {
+					received = time.Unix(int64(payload.Received), 0)
+				}
+				event := Event{
+					Type:        MessageReceived,
+					Contact:     sender,
+					Room:        room,
+					ID:          env.ID,
+					ReplyTo:     env.ReplyTo,
+					ContentType: env.Type,
+					Meta:        env.Meta,
+					Text:        env.Text,
+					Time:        received,
+				}
+				if env.Expires != 0 {
+					event.Expires = time.Unix(env.Expires, 0)
+					// Gone before it arrived
+					if !time.Now().Before(event.Expires) {
+						continue
+					}
+				}
+				switch env.Kind {
+				case kindMessage:
+				case kindEdit:
+					event.Type, event.ID = MessageEdited, env.Target
+				case kindDelete:
+					event.Type, event.ID = MessageDeleted, env.Target
+				case kindTimer:
+					if env.Timer < 0 || env.Timer > int64(MaxTimer/time.Second) {
+						c.emit(Event{Type: Error, Contact: sender, Err: fmt.Errorf("invalid timer from %s", sender)})
+						continue
+					}
+					key := timerKey{contact: sender}
+					if room != "" {
+						key = timerKey{room: room}
+					}
+					event.Type, event.Timer = TimerChanged, time.Duration(env.Timer)*time.Second
+					c.setTimer(key, event.Timer)
+				case kindReaction:
+					if !ValidReaction(env.Text) {
+						c.emit(Event{Type: Error, Contact: sender, Err: fmt.Errorf("invalid reaction from %s", sender)})
+						continue
+					}
+					event.Type, event.ID = ReactionReceived, env.Target
+				default:
+					c.emit(Event{Type: Error, Contact: sender, Err: fmt.Errorf("unknown kind of message %q", env.Kind)})
+					continue
+				}
+				if payload.Timestamp != 0 {
+					event.Sent = time.Unix(int64(payload.Timestamp), 0)
+					skew := received.Sub(event.Sent)
+					if skew > c.MaxClockSkew || -skew > c.MaxClockSkew {
+						event.ClockSkew = skew
+					}
+				}
+				c.emit(event)
+
+			default:
+				return fmt.Errorf("received MESSAGE in an unexpected state: %v", state)
 			}
 
-			// Encrypt the data using recipient's public key
-			encryptedData, err := c.EncryptData([]byte(message), recipientUsername)
+		case variables.MessageAck:
+			var payload models.MessageAckPayload
+			err = binary.Read(c.Conn, binary.BigEndian, &payload)
 			if err != nil {
-				log.Printf("Failed to encrypt message: %v", err)
-				return
+				return fmt.Errorf("failed to read MESSAGE_ACK payload from server: %v", err)
 			}
 
-			var data [2048]byte
-			copy(data[:], encryptedData)
+			c.session.ack(payload.Sequence)
+
+		case variables.TwoFactorAck:
+			var payload models.TwoFactorAckPayload
+			err = binary.Read(c.Conn, binary.BigEndian, &payload)
 			if err != nil {
-				log.Printf("Failed to write header to server: %v", err)
-				return
+				return fmt.Errorf("failed to read TWO_FACTOR_ACK payload from server: %v", err)
 			}
 
-			header := models.Header{
-				Version:  variables.Version,
-				Type:     variables.Message,
-				Length:   uint16(binary.Size(encryptedData)),
-				Sequence: 0, // Sequence number, update this as needed
+			select {
+			case c.twoFactorAcks <- payload:
+			default:
+				c.emit(Event{Type: Error, Err: errors.New("unexpected TWO_FACTOR_ACK")})
 			}
 
-			payload := models.MessagePayload{
-				Timestamp: 0, // Update this with the current timestamp
-				Sender:    c.Username,
-				Recipient: [32]byte(stringToByteArray32(recipientUsername)),
-				TextLen:   uint16(len(message)),
-				Data:      data,
+		case variables.RoomMembers:
+			var payload models.RoomMembersPayload
+			err = binary.Read(c.Conn, binary.BigEndian, &payload)
+			if err != nil {
+				return fmt.Errorf("failed to read ROOM_MEMBERS payload from server: %v", err)
 			}
 
-			// Write header and payload
-			err = binary.Write(c.Conn, binary.BigEndian, &header)
+			c.handleRoomMembers(payload)
+
+		case variables.RoomList:
+			var payload models.RoomListPayload
+			err = binary.Read(c.Conn, binary.BigEndian, &payload)
 			if err != nil {
-				log.Printf("Failed to write header to server: %v", err)
-				return
+				return fmt.Errorf("failed to read ROOM_LIST payload from server: %v", err)
+			}
+
+			select {
+			case c.roomLists <- payload:
+			default:
+				c.emit(Event{Type: Error, Err: errors.New("unexpected ROOM_LIST")})
+			}
+
+		case variables.Disconnect:
+			var payload models.DisconnectPayload
+			err = binary.Read(c.Conn, binary.BigEndian, &payload)
+			if err != nil {
+				return fmt.Errorf("failed to read DISCONNECT payload from server: %v", err)
+			}
+
+			c.Conn.Close()
+			switch payload.Reason {
+			case variables.ServerRequest:
+				return errors.New("disconnected by server")
+			case variables.SessionReplaced:
+				c.setState(TERMINATED)
+				return ErrSessionReplaced
 			}
+			c.setState(TERMINATED)
+			return nil
 
-			err = binary.Write(c.Conn, binary.BigEndian, &payload)
+		case variables.Ping:
+			var payload models.HeartbeatPayload
+			err = binary.Read(c.Conn, binary.BigEndian, &payload)
 			if err != nil {
-				log.Printf("Failed to write payload to server: %v", err)
+				return fmt.Errorf("failed to read PING payload from server: %v", err)
 			}
+
+			if err := c.writePDU(variables.Pong, 0, &payload); err != nil {
+				return fmt.Errorf("failed to write PONG to server: %v", err)
+			}
+			c.expirePending()
+
+		case variables.Pong:
+			var payload models.HeartbeatPayload
+			err = binary.Read(c.Conn, binary.BigEndian, &payload)
+			if err != nil {
+				return fmt.Errorf("failed to read PONG payload from server: %v", err)
+			}
+
+		default:
+			return fmt.Errorf("unknown message type received from server: %d", header.Type)
 		}
 	}
 }
 
-func (c *Client) EncryptData(plaintext []byte, recipientUsername string) ([]byte, error) {
-	publicKey, ok := c.OtherPublicKeys[recipientUsername]
-	if !ok {
-		return nil, fmt.Errorf("public key for user %s not found", recipientUsername)
+// handlePublicKey records a contact's key, or removes the contact if the
+// key is empty, and reports the change
+func (c *Client) handlePublicKey(payload models.PublicKeyPayload) {
+	username := string(bytes.Trim(payload.Username[:], "\x00"))
+
+	// Handle other Client disconnect
+	if payload.Key == [512]byte{} {
+		c.mutex.Lock()
+		key, online := c.OtherPublicKeys[username]
+		if online {
+			c.lastKeys[username] = key
+		}
+		delete(c.OtherPublicKeys, username)
+		c.mutex.Unlock()
+
+		if online {
+			c.emit(Event{Type: ContactOffline, Contact: username})
+		}
+		return
 	}
-	pubInterface, err := x509.ParsePKIXPublicKey(bytes.Trim(publicKey[:], "\x00"))
-	if err != nil {
-		return nil, err
+
+	fingerprint := Fingerprint(payload.Key)
+
+	c.mutex.Lock()
+	_, online := c.OtherPublicKeys[username]
+	previous, seen := c.fingerprints[username]
+	c.OtherPublicKeys[username] = payload.Key
+	c.fingerprints[username] = fingerprint
+	delete(c.lastKeys, username)
+	c.mutex.Unlock()
+
+	if !online {
+		c.emit(Event{Type: ContactOnline, Contact: username, Fingerprint: fingerprint})
 	}
-	pub, ok := pubInterface.(*rsa.PublicKey)
-	if !ok {
-		return nil, errors.New("could not cast publicKey to rsa.PublicKey")
+	if seen && previous != fingerprint {
+		c.emit(Event{Type: KeyChanged, Contact: username, Fingerprint: fingerprint})
 	}
-	encrypted, err := rsa.EncryptPKCS1v15(rand.Reader, pub, plaintext)
-	if err != nil {
-		return nil, err
-	}
-	return encrypted, nil
+
+	// Deliver anything that was waiting for this participant
+	c.flushPending(username)
 }
 
-func (c *Client) DecryptData(ciphertext []byte) ([]byte, error) {
-	plaintext, err := rsa.DecryptPKCS1v15(rand.Reader, c.OwnPrivateKey, ciphertext)
-	if err != nil {
-		return nil, fmt.Errorf("could not decrypt ciphertext: %v", err)
+// RestoreFingerprint sets the fingerprint of a contact's key seen in an
+// earlier session, e.g. from History.KnownKeys. Messages kept in the mailbox
+// are verified against it when the contact is away, and KeyChanged is sent
+// when the contact comes back with another key.
+func (c *Client) RestoreFingerprint(contact string, fingerprint string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.fingerprints[contact]; !ok {
+		c.fingerprints[contact] = fingerprint
 	}
-	return plaintext, nil
 }
 
-func (c *Client) SendPublicKey() {
-	header := models.Header{
-		Version:  variables.Version,
-		Type:     variables.KeyExchange,
-		Length:   uint16(binary.Size(c.OwnPublicKey)),
-		Sequence: 0, // Sequence number, update this as needed
+// publicKey returns the key messages to another participant are encrypted
+// to: the one published while online, the last one seen otherwise
+func (c *Client) publicKey(username string) ([512]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	key, ok := c.OtherPublicKeys[username]
+	if !ok {
+		key, ok = c.lastKeys[username]
 	}
+	return key, ok
+}
 
+func (c *Client) SendPublicKey() error {
 	payload := models.PublicKeyPayload{
 		Username: c.Username,
 		Key:      c.OwnPublicKey,
 	}
 	// Write header and payload
-	err := binary.Write(c.Conn, binary.BigEndian, &header)
-	if err != nil {
-		log.Printf("Failed to write header to server: %v", err)
-		return
-	}
-	err = binary.Write(c.Conn, binary.BigEndian, &payload)
+	err := c.writePDU(variables.KeyExchange, 0, &payload)
 	if err != nil {
-		log.Printf("Failed to write payload to server: %v", err)
+		return fmt.Errorf("failed to write KEY_EXCHANGE to server: %v", err)
 	}
+	return nil
 }
 
-func (c *Client) SendDisconnectRequest() {
-	header := models.Header{
-		Version:  variables.Version,
-		Type:     variables.Disconnect,
-		Length:   uint16(0),
-		Sequence: 0, // Sequence number, update this as needed
-	}
+// SendDisconnectRequest ends the session. The server closes the connection
+// and the Events channel is closed.
+func (c *Client) SendDisconnectRequest() error {
+	c.setState(TERMINATED)
 
 	payload := models.DisconnectPayload{
 		Reason: variables.UserRequest,
 	}
 	// Write header and payload
-	err := binary.Write(c.Conn, binary.BigEndian, &header)
+	err := c.writePDU(variables.Disconnect, 0, &payload)
 	if err != nil {
-		log.Printf("Failed to write header to server: %v", err)
-		return
+		return fmt.Errorf("failed to write DISCONNECT to server: %v", err)
 	}
-	err = binary.Write(c.Conn, binary.BigEndian, &payload)
-	if err != nil {
-		log.Printf("Failed to write payload to server: %v", err)
-	}
-}
-
-func clearScreen() {
-	fmt.Print("\033[H\033[2J")
-}
-
-func clearLine() {
-	fmt.Print("\033[2K\r")
+	return nil
 }
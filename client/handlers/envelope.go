@@ -0,0 +1,406 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"scrp/models"
+	"unicode"
+	"unicode/utf8"
+)
+
+// ErrMessageTooLong is returned when a message does not fit in a MESSAGE
+// once encrypted
+var ErrMessageTooLong = errors.New("message too long")
+
+// Kinds of envelope
+const (
+	kindMessage  = "message"
+	kindEdit     = "edit"
+	kindDelete   = "delete"
+	kindReaction = "reaction"
+	kindTimer    = "timer"
+)
+
+// Version of the envelope format sent. Envelopes without a version were
+// sent before there was one and are read as version 1.
+const envelopeVersion = 1
+
+// Content types of an envelope. A message is text, markdown or a file
+// reference, edits, deletions, reactions and timers are control envelopes.
+const (
+	ContentText     = "text"
+	ContentMarkdown = "markdown"
+	ContentFile     = "file"
+	ContentControl  = "control"
+)
+
+// Metadata of a file reference. The file itself is not sent, the digest
+// lets the recipient check the one they get by other means.
+const (
+	MetaFileName   = "name"
+	MetaFileSize   = "size"
+	MetaFileSHA256 = "sha256"
+)
+
+// Longest reaction accepted, enough for any emoji sequence
+const maxReactionLen = 32
+
+// PaddingPolicy returns the length a plaintext of n bytes is padded to
+// before it is encrypted, at least n. The server sees how long the
+// ciphertext is, padding keeps it from learning the length of the message.
+type PaddingPolicy func(n int) int
+
+// NoPadding encrypts plaintexts as they are
+func NoPadding(n int) int {
+	return n
+}
+
+// BucketPadding pads to the smallest of the sizes, in ascending order, that
+// fits the plaintext, and longer plaintexts to a multiple of the largest
+func BucketPadding(sizes ...int) PaddingPolicy {
+	return func(n int) int {
+		for _, size := range sizes {
+			if n <= size {
+				return size
+			}
+		}
+		if len(sizes) == 0 {
+			return n
+		}
+		largest := sizes[len(sizes)-1]
+		return (n + largest - 1) / largest * largest
+	}
+}
+
+// DefaultPadding is the padding of a new client. An envelope with its
+// embedded key and signature takes up at least 700 bytes, plaintexts longer
+// than the largest bucket are padded to the most that fits in a MESSAGE.
+var DefaultPadding = BucketPadding(768, 1024, 1280, 1536)
+
+// Content is the body of a message
+type Content struct {
+	// ContentText, ContentMarkdown or ContentFile
+	Type string
+	Text string
+	Meta map[string]string
+}
+
+// envelope is what a MESSAGE carries encrypted. It names both ends and is
+// signed by the sender, so the server can neither forge it nor pass it on to
+// someone else. The signing key travels along since messages kept in the
+// mailbox may arrive after the sender has gone, it is only accepted when its
+// fingerprint is the one the sender published.
+type envelope struct {
+	Version int    `json:"v"`
+	ID      string `json:"id"`
+	Kind    string `json:"kind"`
+	// Content type, ContentControl for every kind but messages
+	Type      string `json:"type"`
+	Sender    string `json:"sender"`
+	Recipient string `json:"recipient"`
+	Room      string `json:"room,omitempty"`
+	// Message an edit, delete or reaction applies to
+	Target string `json:"target,omitempty"`
+	// Message a reply is in the thread of
+	ReplyTo string `json:"reply_to,omitempty"`
+	// Text of a message or edit, the emoji of a reaction
+	Text string `json:"text,omitempty"`
+	// Metadata of the content, e.g. of a file reference
+	Meta map[string]string `json:"meta,omitempty"`
+	// When a disappearing message expires, in seconds since the epoch
+	Expires int64 `json:"expires,omitempty"`
+	// Seconds after which messages in the conversation disappear, set by a
+	// timer envelope, zero to keep them
+	Timer int64 `json:"timer,omitempty"`
+	// PKIX form of the public key the envelope is signed with
+	Key []byte `json:"key"`
+}
+
+// ValidReaction reports whether a reaction can be sent: a short emoji or
+// word without spaces or control characters
+func ValidReaction(reaction string) bool {
+	if reaction == "" || len(reaction) > maxReactionLen || !utf8.ValidString(reaction) {
+		return false
+	}
+	for _, r := range reaction {
+		if unicode.IsSpace(r) || unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// newMessageID returns a random message ID
+func newMessageID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// sealEnvelope signs an envelope with the own key and encrypts it for its
+// recipient
+func (c *Client) sealEnvelope(env envelope) ([]byte, error) {
+	env.Key = bytes.Trim(c.OwnPublicKey[:], "\x00")
+	body, err := json.Marshal(env)
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256(body)
+	signature, err := rsa.SignPSS(rand.Reader, c.OwnPrivateKey, crypto.SHA256, digest[:], nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not sign message: %v", err)
+	}
+	return c.EncryptData(append(body, signature...), env.Recipient)
+}
+
+// openEnvelope decrypts a message and checks its signature and that it was
+// sent by sender to this client
+func (c *Client) openEnvelope(ciphertext []byte, sender string, room string) (envelope, error) {
+	var env envelope
+
+	plain, err := c.DecryptData(ciphertext)
+	if err != nil {
+		return env, err
+	}
+
+	// The signature is as long as the modulus of the key, which is only
+	// known after parsing the body in front of it
+	decoder := json.NewDecoder(bytes.NewReader(plain))
+	if err := decoder.Decode(&env); err != nil {
+		return env, fmt.Errorf("invalid message envelope: %v", err)
+	}
+	// The key travels along for messages from contacts that went away, but
+	// it has to be the one the contact published. Otherwise the server
+	// could sign messages in anyone's name with a key of its own.
+	c.mutex.Lock()
+	known, ok := c.fingerprints[sender]
+	c.mutex.Unlock()
+	if !ok {
+		return env, fmt.Errorf("message from %s can not be verified, its key is not known yet", sender)
+	}
+	if len(env.Key) > len(c.OwnPublicKey) {
+		return env, fmt.Errorf("invalid key in message envelope from %s", sender)
+	}
+	var embedded [512]byte
+	copy(embedded[:], env.Key)
+	if Fingerprint(embedded) != known {
+		return env, fmt.Errorf("message from %s is not signed with the key it published", sender)
+	}
+
+	key, err := parsePublicKey(env.Key)
+	if err != nil {
+		return env, fmt.Errorf("invalid key in message envelope: %v", err)
+	}
+	if len(plain) < key.Size() {
+		return env, errors.New("message envelope is not signed")
+	}
+	body, signature := plain[:len(plain)-key.Size()], plain[len(plain)-key.Size():]
+
+	digest := sha256.Sum256(body)
+	if err := rsa.VerifyPSS(key, crypto.SHA256, digest[:], signature, nil); err != nil {
+		return env, fmt.Errorf("invalid signature on message from %s", sender)
+	}
+
+	own := string(bytes.Trim(c.Username[:], "\x00"))
+	if env.Sender != sender || env.Recipient != own || env.Room != room {
+		return env, fmt.Errorf("message from %s was not addressed to this conversation", sender)
+	}
+	if env.ID == "" {
+		return env, errors.New("message envelope without an ID")
+	}
+
+	if env.Version == 0 {
+		env.Version = 1
+		env.Type = ContentText
+		if env.Kind != kindMessage {
+			env.Type = ContentControl
+		}
+	}
+	if env.Version > envelopeVersion {
+		return env, fmt.Errorf("message from %s has unsupported envelope version %d", sender, env.Version)
+	}
+	valid := env.Type == ContentControl
+	if env.Kind == kindMessage {
+		valid = validContent(env.Type)
+	}
+	if !valid {
+		return env, fmt.Errorf("message from %s has invalid content type %q", sender, env.Type)
+	}
+	return env, nil
+}
+
+// validContent reports whether a message can have the content type
+func validContent(contentType string) bool {
+	return contentType == ContentText || contentType == ContentMarkdown || contentType == ContentFile
+}
+
+// EncryptData encrypts plaintext for a contact with a fresh AES-GCM key,
+// which is itself encrypted with the contact's public key using RSA-OAEP.
+// The plaintext is put behind its length and padded as the client's Padding
+// says, but never beyond what fits in a MESSAGE.
+func (c *Client) EncryptData(plaintext []byte, recipientUsername string) ([]byte, error) {
+	publicKey, ok := c.publicKey(recipientUsername)
+	if !ok {
+		return nil, fmt.Errorf("public key for user %s not found", recipientUsername)
+	}
+	pub, err := parsePublicKey(bytes.Trim(publicKey[:], "\x00"))
+	if err != nil {
+		return nil, err
+	}
+
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+
+	padded, err := c.pad(plaintext, len(models.MessagePayload{}.Data)-2-len(wrapped)-len(nonce)-aead.Overhead())
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := append(wrapped, nonce...)
+	return aead.Seal(encrypted, nonce, padded, wrapped), nil
+}
+
+// pad puts plaintext behind its length and pads it with zeros to the size
+// the padding policy asks for, or to limit if that is less
+func (c *Client) pad(plaintext []byte, limit int) ([]byte, error) {
+	if len(plaintext) > math.MaxUint16 {
+		return nil, ErrMessageTooLong
+	}
+
+	size := 2 + len(plaintext)
+	if c.Padding != nil {
+		size = c.Padding(size)
+	}
+	if size > limit {
+		size = limit
+	}
+	if size < 2+len(plaintext) {
+		size = 2 + len(plaintext)
+	}
+
+	padded := make([]byte, size)
+	binary.BigEndian.PutUint16(padded, uint16(len(plaintext)))
+	copy(padded[2:], plaintext)
+	return padded, nil
+}
+
+// DecryptData reverses EncryptData with the own private key
+func (c *Client) DecryptData(ciphertext []byte) ([]byte, error) {
+	size := c.OwnPrivateKey.Size()
+	if len(ciphertext) < size {
+		return nil, errors.New("could not decrypt ciphertext: too short")
+	}
+	wrapped, sealed := ciphertext[:size], ciphertext[size:]
+
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, c.OwnPrivateKey, wrapped, nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt ciphertext: %v", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("could not decrypt ciphertext: too short")
+	}
+
+	padded, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt ciphertext: %v", err)
+	}
+
+	// The padding is authenticated with the rest, only the length has to
+	// make sense
+	if len(padded) < 2 || int(binary.BigEndian.Uint16(padded)) > len(padded)-2 {
+		return nil, errors.New("could not decrypt ciphertext: invalid length")
+	}
+	return padded[2 : 2+binary.BigEndian.Uint16(padded)], nil
+}
+
+// packData puts a ciphertext into the Data of a MESSAGE behind its length,
+// since a ciphertext may end in zero bytes
+func packData(ciphertext []byte) ([2048]byte, error) {
+	var data [2048]byte
+	if len(ciphertext) > len(data)-2 {
+		return data, ErrMessageTooLong
+	}
+	binary.BigEndian.PutUint16(data[:2], uint16(len(ciphertext)))
+	copy(data[2:], ciphertext)
+	return data, nil
+}
+
+func unpackData(data [2048]byte) ([]byte, error) {
+	length := int(binary.BigEndian.Uint16(data[:2]))
+	if length > len(data)-2 {
+		return nil, errors.New("invalid MESSAGE data length")
+	}
+	return data[2 : 2+length], nil
+}
+
+func parsePublicKey(der []byte) (*rsa.PublicKey, error) {
+	pubInterface, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	pub, ok := pubInterface.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("could not cast publicKey to rsa.PublicKey")
+	}
+	return pub, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// checkSize returns ErrMessageTooLong when an envelope would not fit in a
+// MESSAGE. Keys of contacts are taken to be as long as the own one.
+func (c *Client) checkSize(env envelope) error {
+	env.Key = bytes.Trim(c.OwnPublicKey[:], "\x00")
+	body, err := json.Marshal(env)
+	if err != nil {
+		return err
+	}
+
+	// Encrypted key, nonce, GCM tag, plaintext length and signature around
+	// the body. The padding is left out, it only fills what is left.
+	size := c.OwnPrivateKey.Size() + 12 + 16 + 2 + len(body) + c.OwnPrivateKey.Size()
+	if size > len(models.MessagePayload{}.Data)-2 {
+		return ErrMessageTooLong
+	}
+	return nil
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"bytes"
+	"scrp/models"
+	"testing"
+)
+
+func TestEncryptDataPadding(t *testing.T) {
+	client, err := NewClientWithKey("alice", generateKey(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Encrypting to itself keeps the test to a single key
+	client.OtherPublicKeys["alice"] = client.OwnPublicKey
+
+	// The most a padded plaintext may take, after the wrapped key, the
+	// AES-GCM nonce and tag and the length of the ciphertext
+	limit := len(models.MessagePayload{}.Data) - 2 - client.OwnPrivateKey.Size() - 12 - 16
+
+	tests := []struct {
+		// Length of the plaintext and the length it is padded to, both
+		// including the two bytes of the length
+		length int
+		padded int
+	}{
+		{2, 768},
+		{768, 768},
+		{769, 1024},
+		{1024, 1024},
+		{1025, 1280},
+		{1280, 1280},
+		{1281, 1536},
+		{1536, 1536},
+		{1537, limit},
+		{limit, limit},
+		{limit + 1, limit + 1},
+	}
+
+	for _, test := range tests {
+		plaintext := bytes.Repeat([]byte{'a'}, test.length-2)
+
+		ciphertext, err := client.EncryptData(plaintext, "alice")
+		if err != nil {
+			t.Fatalf("EncryptData of %d bytes: %v", len(plaintext), err)
+		}
+		overhead := client.OwnPrivateKey.Size() + 12 + 16
+		if padded := len(ciphertext) - overhead; padded != test.padded {
+			t.Errorf("%d bytes padded to %d, want %d", len(plaintext), padded, test.padded)
+		}
+
+		decrypted, err := client.DecryptData(ciphertext)
+		if err != nil {
+			t.Fatalf("DecryptData of %d bytes: %v", len(plaintext), err)
+		}
+		if !bytes.Equal(decrypted, plaintext) {
+			t.Errorf("%d bytes decrypted to %d other bytes", len(plaintext), len(decrypted))
+		}
+
+		// Only what is padded beyond the limit does not fit in a MESSAGE
+		_, err = packData(ciphertext)
+		if tooLong := test.padded > limit; (err == ErrMessageTooLong) != tooLong {
+			t.Errorf("packData of %d bytes: %v", len(plaintext), err)
+		}
+	}
+}
@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"sort"
+	"time"
+)
+
+// EventType tells what an Event is about
+type EventType int
+
+const (
+	// MessageReceived carries a decrypted message from a contact
+	MessageReceived EventType = iota
+	// ContactOnline is sent when a contact's public key arrives
+	ContactOnline
+	// ContactOffline is sent when a contact goes away
+	ContactOffline
+	// KeyChanged is sent when a contact comes back with a different public
+	// key than the one seen before. It is up to the user to verify the new
+	// fingerprint.
+	KeyChanged
+	// Disconnected is sent when the connection drops. Err says why. If Dial
+	// is set the client reconnects on its own.
+	Disconnected
+	// Reconnected is sent once a dropped session has been resumed
+	Reconnected
+	// RoomChanged is sent when the members of a room the user is in change,
+	// including when the user joins or leaves
+	RoomChanged
+	// MessageEdited is sent when a contact replaces the text of an earlier
+	// message, MessageDeleted when they withdraw one. Both must only be
+	// applied to a message from the same contact in the same conversation.
+	MessageEdited
+	MessageDeleted
+	// ReactionReceived is sent when a contact reacts to a message in the
+	// conversation, Text is the reaction
+	ReactionReceived
+	// TimerChanged is sent when a contact sets how long messages in the
+	// conversation last, Timer is zero when they stay
+	TimerChanged
+	// Error reports a problem that did not end the session
+	Error
+)
+
+// Event is delivered on the Events channel. Only the fields that apply to
+// the event type are set.
+type Event struct {
+	Type EventType
+
+	// The contact the event is about
+	Contact string
+	// The room a MessageReceived was sent to, or the room of a RoomChanged
+	Room string
+
+	// Members of the room after a RoomChanged, and whether the user is
+	// still one of them
+	Members []string
+	Joined  bool
+
+	// ID of a MessageReceived, or of the message a MessageEdited,
+	// MessageDeleted or ReactionReceived applies to
+	ID string
+	// Message a MessageReceived replies to, empty when it is not a reply
+	ReplyTo string
+	// Content type and metadata of a MessageReceived. Text and metadata
+	// come from the contact as they are and may hold control characters.
+	ContentType string
+	Meta        map[string]string
+	// When a disappearing MessageReceived has to be dropped, zero when it
+	// stays
+	Expires time.Time
+	// Timer of a TimerChanged
+	Timer time.Duration
+
+	// Text of a MessageReceived or MessageEdited, when the server received
+	// it and when the sender sent it by its own clock. ClockSkew is how far
+	// the sender's clock is behind, set beyond MaxClockSkew only.
+	Text      string
+	Time      time.Time
+	Sent      time.Time
+	ClockSkew time.Duration
+
+	// Fingerprint of the contact's public key for ContactOnline and
+	// KeyChanged
+	Fingerprint string
+
+	Err error
+}
+
+// Contact is another user that is online
+type Contact struct {
+	Username    string
+	Fingerprint string
+}
+
+// Events returns the channel on which the client reports what happens in
+// the session. It must be drained: the client stops reading from the server
+// while the channel is full. It is closed when the session has ended for
+// good.
+func (c *Client) Events() <-chan Event {
+	return c.events
+}
+
+func (c *Client) emit(event Event) {
+	c.events <- event
+}
+
+// Contacts returns the users that are online, sorted by username
+func (c *Client) Contacts() []Contact {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	contacts := make([]Contact, 0, len(c.OtherPublicKeys))
+	for username, key := range c.OtherPublicKeys {
+		contacts = append(contacts, Contact{
+			Username:    username,
+			Fingerprint: Fingerprint(key),
+		})
+	}
+
+	sort.Slice(contacts, func(i, j int) bool { return contacts[i].Username < contacts[j].Username })
+	return contacts
+}
+
+// Fingerprint returns the base64 SHA-256 hash of a public key, in the same
+// format as SPKIPin
+func Fingerprint(key [512]byte) string {
+	sum := sha256.Sum256(bytes.Trim(key[:], "\x00"))
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -0,0 +1,639 @@
+package handlers
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// ErrWrongPassphrase is returned by OpenHistory when the passphrase does not
+// match the one the history was created with
+var ErrWrongPassphrase = errors.New("wrong history passphrase")
+
+// ErrMessageNotFound is returned by Edit and DeleteMessage when the
+// conversation has no such message from the sender
+var ErrMessageNotFound = errors.New("message not found")
+
+// Text encrypted into the key file to check the passphrase
+const historyCheck = "srcp history"
+
+// Largest record accepted when reading a history file
+const maxHistoryRecord = 1 << 20
+
+// Name of the file keeping the disappearing message timers, also
+// authenticated with its record
+const timersFile = "timers"
+
+// historyKeyFile holds what is needed to derive the history key again. The
+// key itself is never stored.
+type historyKeyFile struct {
+	Salt    string `json:"salt"`
+	Time    uint32 `json:"time"`
+	Memory  uint32 `json:"memory"`
+	Threads uint8  `json:"threads"`
+	Check   string `json:"check"`
+}
+
+// HistoryEntry is a message kept in the local history
+type HistoryEntry struct {
+	// Contact, or "#room" for room messages
+	Conversation string    `json:"conversation"`
+	Sender       string    `json:"sender"`
+	Text         string    `json:"text"`
+	Time         time.Time `json:"time"`
+	// ID the message was sent with, empty for messages kept before there
+	// were IDs
+	ID     string `json:"id,omitempty"`
+	Edited bool   `json:"edited,omitempty"`
+	// Message this one replies to
+	ReplyTo string `json:"reply_to,omitempty"`
+	// Content type and metadata, empty for text
+	ContentType string            `json:"content_type,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+	// Who reacted with each reaction
+	Reactions map[string][]string `json:"reactions,omitempty"`
+	// When a disappearing message is dropped, zero when it stays
+	Expires time.Time `json:"expires"`
+}
+
+// AddReaction records a reaction of sender to the entry, once per sender
+// and reaction
+func (e *HistoryEntry) AddReaction(sender string, reaction string) {
+	for _, s := range e.Reactions[reaction] {
+		if s == sender {
+			return
+		}
+	}
+	if e.Reactions == nil {
+		e.Reactions = make(map[string][]string)
+	}
+	e.Reactions[reaction] = append(e.Reactions[reaction], sender)
+}
+
+// History keeps conversations on disk, encrypted with AES-GCM under a key
+// derived from a passphrase with Argon2id. Every conversation is a file of
+// length prefixed records, named by an HMAC of the conversation so that the
+// directory does not reveal who the user talks to.
+type History struct {
+	Dir string
+	// Messages older than Retention are dropped, zero keeps them forever
+	Retention time.Duration
+
+	mutex sync.Mutex
+	aead  cipher.AEAD
+	names []byte
+	// Read on first use
+	index *searchIndex
+	// Earliest expiry of a disappearing message in each conversation file,
+	// nil until Expire has read every file once
+	expiries map[string]time.Time
+}
+
+// DefaultHistoryDir returns the history directory for the user on the server
+// in the user's configuration directory
+func DefaultHistoryDir(username string, server string) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	name := strings.NewReplacer("/", "_", ":", "_", "\\", "_").Replace(tokenKey(username, server))
+	return filepath.Join(dir, "srcp", "history", name), nil
+}
+
+// OpenHistory opens the history in dir, creating it on first use. It
+// returns ErrWrongPassphrase when the passphrase does not match.
+func OpenHistory(dir string, passphrase string, retention time.Duration) (*History, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	path := filepath.Join(dir, "key.json")
+	var keyFile historyKeyFile
+
+	data, err := os.ReadFile(path)
+	switch {
+	case os.IsNotExist(err):
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+		keyFile = historyKeyFile{
+			Salt:    base64.StdEncoding.EncodeToString(salt),
+			Time:    1,
+			Memory:  64 * 1024,
+			Threads: 4,
+		}
+	case err != nil:
+		return nil, err
+	default:
+		if err := json.Unmarshal(data, &keyFile); err != nil {
+			return nil, fmt.Errorf("could not parse history key file: %v", err)
+		}
+	}
+
+	salt, err := base64.StdEncoding.DecodeString(keyFile.Salt)
+	if err != nil {
+		return nil, fmt.Errorf("invalid salt in history key file: %v", err)
+	}
+
+	// The first half encrypts the records, the second names the files
+	key := argon2.IDKey([]byte(passphrase), salt, keyFile.Time, keyFile.Memory, keyFile.Threads, 64)
+	block, err := aes.NewCipher(key[:32])
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &History{
+		Dir:       dir,
+		Retention: retention,
+		aead:      aead,
+		names:     key[32:],
+	}
+
+	if keyFile.Check == "" {
+		check, err := h.seal([]byte(historyCheck), []byte("check"))
+		if err != nil {
+			return nil, err
+		}
+		keyFile.Check = base64.StdEncoding.EncodeToString(check)
+		data, err := json.MarshalIndent(keyFile, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		if err := writeFileAtomic(path, data); err != nil {
+			return nil, err
+		}
+		return h, nil
+	}
+
+	check, err := base64.StdEncoding.DecodeString(keyFile.Check)
+	if err != nil {
+		return nil, fmt.Errorf("invalid check in history key file: %v", err)
+	}
+	plain, err := h.open(check, []byte("check"))
+	if err != nil || string(plain) != historyCheck {
+		return nil, ErrWrongPassphrase
+	}
+	return h, nil
+}
+
+// Append adds a message to the history of its conversation. A message with
+// an ID that is kept already, e.g. delivered again after a restart, is left
+// out.
+func (h *History) Append(entry HistoryEntry) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if entry.ID != "" {
+		index, err := h.searchIndex()
+		if err != nil {
+			return err
+		}
+		if _, ok := index.docs[indexDoc{entry.Conversation, entry.ID}]; ok {
+			return nil
+		}
+	}
+
+	id := h.fileID(entry.Conversation)
+	record, err := h.record(id, entry)
+	if err != nil {
+		return err
+	}
+
+	if err := appendFile(h.path(id), record); err != nil {
+		return err
+	}
+	if at, ok := h.expiries[id]; h.expiries != nil && !entry.Expires.IsZero() && (!ok || entry.Expires.Before(at)) {
+		h.expiries[id] = entry.Expires
+	}
+	return h.indexEntry(entry)
+}
+
+// Load returns the messages kept for a conversation ordered by time, oldest
+// first. Expired messages are dropped from the file.
+func (h *History) Load(conversation string) ([]HistoryEntry, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.load(h.fileID(conversation))
+}
+
+// Edit replaces the text of a message and marks it as edited. Only the
+// sender of a message can edit it.
+func (h *History) Edit(conversation string, id string, sender string, text string) error {
+	return h.change(conversation, id, sender, func(entries []HistoryEntry, i int) []HistoryEntry {
+		entries[i].Text = text
+		entries[i].Edited = true
+		return entries
+	})
+}
+
+// DeleteMessage removes a message. Only its sender can delete it.
+func (h *History) DeleteMessage(conversation string, id string, sender string) error {
+	return h.change(conversation, id, sender, func(entries []HistoryEntry, i int) []HistoryEntry {
+		return append(entries[:i], entries[i+1:]...)
+	})
+}
+
+// React records a reaction of sender to a message from anyone
+func (h *History) React(conversation string, id string, sender string, reaction string) error {
+	return h.change(conversation, id, "", func(entries []HistoryEntry, i int) []HistoryEntry {
+		entries[i].AddReaction(sender, reaction)
+		return entries
+	})
+}
+
+// change applies update to the message with the ID from sender, or from
+// anyone when sender is empty, rewrites the conversation and indexes the
+// message again
+func (h *History) change(conversation string, id string, sender string, update func([]HistoryEntry, int) []HistoryEntry) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	fileID := h.fileID(conversation)
+	entries, err := h.load(fileID)
+	if err != nil {
+		return err
+	}
+
+	for i, entry := range entries {
+		if id == "" || entry.ID != id || (sender != "" && entry.Sender != sender) {
+			continue
+		}
+
+		entries = update(entries, i)
+		if err := h.rewrite(fileID, entries); err != nil {
+			return err
+		}
+		if i < len(entries) && entries[i].ID == id {
+			return h.indexEntry(entries[i])
+		}
+		return h.unindexEntry(entry)
+	}
+	return ErrMessageNotFound
+}
+
+// Delete removes the history of a conversation
+func (h *History) Delete(conversation string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	err := os.Remove(h.path(h.fileID(conversation)))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return h.unindexConversation(conversation)
+}
+
+// Timers returns the disappearing message timers kept for the
+// conversations, by contact or "#room"
+func (h *History) Timers() (map[string]time.Duration, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	return h.timers()
+}
+
+// SetTimer keeps the disappearing message timer of a conversation, zero
+// forgets it
+func (h *History) SetTimer(conversation string, timer time.Duration) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	timers, err := h.timers()
+	if err != nil {
+		return err
+	}
+	if timer <= 0 {
+		delete(timers, conversation)
+	} else {
+		timers[conversation] = timer
+	}
+	return h.writeSettings(timersFile, timers)
+}
+
+func (h *History) timers() (map[string]time.Duration, error) {
+	timers := make(map[string]time.Duration)
+	return timers, h.readSettings(timersFile, &timers)
+}
+
+// readSettings reads a file of the history directory holding a single
+// encrypted JSON record into v, leaving v alone when there is no file
+func (h *History) readSettings(file string, v any) error {
+	records, err := h.readRecords(filepath.Join(h.Dir, file), file)
+	if err != nil || len(records) == 0 {
+		return err
+	}
+	if err := json.Unmarshal(records[0], v); err != nil {
+		return fmt.Errorf("could not parse history file %s: %v", file, err)
+	}
+	return nil
+}
+
+// writeSettings replaces a file read with readSettings
+func (h *History) writeSettings(file string, v any) error {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	record, err := h.sealRecord(plain, file)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(h.Dir, file), record)
+}
+
+// Conversations returns the conversations that have messages kept, sorted
+// by name
+func (h *History) Conversations() ([]string, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	ids, err := h.fileIDs()
+	if err != nil {
+		return nil, err
+	}
+
+	var names []string
+	for _, id := range ids {
+		entries, err := h.load(id)
+		if err != nil {
+			return names, err
+		}
+		if len(entries) > 0 {
+			names = append(names, entries[0].Conversation)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// Prune drops expired messages from every conversation
+func (h *History) Prune() error {
+	if h.Retention == 0 {
+		return nil
+	}
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	ids, err := h.fileIDs()
+	if err != nil {
+		return err
+	}
+	for _, id := range ids {
+		if _, err := h.load(id); err != nil {
+			return err
+		}
+	}
+	return h.expireIndex()
+}
+
+// Expire drops the disappearing messages whose time is up from the
+// conversations and the search index. The first call reads every
+// conversation, later ones only those with a message due.
+func (h *History) Expire() error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	var ids []string
+	if h.expiries == nil {
+		var err error
+		if ids, err = h.fileIDs(); err != nil {
+			return err
+		}
+		h.expiries = make(map[string]time.Time)
+	} else {
+		now := time.Now()
+		for id, at := range h.expiries {
+			if !now.Before(at) {
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	for _, id := range ids {
+		if _, err := h.load(id); err != nil {
+			return err
+		}
+	}
+	return h.expireIndex()
+}
+
+// fileIDs returns the IDs of the conversation files in the directory
+func (h *History) fileIDs() ([]string, error) {
+	files, err := os.ReadDir(h.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, file := range files {
+		if id, ok := strings.CutSuffix(file.Name(), ".hist"); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// load reads a conversation file and rewrites it without the expired
+// messages if there are any
+func (h *History) load(id string) ([]HistoryEntry, error) {
+	records, err := h.readRecords(h.path(id), id)
+	if err != nil {
+		return nil, err
+	}
+
+	var entries []HistoryEntry
+	var expires time.Time
+	expired := false
+	for _, plain := range records {
+		var entry HistoryEntry
+		if err := json.Unmarshal(plain, &entry); err != nil {
+			return entries, fmt.Errorf("could not parse history file %s: %v", h.path(id), err)
+		}
+
+		if h.expired(entry) {
+			expired = true
+			continue
+		}
+		if !entry.Expires.IsZero() && (expires.IsZero() || entry.Expires.Before(expires)) {
+			expires = entry.Expires
+		}
+		entries = append(entries, entry)
+	}
+
+	if h.expiries != nil {
+		if expires.IsZero() {
+			delete(h.expiries, id)
+		} else {
+			h.expiries[id] = expires
+		}
+	}
+
+	// Messages are appended as they arrive, which is not always the order
+	// they were sent in, e.g. when delivered from the server's mailbox
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].Time.Before(entries[j].Time) })
+
+	if expired {
+		if err := h.rewrite(id, entries); err != nil {
+			return entries, err
+		}
+	}
+	return entries, nil
+}
+
+func (h *History) rewrite(id string, entries []HistoryEntry) error {
+	if len(entries) == 0 {
+		return os.Remove(h.path(id))
+	}
+
+	var data []byte
+	for _, entry := range entries {
+		record, err := h.record(id, entry)
+		if err != nil {
+			return err
+		}
+		data = append(data, record...)
+	}
+	return writeFileAtomic(h.path(id), data)
+}
+
+func (h *History) expired(entry HistoryEntry) bool {
+	if !entry.Expires.IsZero() && !time.Now().Before(entry.Expires) {
+		return true
+	}
+	return h.Retention > 0 && time.Since(entry.Time) > h.Retention
+}
+
+// record encrypts an entry into a length prefixed record. The file ID is
+// authenticated so records can not be moved between conversations.
+func (h *History) record(id string, entry HistoryEntry) ([]byte, error) {
+	plain, err := json.Marshal(entry)
+	if err != nil {
+		return nil, err
+	}
+	return h.sealRecord(plain, id)
+}
+
+// sealRecord encrypts plain into a length prefixed record, authenticating
+// the name of the file it belongs to
+func (h *History) sealRecord(plain []byte, file string) ([]byte, error) {
+	sealed, err := h.seal(plain, []byte(file))
+	if err != nil {
+		return nil, err
+	}
+	record := make([]byte, 4, 4+len(sealed))
+	binary.BigEndian.PutUint32(record, uint32(len(sealed)))
+	return append(record, sealed...), nil
+}
+
+// readRecords decrypts the records of a file written with sealRecord. A
+// missing file has no records.
+func (h *History) readRecords(path string, file string) ([][]byte, error) {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var records [][]byte
+	reader := bytes.NewReader(data)
+	for {
+		var length uint32
+		err := binary.Read(reader, binary.BigEndian, &length)
+		if err == io.EOF {
+			break
+		}
+		if err != nil || length > maxHistoryRecord {
+			return records, fmt.Errorf("corrupt history file %s", path)
+		}
+
+		sealed := make([]byte, length)
+		if _, err := io.ReadFull(reader, sealed); err != nil {
+			return records, fmt.Errorf("corrupt history file %s", path)
+		}
+
+		plain, err := h.open(sealed, []byte(file))
+		if err != nil {
+			return records, fmt.Errorf("could not decrypt history file %s: %v", path, err)
+		}
+		records = append(records, plain)
+	}
+	return records, nil
+}
+
+// appendFile appends data to a file only readable by its owner
+func appendFile(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// seal encrypts plain with a random nonce which is prepended to the result
+func (h *History) seal(plain []byte, additional []byte) ([]byte, error) {
+	nonce := make([]byte, h.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return h.aead.Seal(nonce, nonce, plain, additional), nil
+}
+
+func (h *History) open(sealed []byte, additional []byte) ([]byte, error) {
+	if len(sealed) < h.aead.NonceSize() {
+		return nil, errors.New("record too short")
+	}
+	nonce, ciphertext := sealed[:h.aead.NonceSize()], sealed[h.aead.NonceSize():]
+	return h.aead.Open(nil, nonce, ciphertext, additional)
+}
+
+// fileID names the file of a conversation without revealing it
+func (h *History) fileID(conversation string) string {
+	mac := hmac.New(sha256.New, h.names)
+	mac.Write([]byte(conversation))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func (h *History) path(id string) string {
+	return filepath.Join(h.Dir, id+".hist")
+}
+
+// writeFileAtomic writes to a temporary file first so a crash never leaves a
+// truncated file
+func writeFileAtomic(path string, data []byte) error {
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// Name of the file keeping the identity key in the history directory, also
+// authenticated with its record
+const identityFile = "identity"
+
+// Name of the file keeping the fingerprints of the contacts' keys
+const knownKeysFile = "known_keys"
+
+// Size of the identity keys generated
+const identityKeyBits = 2048
+
+// IdentityKey returns the key the user signs and receives messages with,
+// generating it on first use. It is kept encrypted like the conversations,
+// so contacts see the same fingerprint after a restart and messages kept in
+// the server's mailbox can still be decrypted.
+func (h *History) IdentityKey() (*rsa.PrivateKey, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	path := filepath.Join(h.Dir, identityFile)
+	records, err := h.readRecords(path, identityFile)
+	if err != nil {
+		return nil, err
+	}
+	if len(records) > 0 {
+		parsed, err := x509.ParsePKCS8PrivateKey(records[0])
+		if err != nil {
+			return nil, fmt.Errorf("could not parse identity key: %v", err)
+		}
+		key, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return nil, errors.New("identity key is not an RSA key")
+		}
+		return key, nil
+	}
+
+	key, err := rsa.GenerateKey(rand.Reader, identityKeyBits)
+	if err != nil {
+		return nil, fmt.Errorf("could not generate identity key: %v", err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	record, err := h.sealRecord(der, identityFile)
+	if err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, record); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// KnownKeys returns the fingerprints of the contacts' keys seen before, by
+// contact
+func (h *History) KnownKeys() (map[string]string, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	keys := make(map[string]string)
+	return keys, h.readSettings(knownKeysFile, &keys)
+}
+
+// SetKnownKey keeps the fingerprint of a contact's key
+func (h *History) SetKnownKey(contact string, fingerprint string) error {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	keys := make(map[string]string)
+	if err := h.readSettings(knownKeysFile, &keys); err != nil {
+		return err
+	}
+	if keys[contact] == fingerprint {
+		return nil
+	}
+	keys[contact] = fingerprint
+	return h.writeSettings(knownKeysFile, keys)
+}
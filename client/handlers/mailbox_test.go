@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"io"
+	"log"
+	"net"
+	"testing"
+	"time"
+
+	server "scrp/server/handlers"
+)
+
+// startServer serves a server with the default settings on a local port
+// without TLS and returns its address
+func startServer(t *testing.T) string {
+	t.Helper()
+
+	srv, err := server.NewServer(server.WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(context.Background(), listener)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		srv.Shutdown(ctx)
+	})
+	return listener.Addr().String()
+}
+
+// login connects a client with the key to the server and logs it in
+func login(t *testing.T, addr string, username string, key *rsa.PrivateKey) *Client {
+	t.Helper()
+
+	client, err := NewClientWithKey(username, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client.Conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Login("password"); err != nil {
+		t.Fatalf("login as %s: %v", username, err)
+	}
+	t.Cleanup(func() { client.Conn.Close() })
+	return client
+}
+
+// waitEvent returns the first event of the type about the contact, skipping
+// the others
+func waitEvent(t *testing.T, client *Client, eventType EventType, contact string) Event {
+	t.Helper()
+
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event, ok := <-client.Events():
+			if !ok {
+				t.Fatalf("session ended waiting for event %d about %s", eventType, contact)
+			}
+			if event.Type == eventType && event.Contact == contact {
+				return event
+			}
+		case <-timeout:
+			t.Fatalf("no event %d about %s", eventType, contact)
+		}
+	}
+}
+
+func generateKey(t *testing.T) *rsa.PrivateKey {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, identityKeyBits)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSendToOfflineContact(t *testing.T) {
+	addr := startServer(t)
+	aliceKey, bobKey := generateKey(t), generateKey(t)
+
+	alice := login(t, addr, "alice", aliceKey)
+	bob := login(t, addr, "bob", bobKey)
+	waitEvent(t, alice, ContactOnline, "bob")
+
+	if err := bob.SendDisconnectRequest(); err != nil {
+		t.Fatal(err)
+	}
+	waitEvent(t, alice, ContactOffline, "bob")
+
+	// The server accepts the message for its mailbox while bob is away
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := alice.Send(ctx, "bob", "while you were away"); err != nil {
+		t.Fatalf("send to offline contact: %v", err)
+	}
+
+	bob = login(t, addr, "bob", bobKey)
+	event := waitEvent(t, bob, MessageReceived, "alice")
+	if event.Text != "while you were away" {
+		t.Errorf("received %q", event.Text)
+	}
+}
@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"scrp/models"
+	"scrp/variables"
+	"sort"
+)
+
+// JoinRoom asks the server to add the user to a room, creating it if it
+// does not exist. The membership arrives as a RoomChanged event.
+func (c *Client) JoinRoom(room string) error {
+	payload := models.RoomPayload{
+		Room: stringToByteArray32(room),
+	}
+	if err := c.writePDU(variables.RoomJoin, 0, &payload); err != nil {
+		return fmt.Errorf("failed to write ROOM_JOIN to server: %v", err)
+	}
+	return nil
+}
+
+// LeaveRoom asks the server to remove the user from a room
+func (c *Client) LeaveRoom(room string) error {
+	payload := models.RoomPayload{
+		Room: stringToByteArray32(room),
+	}
+	if err := c.writePDU(variables.RoomLeave, 0, &payload); err != nil {
+		return fmt.Errorf("failed to write ROOM_LEAVE to server: %v", err)
+	}
+	return nil
+}
+
+// ListRooms returns the names of the rooms on the server
+func (c *Client) ListRooms(ctx context.Context) ([]string, error) {
+	var payload models.RoomListPayload
+	if err := c.writePDU(variables.RoomList, 0, &payload); err != nil {
+		return nil, fmt.Errorf("failed to write ROOM_LIST to server: %v", err)
+	}
+
+	select {
+	case list := <-c.roomLists:
+		rooms := make([]string, 0, list.Count)
+		for i := 0; i < int(list.Count) && i < len(list.Rooms); i++ {
+			rooms = append(rooms, string(bytes.Trim(list.Rooms[i][:], "\x00")))
+		}
+		return rooms, nil
+	case <-c.stopped:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Rooms returns the rooms the user is a member of, sorted by name
+func (c *Client) Rooms() []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	rooms := make([]string, 0, len(c.rooms))
+	for room := range c.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms
+}
+
+// RoomMembers returns the members of a room the user is in, sorted by name
+func (c *Client) RoomMembers(room string) []string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return append([]string(nil), c.rooms[room]...)
+}
+
+// SendRoom encrypts text separately for every other member of the room and
+// waits until the server has accepted every copy. Copies for members that
+// went offline are kept by the server, those for members whose key was never
+// seen wait until they come online, for up to a day.
+func (c *Client) SendRoom(ctx context.Context, room string, text string) error {
+	env, err := newEnvelope(kindMessage, "", text)
+	if err != nil {
+		return err
+	}
+	deliveries, err := c.queueRoomMessage(room, env)
+	if err != nil {
+		return err
+	}
+
+	for _, delivery := range deliveries {
+		select {
+		case <-delivery.done:
+			if delivery.err != nil {
+				return delivery.err
+			}
+		case <-c.stopped:
+			return ErrClosed
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// SendRoomMessage is SendRoom without waiting for the server to accept the
+// copies
+func (c *Client) SendRoomMessage(room string, text string) error {
+	_, err := c.PostRoomMessage(room, text)
+	return err
+}
+
+// PostRoomMessage is SendRoomMessage returning the ID of the message, which
+// is the same for every copy
+func (c *Client) PostRoomMessage(room string, text string) (string, error) {
+	env, err := newEnvelope(kindMessage, "", text)
+	if err != nil {
+		return "", err
+	}
+	_, err = c.queueRoomMessage(room, env)
+	return env.ID, err
+}
+
+// ReplyRoomMessage sends a message to the room in the thread of an earlier
+// message and returns its ID
+func (c *Client) ReplyRoomMessage(room string, parent string, text string) (string, error) {
+	env, err := newEnvelope(kindMessage, "", text)
+	if err != nil {
+		return "", err
+	}
+	env.ReplyTo = parent
+	_, err = c.queueRoomMessage(room, env)
+	return env.ID, err
+}
+
+// PostRoomContent is PostContent for a room
+func (c *Client) PostRoomContent(room string, parent string, content Content) (string, error) {
+	env, err := contentEnvelope(parent, content)
+	if err != nil {
+		return "", err
+	}
+	_, err = c.queueRoomMessage(room, env)
+	return env.ID, err
+}
+
+// ReactRoom reacts to a message in the room with an emoji
+func (c *Client) ReactRoom(room string, id string, reaction string) error {
+	if !ValidReaction(reaction) {
+		return fmt.Errorf("invalid reaction %q", reaction)
+	}
+	env, err := newEnvelope(kindReaction, id, reaction)
+	if err != nil {
+		return err
+	}
+	_, err = c.queueRoomMessage(room, env)
+	return err
+}
+
+// EditRoomMessage replaces the text of an earlier message to the room
+func (c *Client) EditRoomMessage(room string, id string, text string) error {
+	env, err := newEnvelope(kindEdit, id, text)
+	if err != nil {
+		return err
+	}
+	_, err = c.queueRoomMessage(room, env)
+	return err
+}
+
+// DeleteRoomMessage withdraws an earlier message to the room
+func (c *Client) DeleteRoomMessage(room string, id string) error {
+	env, err := newEnvelope(kindDelete, id, "")
+	if err != nil {
+		return err
+	}
+	_, err = c.queueRoomMessage(room, env)
+	return err
+}
+
+func (c *Client) queueRoomMessage(room string, env envelope) ([]*delivery, error) {
+	c.mutex.Lock()
+	members, ok := c.rooms[room]
+	c.mutex.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("not a member of room %s", room)
+	}
+
+	own := string(bytes.Trim(c.Username[:], "\x00"))
+
+	var deliveries []*delivery
+	for _, member := range members {
+		if member == own {
+			continue
+		}
+
+		delivery, err := c.queueMessage(member, room, env)
+		if err != nil {
+			return deliveries, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, nil
+}
+
+// handleRoomMembers records the membership of a room and reports it
+func (c *Client) handleRoomMembers(payload models.RoomMembersPayload) {
+	room := string(bytes.Trim(payload.Room[:], "\x00"))
+
+	switch payload.Status {
+	case variables.RoomOK:
+	case variables.RoomFull:
+		c.emit(Event{Type: Error, Room: room, Err: fmt.Errorf("room %s is full", room)})
+		return
+	default:
+		c.emit(Event{Type: Error, Room: room, Err: errors.New("invalid room name, use up to 31 letters, digits, - and _")})
+		return
+	}
+
+	own := string(bytes.Trim(c.Username[:], "\x00"))
+	member := false
+
+	var members []string
+	for i := 0; i < int(payload.Count) && i < len(payload.Members); i++ {
+		username := string(bytes.Trim(payload.Members[i][:], "\x00"))
+		members = append(members, username)
+		if username == own {
+			member = true
+		}
+	}
+
+	c.mutex.Lock()
+	if member {
+		c.rooms[room] = members
+	} else {
+		delete(c.rooms, room)
+	}
+	c.mutex.Unlock()
+
+	c.emit(Event{Type: RoomChanged, Room: room, Members: members, Joined: member})
+}
@@ -0,0 +1,401 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// Name of the index journal in the history directory, also authenticated
+// with each of its records
+const indexFile = "index"
+
+// SearchQuery selects messages in the history. Every term has to match the
+// start of a word of the message. Empty fields do not filter.
+type SearchQuery struct {
+	Terms []string
+	// Contact or "#room" the message was in
+	Conversation string
+	// Who sent the message
+	Sender string
+	// Only messages at or after After and before Before
+	After  time.Time
+	Before time.Time
+}
+
+// SearchResult is a message found by Search. Index is its position among
+// the messages Load returns for its conversation.
+type SearchResult struct {
+	HistoryEntry
+	Index int
+}
+
+// indexDoc identifies a message in the index by the ID it was sent with
+type indexDoc struct {
+	Conversation string
+	ID           string
+}
+
+// docID returns the ID a message is indexed under. Messages kept before
+// there were IDs go by their time.
+func docID(entry HistoryEntry) string {
+	if entry.ID != "" {
+		return entry.ID
+	}
+	return "@" + strconv.FormatInt(entry.Time.UnixNano(), 10)
+}
+
+// indexRecord is one entry of the index journal. A deleted record drops the
+// message with the ID, or everything indexed for the conversation before it
+// when ID is empty. Records written before messages were indexed by ID have
+// only a Time, the index is built again when one is found.
+type indexRecord struct {
+	Conversation string   `json:"conversation"`
+	ID           string   `json:"id,omitempty"`
+	Time         int64    `json:"time,omitempty"`
+	Words        []string `json:"words,omitempty"`
+	// When a disappearing message expires, in nanoseconds like Time
+	Expires int64 `json:"expires,omitempty"`
+	Deleted bool  `json:"deleted,omitempty"`
+}
+
+// searchIndex maps the words of the messages to the messages. It is kept
+// on disk as a journal of encrypted records, like the conversations.
+type searchIndex struct {
+	docs  map[indexDoc][]string
+	words map[string]map[indexDoc]struct{}
+	// When the messages were sent, in nanoseconds
+	times map[indexDoc]int64
+	// Expiry of the disappearing messages
+	expires map[indexDoc]int64
+}
+
+func newSearchIndex() *searchIndex {
+	return &searchIndex{
+		docs:    make(map[indexDoc][]string),
+		words:   make(map[string]map[indexDoc]struct{}),
+		times:   make(map[indexDoc]int64),
+		expires: make(map[indexDoc]int64),
+	}
+}
+
+func (si *searchIndex) add(doc indexDoc, at int64, words []string, expires int64) {
+	si.remove(doc)
+	si.docs[doc] = words
+	si.times[doc] = at
+	if expires != 0 {
+		si.expires[doc] = expires
+	}
+	for _, word := range words {
+		docs, ok := si.words[word]
+		if !ok {
+			docs = make(map[indexDoc]struct{})
+			si.words[word] = docs
+		}
+		docs[doc] = struct{}{}
+	}
+}
+
+func (si *searchIndex) remove(doc indexDoc) {
+	for _, word := range si.docs[doc] {
+		delete(si.words[word], doc)
+		if len(si.words[word]) == 0 {
+			delete(si.words, word)
+		}
+	}
+	delete(si.docs, doc)
+	delete(si.times, doc)
+	delete(si.expires, doc)
+}
+
+func (si *searchIndex) removeConversation(conversation string) {
+	for doc := range si.docs {
+		if doc.Conversation == conversation {
+			si.remove(doc)
+		}
+	}
+}
+
+// match returns the messages with a word starting with term
+func (si *searchIndex) match(term string) map[indexDoc]struct{} {
+	matches := make(map[indexDoc]struct{})
+	for word, docs := range si.words {
+		if strings.HasPrefix(word, term) {
+			for doc := range docs {
+				matches[doc] = struct{}{}
+			}
+		}
+	}
+	return matches
+}
+
+// indexWords splits text into the distinct lower case words it is indexed
+// under
+func indexWords(text string) []string {
+	seen := make(map[string]bool)
+	var words []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	}) {
+		if !seen[word] {
+			seen[word] = true
+			words = append(words, word)
+		}
+	}
+	return words
+}
+
+// Search returns the messages matching the query, oldest first
+func (h *History) Search(query SearchQuery) ([]SearchResult, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	index, err := h.searchIndex()
+	if err != nil {
+		return nil, err
+	}
+
+	var terms []string
+	for _, term := range query.Terms {
+		terms = append(terms, indexWords(term)...)
+	}
+	if len(terms) == 0 && query.Conversation == "" && query.Sender == "" {
+		return nil, fmt.Errorf("nothing to search for")
+	}
+
+	// Candidates match every term, the messages are checked against the
+	// history since the index may be behind deletions and expiry
+	var candidates map[indexDoc]struct{}
+	if len(terms) == 0 {
+		candidates = make(map[indexDoc]struct{})
+		for doc := range index.docs {
+			candidates[doc] = struct{}{}
+		}
+	}
+	for _, term := range terms {
+		matches := index.match(term)
+		if candidates == nil {
+			candidates = matches
+			continue
+		}
+		for doc := range candidates {
+			if _, ok := matches[doc]; !ok {
+				delete(candidates, doc)
+			}
+		}
+	}
+
+	byConversation := make(map[string]map[string]bool)
+	for doc := range candidates {
+		if query.Conversation != "" && doc.Conversation != query.Conversation {
+			continue
+		}
+		at := time.Unix(0, index.times[doc])
+		if (!query.After.IsZero() && at.Before(query.After)) || (!query.Before.IsZero() && !at.Before(query.Before)) {
+			continue
+		}
+		if byConversation[doc.Conversation] == nil {
+			byConversation[doc.Conversation] = make(map[string]bool)
+		}
+		byConversation[doc.Conversation][doc.ID] = true
+	}
+
+	var results []SearchResult
+	for conversation, ids := range byConversation {
+		entries, err := h.load(h.fileID(conversation))
+		if err != nil {
+			return nil, err
+		}
+		for i, entry := range entries {
+			if !ids[docID(entry)] {
+				continue
+			}
+			if query.Sender != "" && entry.Sender != query.Sender {
+				continue
+			}
+			results = append(results, SearchResult{HistoryEntry: entry, Index: i})
+		}
+	}
+
+	sort.Slice(results, func(i, j int) bool { return results[i].Time.Before(results[j].Time) })
+	return results, nil
+}
+
+// searchIndex returns the index, reading it on first use. Without an index
+// file, or with one from before messages were indexed by ID, it is built
+// from the conversations.
+func (h *History) searchIndex() (*searchIndex, error) {
+	if h.index != nil {
+		return h.index, nil
+	}
+
+	path := filepath.Join(h.Dir, indexFile)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		return h.rebuildIndex()
+	}
+
+	records, err := h.readRecords(path, indexFile)
+	if err != nil {
+		return nil, err
+	}
+
+	index := newSearchIndex()
+	for _, plain := range records {
+		var record indexRecord
+		if err := json.Unmarshal(plain, &record); err != nil {
+			return nil, fmt.Errorf("could not parse search index: %v", err)
+		}
+		if record.ID == "" && record.Time != 0 {
+			return h.rebuildIndex()
+		}
+		if record.Deleted && record.ID != "" {
+			index.remove(indexDoc{record.Conversation, record.ID})
+			continue
+		}
+		if record.Deleted {
+			index.removeConversation(record.Conversation)
+			continue
+		}
+		index.add(indexDoc{record.Conversation, record.ID}, record.Time, record.Words, record.Expires)
+	}
+
+	h.index = index
+	return index, nil
+}
+
+// rebuildIndex indexes every conversation and replaces the index file
+func (h *History) rebuildIndex() (*searchIndex, error) {
+	index := newSearchIndex()
+	ids, err := h.fileIDs()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		entries, err := h.load(id)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			index.add(indexDoc{entry.Conversation, docID(entry)}, entry.Time.UnixNano(), indexWords(entry.Text), expiresNano(entry))
+		}
+	}
+
+	h.index = index
+	if err := h.compactIndex(); err != nil {
+		return nil, err
+	}
+	return index, nil
+}
+
+// indexEntry adds a message to the index
+func (h *History) indexEntry(entry HistoryEntry) error {
+	index, err := h.searchIndex()
+	if err != nil {
+		return err
+	}
+
+	doc := indexDoc{entry.Conversation, docID(entry)}
+	at := entry.Time.UnixNano()
+	words := indexWords(entry.Text)
+	index.add(doc, at, words, expiresNano(entry))
+
+	return h.appendIndex(indexRecord{Conversation: doc.Conversation, ID: doc.ID, Time: at, Words: words, Expires: expiresNano(entry)})
+}
+
+// unindexEntry drops a message from the index
+func (h *History) unindexEntry(entry HistoryEntry) error {
+	index, err := h.searchIndex()
+	if err != nil {
+		return err
+	}
+
+	doc := indexDoc{entry.Conversation, docID(entry)}
+	index.remove(doc)
+	return h.appendIndex(indexRecord{Conversation: doc.Conversation, ID: doc.ID, Deleted: true})
+}
+
+// unindexConversation drops a conversation from the index
+func (h *History) unindexConversation(conversation string) error {
+	index, err := h.searchIndex()
+	if err != nil {
+		return err
+	}
+
+	index.removeConversation(conversation)
+	return h.appendIndex(indexRecord{Conversation: conversation, Deleted: true})
+}
+
+// expireIndex drops expired messages from the index and rewrites the
+// journal without them when there were any
+func (h *History) expireIndex() error {
+	index, err := h.searchIndex()
+	if err != nil {
+		return err
+	}
+
+	now := time.Now().UnixNano()
+	expired := false
+	for doc, expires := range index.expires {
+		if expires <= now {
+			index.remove(doc)
+			expired = true
+		}
+	}
+	if h.Retention > 0 {
+		cutoff := time.Now().Add(-h.Retention).UnixNano()
+		for doc, at := range index.times {
+			if at < cutoff {
+				index.remove(doc)
+				expired = true
+			}
+		}
+	}
+
+	if !expired {
+		return nil
+	}
+	return h.compactIndex()
+}
+
+// expiresNano returns when a message expires as kept in the index
+func expiresNano(entry HistoryEntry) int64 {
+	if entry.Expires.IsZero() {
+		return 0
+	}
+	return entry.Expires.UnixNano()
+}
+
+func (h *History) appendIndex(record indexRecord) error {
+	plain, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	sealed, err := h.sealRecord(plain, indexFile)
+	if err != nil {
+		return err
+	}
+	return appendFile(filepath.Join(h.Dir, indexFile), sealed)
+}
+
+// compactIndex rewrites the journal with one record per indexed message
+func (h *History) compactIndex() error {
+	var data []byte
+	for doc, words := range h.index.docs {
+		plain, err := json.Marshal(indexRecord{Conversation: doc.Conversation, ID: doc.ID, Time: h.index.times[doc], Words: words, Expires: h.index.expires[doc]})
+		if err != nil {
+			return err
+		}
+		sealed, err := h.sealRecord(plain, indexFile)
+		if err != nil {
+			return err
+		}
+		data = append(data, sealed...)
+	}
+	return writeFileAtomic(filepath.Join(h.Dir, indexFile), data)
+}
@@ -0,0 +1,465 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"scrp/models"
+	"scrp/variables"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Messages the server has not acknowledged are given up after
+	// pendingTimeout, and no more than maxPendingMessages are kept
+	pendingTimeout     = 24 * time.Hour
+	maxPendingMessages = 1000
+	// IDs of the last messages received, to drop messages delivered twice
+	maxSeenMessages = 4096
+)
+
+var (
+	// ErrNotDelivered is returned by Send when the server did not accept
+	// the message within a day
+	ErrNotDelivered = errors.New("message was not delivered")
+	// ErrTooManyPending is returned when too many messages wait for the
+	// server already
+	ErrTooManyPending = errors.New("too many messages waiting for delivery")
+)
+
+// session keeps what is needed to resume after the connection drops: the
+// session token from the last AUTH_RESPONSE and every message the server has
+// not acknowledged yet
+type session struct {
+	mutex    sync.Mutex
+	token    [64]byte
+	sequence uint32
+	pending  map[uint32]*pendingMessage
+	// Counts the logins, to tell the connections apart
+	connection uint32
+	// Sender and ID of the messages received lately, oldest first in
+	// seenOrder
+	seen      map[string]struct{}
+	seenOrder []string
+}
+
+type pendingMessage struct {
+	Recipient string
+	Room      string
+	Envelope  envelope
+	queued    time.Time
+	// Connection and fingerprint of the key the message was last written
+	// with. It is written again only when one of them changed.
+	connection uint32
+	key        string
+	delivery   *delivery
+}
+
+// delivery is closed when the server accepts a message or it is given up,
+// err tells which
+type delivery struct {
+	done chan struct{}
+	err  error
+}
+
+func (s *session) setToken(token [64]byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.token = token
+	s.connection++
+}
+
+func (s *session) ack(sequence uint32) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if msg, ok := s.pending[sequence]; ok {
+		close(msg.delivery.done)
+		delete(s.pending, sequence)
+	}
+}
+
+// expire gives up the messages queued before cutoff and returns them
+func (s *session) expire(cutoff time.Time) []*pendingMessage {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	var expired []*pendingMessage
+	for sequence, msg := range s.pending {
+		if msg.queued.Before(cutoff) {
+			msg.delivery.err = ErrNotDelivered
+			close(msg.delivery.done)
+			delete(s.pending, sequence)
+			expired = append(expired, msg)
+		}
+	}
+	return expired
+}
+
+// received reports whether a message from sender with the ID was received
+// before and remembers it otherwise
+func (s *session) received(sender string, id string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := sender + "/" + id
+	if _, ok := s.seen[key]; ok {
+		return true
+	}
+	if len(s.seenOrder) >= maxSeenMessages {
+		delete(s.seen, s.seenOrder[0])
+		s.seenOrder = s.seenOrder[1:]
+	}
+	s.seen[key] = struct{}{}
+	s.seenOrder = append(s.seenOrder, key)
+	return false
+}
+
+// connected reports whether the client is logged in and exchanging keys or
+// messages
+func (c *Client) connected() bool {
+	switch c.State() {
+	case PUBLIC_KEY_SENT, PUBLIC_KEY_RECVD, CHAT:
+		return true
+	}
+	return false
+}
+
+// Send encrypts text for the contact and waits until the server has
+// accepted it for delivery. Messages to contacts that went offline are
+// encrypted to the key they had and kept by the server until they log in
+// again. Messages to contacts whose key was never seen wait until they come
+// online, for up to a day before ErrNotDelivered is returned. If ctx ends
+// first the message stays queued and ctx.Err() is returned.
+func (c *Client) Send(ctx context.Context, to string, text string) error {
+	env, err := newEnvelope(kindMessage, "", text)
+	if err != nil {
+		return err
+	}
+	delivery, err := c.queueMessage(to, "", env)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case <-delivery.done:
+		return delivery.err
+	case <-c.stopped:
+		return ErrClosed
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// SendMessage is Send without waiting for the server to accept the message
+func (c *Client) SendMessage(recipientUsername string, message string) error {
+	_, err := c.PostMessage(recipientUsername, message)
+	return err
+}
+
+// PostMessage is SendMessage returning the ID of the message, which
+// EditMessage and DeleteMessage refer to
+func (c *Client) PostMessage(to string, text string) (string, error) {
+	env, err := newEnvelope(kindMessage, "", text)
+	if err != nil {
+		return "", err
+	}
+	_, err = c.queueMessage(to, "", env)
+	return env.ID, err
+}
+
+// ReplyMessage sends a message in the thread of an earlier message in the
+// conversation and returns its ID
+func (c *Client) ReplyMessage(to string, parent string, text string) (string, error) {
+	env, err := newEnvelope(kindMessage, "", text)
+	if err != nil {
+		return "", err
+	}
+	env.ReplyTo = parent
+	_, err = c.queueMessage(to, "", env)
+	return env.ID, err
+}
+
+// PostContent sends a message of any content type, in the thread of parent
+// if set, and returns its ID
+func (c *Client) PostContent(to string, parent string, content Content) (string, error) {
+	env, err := contentEnvelope(parent, content)
+	if err != nil {
+		return "", err
+	}
+	_, err = c.queueMessage(to, "", env)
+	return env.ID, err
+}
+
+// React reacts to a message in the conversation with an emoji
+func (c *Client) React(to string, id string, reaction string) error {
+	if !ValidReaction(reaction) {
+		return fmt.Errorf("invalid reaction %q", reaction)
+	}
+	env, err := newEnvelope(kindReaction, id, reaction)
+	if err != nil {
+		return err
+	}
+	_, err = c.queueMessage(to, "", env)
+	return err
+}
+
+// EditMessage replaces the text of an earlier message to the contact. The
+// contact applies it only to a message from this user.
+func (c *Client) EditMessage(to string, id string, text string) error {
+	env, err := newEnvelope(kindEdit, id, text)
+	if err != nil {
+		return err
+	}
+	_, err = c.queueMessage(to, "", env)
+	return err
+}
+
+// DeleteMessage withdraws an earlier message to the contact
+func (c *Client) DeleteMessage(to string, id string) error {
+	env, err := newEnvelope(kindDelete, id, "")
+	if err != nil {
+		return err
+	}
+	_, err = c.queueMessage(to, "", env)
+	return err
+}
+
+// newEnvelope returns an envelope with a new ID. target is the message an
+// edit or delete applies to.
+func newEnvelope(kind string, target string, text string) (envelope, error) {
+	id, err := newMessageID()
+	if err != nil {
+		return envelope{}, err
+	}
+	contentType := ContentControl
+	if kind == kindMessage {
+		contentType = ContentText
+	}
+	return envelope{Version: envelopeVersion, ID: id, Kind: kind, Type: contentType, Target: target, Text: text}, nil
+}
+
+// contentEnvelope returns a message envelope with a new ID for content, in
+// the thread of parent if set
+func contentEnvelope(parent string, content Content) (envelope, error) {
+	if !validContent(content.Type) {
+		return envelope{}, fmt.Errorf("invalid content type %q", content.Type)
+	}
+	env, err := newEnvelope(kindMessage, "", content.Text)
+	env.Type, env.Meta, env.ReplyTo = content.Type, content.Meta, parent
+	return env, err
+}
+
+// queueMessage encrypts a message for the recipient and sends it. The
+// message is kept until the server acknowledges it, so it is sent again
+// after a reconnect if needed, or until it is given up after
+// pendingTimeout. room is set for a copy of a room message.
+func (c *Client) queueMessage(recipientUsername string, room string, env envelope) (*delivery, error) {
+	if c.State() == TERMINATED {
+		return nil, ErrClosed
+	}
+
+	env.Sender = string(bytes.Trim(c.Username[:], "\x00"))
+	env.Recipient = recipientUsername
+	env.Room = room
+	if env.Kind == kindMessage {
+		env.Expires = c.expiry(recipientUsername, room)
+	}
+	if err := c.checkSize(env); err != nil {
+		return nil, err
+	}
+
+	delivery := &delivery{done: make(chan struct{})}
+
+	c.session.mutex.Lock()
+	if len(c.session.pending) >= maxPendingMessages {
+		c.session.mutex.Unlock()
+		return nil, ErrTooManyPending
+	}
+	c.session.sequence++
+	sequence := c.session.sequence
+	c.session.pending[sequence] = &pendingMessage{
+		Recipient: recipientUsername,
+		Room:      room,
+		Envelope:  env,
+		queued:    time.Now(),
+		delivery:  delivery,
+	}
+	c.session.mutex.Unlock()
+
+	// Without a connection or a key the message waits for flushPending
+	if _, ok := c.publicKey(recipientUsername); !ok || !c.connected() {
+		return delivery, nil
+	}
+	return delivery, c.writeMessage(sequence)
+}
+
+// writeMessage encrypts and writes a pending message on the current
+// connection
+func (c *Client) writeMessage(sequence uint32) error {
+	c.session.mutex.Lock()
+	msg, ok := c.session.pending[sequence]
+	var pending pendingMessage
+	if ok {
+		pending = *msg
+	}
+	connection := c.session.connection
+	c.session.mutex.Unlock()
+	if !ok {
+		return nil
+	}
+	key, ok := c.publicKey(pending.Recipient)
+	if !ok {
+		return nil
+	}
+
+	// Sign and encrypt the envelope with the recipient's current key
+	encryptedData, err := c.sealEnvelope(pending.Envelope)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt message: %v", err)
+	}
+	data, err := packData(encryptedData)
+	if err != nil {
+		return err
+	}
+
+	payload := models.MessagePayload{
+		Timestamp: uint32(time.Now().Unix()),
+		Expires:   uint32(pending.Envelope.Expires),
+		Sender:    c.Username,
+		Recipient: stringToByteArray32(pending.Recipient),
+		Room:      stringToByteArray32(pending.Room),
+		Data:      data,
+	}
+
+	// Write header and payload
+	if err := c.writePDU(variables.Message, sequence, &payload); err != nil {
+		return fmt.Errorf("failed to write MESSAGE to server: %v", err)
+	}
+
+	c.session.mutex.Lock()
+	msg.connection, msg.key = connection, Fingerprint(key)
+	c.session.mutex.Unlock()
+	return nil
+}
+
+// flushPending sends the unacknowledged messages for the recipient that were
+// not written on this connection with the recipient's current key. It is
+// called whenever the recipient's key arrives: messages written before that
+// were either rejected by the server or encrypted with a key the recipient
+// no longer has.
+func (c *Client) flushPending(recipientUsername string) {
+	c.expirePending()
+
+	key, ok := c.publicKey(recipientUsername)
+	if !ok {
+		return
+	}
+	fingerprint := Fingerprint(key)
+
+	c.session.mutex.Lock()
+	var sequences []uint32
+	for sequence, msg := range c.session.pending {
+		if msg.Recipient != recipientUsername {
+			continue
+		}
+		if msg.connection == c.session.connection && msg.key == fingerprint {
+			continue
+		}
+		sequences = append(sequences, sequence)
+	}
+	c.session.mutex.Unlock()
+
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+	for _, sequence := range sequences {
+		if err := c.writeMessage(sequence); err != nil {
+			c.emit(Event{Type: Error, Contact: recipientUsername, Err: err})
+			return
+		}
+	}
+}
+
+// expirePending gives up the messages the server did not accept in time and
+// reports them
+func (c *Client) expirePending() {
+	for _, msg := range c.session.expire(time.Now().Add(-pendingTimeout)) {
+		to := msg.Recipient
+		if msg.Room != "" {
+			to = msg.Recipient + " in " + msg.Room
+		}
+		c.emit(Event{Type: Error, Contact: msg.Recipient, Room: msg.Room, Err: fmt.Errorf("message to %s was not delivered within %v", to, pendingTimeout)})
+	}
+}
+
+// reconnect dials the server with exponential backoff and logs in again
+// with the session token from the last login until it succeeds, the token
+// is rejected or the session is ended
+func (c *Client) reconnect() error {
+	c.Conn.Close()
+
+	// Keys are sent again by the server once we have logged in
+	c.mutex.Lock()
+	var contacts []string
+	for username, key := range c.OtherPublicKeys {
+		contacts = append(contacts, username)
+		c.lastKeys[username] = key
+	}
+	c.OtherPublicKeys = make(map[string][512]byte)
+	c.mutex.Unlock()
+
+	sort.Strings(contacts)
+	for _, username := range contacts {
+		c.emit(Event{Type: ContactOffline, Contact: username})
+	}
+
+	delay := c.ReconnectMinDelay
+	for {
+		time.Sleep(delay)
+
+		if c.State() == TERMINATED {
+			return ErrClosed
+		}
+
+		err := c.resume()
+		if err == nil {
+			return nil
+		}
+		if err == ErrAuthFailed {
+			c.setState(TERMINATED)
+			return errors.New("session token was rejected, log in again")
+		}
+		if errors.Is(err, ErrProtocolVersion) {
+			c.setState(TERMINATED)
+			return err
+		}
+		c.emit(Event{Type: Error, Err: fmt.Errorf("failed to reconnect: %v", err)})
+
+		delay *= 2
+		if delay > c.ReconnectMaxDelay {
+			delay = c.ReconnectMaxDelay
+		}
+	}
+}
+
+// resume opens a new connection and logs in with the session token
+func (c *Client) resume() error {
+	conn, err := c.Dial()
+	if err != nil {
+		return err
+	}
+
+	c.writeMutex.Lock()
+	c.Conn = conn
+	c.writeMutex.Unlock()
+
+	c.setState(INIT)
+	if err := c.LoginWithToken(c.SessionToken()); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,107 @@
+package handlers
+
+import (
+	"fmt"
+	"time"
+)
+
+// MaxTimer is the longest disappearing message timer. Longer timers from
+// contacts are rejected, they would overflow a time.Duration.
+const MaxTimer = 365 * 24 * time.Hour
+
+// timerKey names a conversation, a room or else a contact
+type timerKey struct {
+	contact string
+	room    string
+}
+
+// SetTimer makes messages to and from the contact disappear after timer,
+// zero keeps them. The contact is told with an authenticated control message
+// and applies the same timer.
+func (c *Client) SetTimer(to string, timer time.Duration) error {
+	env, err := timerEnvelope(timer)
+	if err != nil {
+		return err
+	}
+	if _, err := c.queueMessage(to, "", env); err != nil {
+		return err
+	}
+	c.RestoreTimer(to, timer)
+	return nil
+}
+
+// SetRoomTimer is SetTimer for every member of a room
+func (c *Client) SetRoomTimer(room string, timer time.Duration) error {
+	env, err := timerEnvelope(timer)
+	if err != nil {
+		return err
+	}
+	if _, err := c.queueRoomMessage(room, env); err != nil {
+		return err
+	}
+	c.RestoreRoomTimer(room, timer)
+	return nil
+}
+
+// Timer returns after how long messages with the contact disappear, zero
+// when they stay
+func (c *Client) Timer(to string) time.Duration {
+	return c.timer(timerKey{contact: to})
+}
+
+// RoomTimer is Timer for a room
+func (c *Client) RoomTimer(room string) time.Duration {
+	return c.timer(timerKey{room: room})
+}
+
+// RestoreTimer sets the timer of a conversation without telling the contact,
+// e.g. one kept from an earlier session
+func (c *Client) RestoreTimer(to string, timer time.Duration) {
+	c.setTimer(timerKey{contact: to}, timer)
+}
+
+// RestoreRoomTimer is RestoreTimer for a room, the members are not told
+func (c *Client) RestoreRoomTimer(room string, timer time.Duration) {
+	c.setTimer(timerKey{room: room}, timer)
+}
+
+func (c *Client) timer(key timerKey) time.Duration {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.timers[key]
+}
+
+func (c *Client) setTimer(key timerKey, timer time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if timer <= 0 {
+		delete(c.timers, key)
+		return
+	}
+	c.timers[key] = timer
+}
+
+// expiry returns when a message sent now in the conversation expires, zero
+// when it does not
+func (c *Client) expiry(recipient string, room string) int64 {
+	key := timerKey{contact: recipient}
+	if room != "" {
+		key = timerKey{room: room}
+	}
+	timer := c.timer(key)
+	if timer <= 0 {
+		return 0
+	}
+	return time.Now().Add(timer).Unix()
+}
+
+func timerEnvelope(timer time.Duration) (envelope, error) {
+	if timer < 0 || (timer > 0 && timer < time.Second) || timer > MaxTimer {
+		return envelope{}, fmt.Errorf("invalid timer %v", timer)
+	}
+	env, err := newEnvelope(kindTimer, "", "")
+	env.Timer = int64(timer / time.Second)
+	return env, err
+}
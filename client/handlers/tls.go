@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// TLSOptions control how the client verifies the server certificate. In
+// order of precedence the server is trusted if:
+//
+//   - Insecure is set, nothing is verified
+//   - Pin is set and matches the server key
+//   - CAFile is set and signed the server certificate
+//   - the system roots verify the server certificate
+//   - the server key matches the pin recorded in KnownHostsFile on the
+//     first connection
+type TLSOptions struct {
+	CAFile         string
+	Pin            string
+	KnownHostsFile string
+	Insecure       bool
+
+	// Client certificates for certificate authentication
+	Certificates []tls.Certificate
+}
+
+// DefaultKnownHostsFile returns the known hosts file in the user's
+// configuration directory
+func DefaultKnownHostsFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "srcp", "known_hosts")
+}
+
+// SPKIPin returns the base64 encoded SHA-256 hash of the certificate's
+// public key
+func SPKIPin(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// Config returns a TLS configuration for connecting to addr (host:port)
+func (o TLSOptions) Config(addr string) (*tls.Config, error) {
+	// Unlike cutting at the last colon this also strips the brackets of an
+	// IPv6 address
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	var roots *x509.CertPool
+	if o.CAFile != "" {
+		data, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read CA file: %v", err)
+		}
+		roots = x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", o.CAFile)
+		}
+	}
+
+	return &tls.Config{
+		ServerName:   host,
+		Certificates: o.Certificates,
+		// Verification is done in VerifyConnection so that pinning and trust
+		// on first use can be applied when the usual checks fail
+		InsecureSkipVerify: true,
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if o.Insecure {
+				return nil
+			}
+			return o.verify(addr, host, roots, state)
+		},
+	}, nil
+}
+
+func (o TLSOptions) verify(addr string, host string, roots *x509.CertPool, state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return errors.New("server did not present a certificate")
+	}
+	leaf := state.PeerCertificates[0]
+	pin := SPKIPin(leaf)
+
+	if o.Pin != "" {
+		if pin != o.Pin {
+			return fmt.Errorf("server key for %s does not match the configured pin: expected %s, got %s", addr, o.Pin, pin)
+		}
+		return nil
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, cert := range state.PeerCertificates[1:] {
+		intermediates.AddCert(cert)
+	}
+	verifyOptions := x509.VerifyOptions{
+		DNSName:       host,
+		Roots:         roots,
+		Intermediates: intermediates,
+	}
+
+	_, err := leaf.Verify(verifyOptions)
+	if o.CAFile != "" {
+		if err != nil {
+			return fmt.Errorf("server certificate for %s is not trusted by CA %s: %v", addr, o.CAFile, err)
+		}
+		return nil
+	}
+	if err == nil {
+		return nil
+	}
+
+	// Not verifiable through the system roots, fall back to trust on first
+	// use
+	if o.KnownHostsFile == "" {
+		return fmt.Errorf("server certificate for %s is not trusted (%v); use -ca, -pin or -insecure", addr, err)
+	}
+
+	known, ok, err := lookupKnownHost(o.KnownHostsFile, addr)
+	if err != nil {
+		return fmt.Errorf("could not read known hosts: %v", err)
+	}
+	if ok {
+		if known != pin {
+			return fmt.Errorf("SERVER KEY FOR %s HAS CHANGED: expected %s, got %s. "+
+				"Someone may be intercepting the connection. If the server key was "+
+				"replaced on purpose, remove its entry from %s", addr, known, pin, o.KnownHostsFile)
+		}
+		return nil
+	}
+
+	if err := addKnownHost(o.KnownHostsFile, addr, pin); err != nil {
+		return fmt.Errorf("could not record server key: %v", err)
+	}
+	log.Printf("Trusting server key for %s on first use (sha256 %s)", addr, pin)
+	return nil
+}
+
+// lookupKnownHost returns the pin recorded for addr
+func lookupKnownHost(path string, addr string) (string, bool, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == addr {
+			return fields[1], true, nil
+		}
+	}
+	return "", false, scanner.Err()
+}
+
+// addKnownHost records the pin for addr
+func addKnownHost(path string, addr string, pin string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = fmt.Fprintf(f, "%s %s\n", addr, pin)
+	return err
+}
@@ -0,0 +1,26 @@
+package handlers
+
+import "testing"
+
+func TestConfigServerName(t *testing.T) {
+	tests := []struct {
+		addr string
+		host string
+	}{
+		{"localhost:8080", "localhost"},
+		{"127.0.0.1:8080", "127.0.0.1"},
+		{"[::1]:8080", "::1"},
+		{"[2001:db8::1]:8080", "2001:db8::1"},
+		{"localhost", "localhost"},
+	}
+
+	for _, test := range tests {
+		config, err := TLSOptions{}.Config(test.addr)
+		if err != nil {
+			t.Fatalf("Config(%q): %v", test.addr, err)
+		}
+		if config.ServerName != test.host {
+			t.Errorf("Config(%q).ServerName = %q, want %q", test.addr, config.ServerName, test.host)
+		}
+	}
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// TokenCache stores session tokens on disk, keyed by user and server, so the
+// password is only needed when a token is missing, expired or revoked. The
+// file is only readable by its owner.
+type TokenCache struct {
+	Path string
+}
+
+// DefaultTokenCache returns a cache in the user's configuration directory
+func DefaultTokenCache() (*TokenCache, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return nil, err
+	}
+	return &TokenCache{Path: filepath.Join(dir, "srcp", "tokens.json")}, nil
+}
+
+func tokenKey(username string, server string) string {
+	return username + "@" + server
+}
+
+func (tc *TokenCache) load() (map[string]string, error) {
+	tokens := make(map[string]string)
+
+	info, err := os.Stat(tc.Path)
+	if os.IsNotExist(err) {
+		return tokens, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return nil, fmt.Errorf("token cache %s is accessible by other users, refusing to use it", tc.Path)
+	}
+
+	data, err := os.ReadFile(tc.Path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &tokens); err != nil {
+		return nil, fmt.Errorf("could not parse token cache: %v", err)
+	}
+	return tokens, nil
+}
+
+func (tc *TokenCache) save(tokens map[string]string) error {
+	if err := os.MkdirAll(filepath.Dir(tc.Path), 0700); err != nil {
+		return err
+	}
+
+	data, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated cache
+	tmp := tc.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, tc.Path)
+}
+
+// Get returns the cached token for the user on the server
+func (tc *TokenCache) Get(username string, server string) ([64]byte, bool, error) {
+	var token [64]byte
+
+	tokens, err := tc.load()
+	if err != nil {
+		return token, false, err
+	}
+
+	encoded, ok := tokens[tokenKey(username, server)]
+	if !ok {
+		return token, false, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil || len(decoded) != len(token) {
+		return token, false, fmt.Errorf("invalid token cached for %s", tokenKey(username, server))
+	}
+	copy(token[:], decoded)
+	return token, true, nil
+}
+
+// Put stores the token for the user on the server
+func (tc *TokenCache) Put(username string, server string, token [64]byte) error {
+	tokens, err := tc.load()
+	if err != nil {
+		return err
+	}
+
+	tokens[tokenKey(username, server)] = base64.StdEncoding.EncodeToString(token[:])
+	return tc.save(tokens)
+}
+
+// Delete removes the token for the user on the server
+func (tc *TokenCache) Delete(username string, server string) error {
+	tokens, err := tc.load()
+	if err != nil {
+		return err
+	}
+
+	delete(tokens, tokenKey(username, server))
+	return tc.save(tokens)
+}
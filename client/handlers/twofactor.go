@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"scrp/models"
+	"scrp/variables"
+	"time"
+)
+
+// ErrTwoFactorRejected is returned when the server refuses a two factor
+// request, usually because the code was wrong
+var ErrTwoFactorRejected = errors.New("two factor request rejected")
+
+// twoFactorRequest sends a TWO_FACTOR request and waits for the answer, which
+// is picked up by readServerMessages
+func (c *Client) twoFactorRequest(action uint8, code string) (models.TwoFactorAckPayload, error) {
+	payload := models.TwoFactorPayload{
+		Action: action,
+	}
+	copy(payload.Code[:], code)
+
+	err := c.writePDU(variables.TwoFactor, 0, &payload)
+	if err != nil {
+		return models.TwoFactorAckPayload{}, fmt.Errorf("failed to write TWO_FACTOR to server: %v", err)
+	}
+
+	select {
+	case ack := <-c.twoFactorAcks:
+		if ack.Status != variables.TwoFactorSuccess {
+			return ack, ErrTwoFactorRejected
+		}
+		return ack, nil
+	case <-time.After(c.HeartbeatInterval + c.HeartbeatTimeout):
+		return models.TwoFactorAckPayload{}, errors.New("timed out waiting for TWO_FACTOR_ACK")
+	}
+}
+
+// EnrollTwoFactor starts TOTP enrollment and returns the provisioning URI to
+// add to an authenticator app. Enrollment takes effect after
+// ConfirmTwoFactor. When TOTP is already enabled, code has to be a current
+// code or a recovery code, otherwise it is ignored.
+func (c *Client) EnrollTwoFactor(code string) (string, error) {
+	ack, err := c.twoFactorRequest(variables.TwoFactorEnroll, code)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.Trim(ack.URI[:], "\x00")), nil
+}
+
+// ConfirmTwoFactor enables TOTP with a code from the authenticator app and
+// returns the recovery codes
+func (c *Client) ConfirmTwoFactor(code string) ([]string, error) {
+	ack, err := c.twoFactorRequest(variables.TwoFactorConfirm, code)
+	if err != nil {
+		return nil, err
+	}
+
+	var codes []string
+	for _, recoveryCode := range ack.RecoveryCodes {
+		if recoveryCode != [16]byte{} {
+			codes = append(codes, string(bytes.Trim(recoveryCode[:], "\x00")))
+		}
+	}
+	return codes, nil
+}
+
+// DisableTwoFactor turns TOTP off. A current code or a recovery code is
+// required.
+func (c *Client) DisableTwoFactor(code string) error {
+	_, err := c.twoFactorRequest(variables.TwoFactorDisable, code)
+	return err
+}
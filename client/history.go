@@ -0,0 +1,309 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"scrp/client/handlers"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+// Attempts at typing the history passphrase before going on without history
+const passphraseAttempts = 3
+
+// openHistory opens the local history of the user on the server. It returns
+// nil when the history is turned off or can not be opened, the chat works
+// without it.
+func openHistory(profile Profile, username string, addr string) *handlers.History {
+	if profile.NoHistory {
+		return nil
+	}
+
+	retention, err := profile.Retention()
+	if err != nil {
+		log.Printf("History disabled: %v", err)
+		return nil
+	}
+
+	dir, err := handlers.DefaultHistoryDir(username, addr)
+	if err != nil {
+		log.Printf("History disabled: %v", err)
+		return nil
+	}
+
+	var history *handlers.History
+	if profile.HistoryPassphraseFile != "" {
+		passphrase, err := readPasswordFile(profile.HistoryPassphraseFile)
+		if err != nil {
+			log.Printf("History disabled: %v", err)
+			return nil
+		}
+		history, err = handlers.OpenHistory(dir, passphrase, retention)
+		if err != nil {
+			log.Printf("History disabled: %v", err)
+			return nil
+		}
+	} else {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return nil
+		}
+
+		for attempt := 1; ; attempt++ {
+			fmt.Print("History passphrase (empty to go without history): ")
+			passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+			fmt.Println()
+			if err != nil || len(passphrase) == 0 {
+				return nil
+			}
+
+			history, err = handlers.OpenHistory(dir, string(passphrase), retention)
+			if err == nil {
+				break
+			}
+			if !errors.Is(err, handlers.ErrWrongPassphrase) || attempt == passphraseAttempts {
+				log.Printf("History disabled: %v", err)
+				return nil
+			}
+			fmt.Println("Wrong passphrase, try again.")
+		}
+	}
+
+	if err := history.Prune(); err != nil {
+		log.Printf("Failed to apply the history retention: %v", err)
+	}
+	if err := history.Expire(); err != nil {
+		log.Printf("Failed to drop disappeared messages: %v", err)
+	}
+	return history
+}
+
+// newClient creates the client with the identity key kept in the history.
+// Without a history the key only lasts for the session.
+func newClient(username string, history *handlers.History) (*handlers.Client, error) {
+	if history == nil {
+		log.Printf("Without a history the identity key changes on every start and messages kept while away can not be read")
+		return handlers.NewClient(username)
+	}
+
+	key, err := history.IdentityKey()
+	if err != nil {
+		log.Printf("Failed to load the identity key, using a new one for this session: %v", err)
+		return handlers.NewClient(username)
+	}
+	return handlers.NewClientWithKey(username, key)
+}
+
+// restoreKnownKeys gives the client the fingerprints of the contacts' keys
+// seen in earlier sessions
+func restoreKnownKeys(client *handlers.Client, history *handlers.History) {
+	if history == nil {
+		return
+	}
+	keys, err := history.KnownKeys()
+	if err != nil {
+		log.Printf("Failed to read the known keys of contacts: %v", err)
+		return
+	}
+	for contact, fingerprint := range keys {
+		client.RestoreFingerprint(contact, fingerprint)
+	}
+}
+
+// keepKnownKey keeps the fingerprint of a contact's key in the history if
+// there is one
+func keepKnownKey(history *handlers.History, contact string, fingerprint string) error {
+	if history == nil {
+		return nil
+	}
+	return history.SetKnownKey(contact, fingerprint)
+}
+
+// restoreTimers gives the client the disappearing message timers kept from
+// earlier sessions
+func restoreTimers(client *handlers.Client, history *handlers.History) {
+	if history == nil {
+		return
+	}
+	timers, err := history.Timers()
+	if err != nil {
+		log.Printf("Failed to read the disappearing message timers: %v", err)
+		return
+	}
+	for name, timer := range timers {
+		if room, ok := strings.CutPrefix(name, roomPrefix); ok {
+			client.RestoreRoomTimer(room, timer)
+		} else {
+			client.RestoreTimer(name, timer)
+		}
+	}
+}
+
+// applyTimer sets the disappearing message timer of a conversation in the
+// client, which may have been restored after a contact changed it, and keeps
+// it in the history if there is one
+func applyTimer(client *handlers.Client, history *handlers.History, name string, timer time.Duration) error {
+	if room, ok := strings.CutPrefix(name, roomPrefix); ok {
+		client.RestoreRoomTimer(room, timer)
+	} else {
+		client.RestoreTimer(name, timer)
+	}
+	if history == nil {
+		return nil
+	}
+	return history.SetTimer(name, timer)
+}
+
+// conversationTimer returns after how long messages in a conversation
+// disappear, zero when they stay
+func conversationTimer(client *handlers.Client, name string) time.Duration {
+	if room, ok := strings.CutPrefix(name, roomPrefix); ok {
+		return client.RoomTimer(room)
+	}
+	return client.Timer(name)
+}
+
+// expiresAt returns when a message sent now in a conversation disappears,
+// zero when it stays
+func expiresAt(client *handlers.Client, name string) time.Time {
+	timer := conversationTimer(client, name)
+	if timer <= 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timer)
+}
+
+// formatTimer tells who set the disappearing message timer of a
+// conversation and to what
+func formatTimer(sender string, timer time.Duration) string {
+	if timer <= 0 {
+		return fmt.Sprintf("* %s turned disappearing messages off", sender)
+	}
+	return fmt.Sprintf("* %s set messages to disappear after %v", sender, timer)
+}
+
+// recordMessage adds a message to the history if there is one
+func recordMessage(history *handlers.History, entry handlers.HistoryEntry) error {
+	if history == nil {
+		return nil
+	}
+	return history.Append(entry)
+}
+
+// editRecorded edits a message in the history if there is one
+func editRecorded(history *handlers.History, conversation string, sender string, id string, text string) error {
+	if history == nil {
+		return nil
+	}
+	return ignoreNotFound(history.Edit(conversation, id, sender, text))
+}
+
+// deleteRecorded deletes a message from the history if there is one
+func deleteRecorded(history *handlers.History, conversation string, sender string, id string) error {
+	if history == nil {
+		return nil
+	}
+	return ignoreNotFound(history.DeleteMessage(conversation, id, sender))
+}
+
+// reactRecorded records a reaction in the history if there is one
+func reactRecorded(history *handlers.History, conversation string, sender string, id string, reaction string) error {
+	if history == nil {
+		return nil
+	}
+	return ignoreNotFound(history.React(conversation, id, sender, reaction))
+}
+
+// ignoreNotFound drops the error for messages that are not kept, they may
+// be older than the history
+func ignoreNotFound(err error) error {
+	if errors.Is(err, handlers.ErrMessageNotFound) {
+		return nil
+	}
+	return err
+}
+
+// sanitize makes text from a contact safe to print. Control characters,
+// which could start terminal escape sequences, are replaced, and
+// bidirectional overrides, which could disguise the text, are dropped. Line
+// breaks and tabs become spaces.
+func sanitize(text string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r == '\n' || r == '\r' || r == '\t':
+			return ' '
+		case unicode.IsControl(r):
+			return utf8.RuneError
+		case r >= '\u202a' && r <= '\u202e', r >= '\u2066' && r <= '\u2069':
+			return -1
+		}
+		return r
+	}, text)
+}
+
+// formatMessage formats a message for the scrollback, with the date when it
+// is not from today
+func formatMessage(at time.Time, sender string, text string) string {
+	at = at.Local()
+	layout := "15:04"
+	if at.Format("2006-01-02") != time.Now().Format("2006-01-02") {
+		layout = "2006-01-02 15:04"
+	}
+	return fmt.Sprintf("%s %s: %s", at.Format(layout), sanitize(sender), sanitize(text))
+}
+
+// entryText returns what is shown of a kept message for its content type.
+// Markdown is shown as it was written.
+func entryText(entry handlers.HistoryEntry) string {
+	if entry.ContentType != handlers.ContentFile {
+		return entry.Text
+	}
+	text := fmt.Sprintf("[file %s, %s bytes, sha256 %s]", entry.Meta[handlers.MetaFileName], entry.Meta[handlers.MetaFileSize], entry.Meta[handlers.MetaFileSHA256])
+	if entry.Text != "" {
+		text += " " + entry.Text
+	}
+	return text
+}
+
+// formatEntry formats a kept message, marking it when it was edited and
+// counting its reactions
+func formatEntry(entry handlers.HistoryEntry) string {
+	line := formatMessage(entry.Time, entry.Sender, entryText(entry))
+	if entry.Edited {
+		line += " (edited)"
+	}
+	if len(entry.Reactions) > 0 {
+		reactions := make([]string, 0, len(entry.Reactions))
+		for reaction, senders := range entry.Reactions {
+			reactions = append(reactions, fmt.Sprintf("%s %d", sanitize(reaction), len(senders)))
+		}
+		sort.Strings(reactions)
+		line += " [" + strings.Join(reactions, ", ") + "]"
+	}
+	return line
+}
+
+// quoteEntry shortens a message to refer to it
+func quoteEntry(entry handlers.HistoryEntry) string {
+	text := []rune(sanitize(entryText(entry)))
+	if len(text) > 30 {
+		text = append(text[:29], '…')
+	}
+	return fmt.Sprintf("%s: %s", sanitize(entry.Sender), string(text))
+}
+
+// formatClockSkew warns that the times a contact puts on messages can not be
+// trusted
+func formatClockSkew(sender string, skew time.Duration) string {
+	direction := "behind"
+	if skew < 0 {
+		direction, skew = "ahead of", -skew
+	}
+	return fmt.Sprintf("* the clock of %s is %v %s the server's", sender, skew.Round(time.Second), direction)
+}
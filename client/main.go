@@ -2,7 +2,11 @@ package main
 
 import (
 	"bufio"
+	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -14,39 +18,115 @@ import (
 )
 
 func main() {
+	profile, err := parseProfile(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
 	// Define own username, password and public key here
 	sigChan := make(chan os.Signal, 1)
 	// Notify the program to send the SIGINT signal to sigChan
 	signal.Notify(sigChan, syscall.SIGINT)
 	scanner := bufio.NewScanner(os.Stdin)
 
-	fmt.Print("Enter Server Address or Host (e.g. 192.168.1.1 or localhost): ")
-	scanner.Scan()
-	host := scanner.Text()
+	tlsOptions := handlers.TLSOptions{
+		CAFile:         profile.CAFile,
+		Pin:            profile.Pin,
+		KnownHostsFile: profile.KnownHosts,
+		Insecure:       profile.Insecure,
+	}
+	if profile.Insecure {
+		log.Println("WARNING: server certificate verification is disabled")
+	}
+
+	// With a client certificate the username comes from the certificate
+	if profile.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(profile.Cert, profile.Key)
+		if err != nil {
+			log.Fatalf("Failed to load client certificate: %v", err)
+		}
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		if err != nil {
+			log.Fatalf("Failed to parse client certificate: %v", err)
+		}
+
+		tlsOptions.Certificates = []tls.Certificate{cert}
+		profile.User = leaf.Subject.CommonName
+	}
 
-	fmt.Print("Enter username: ")
-	scanner.Scan()
-	username := scanner.Text()
+	// Anything not given by flags or the profile is asked for
+	if profile.Server == "" {
+		fmt.Print("Enter Server Address or Host (e.g. 192.168.1.1 or localhost): ")
+		scanner.Scan()
+		profile.Server = scanner.Text()
+	}
 
-	fmt.Print("Enter Password: ")
-	bytePassword, _ := term.ReadPassword(int(syscall.Stdin))
-	password := string(bytePassword)
+	if profile.User == "" {
+		fmt.Print("Enter username: ")
+		scanner.Scan()
+		profile.User = scanner.Text()
+	}
+	username := profile.User
+	addr := profile.Addr()
 
-	client, err := handlers.NewClient(username, password)
+	tokens, err := handlers.DefaultTokenCache()
 	if err != nil {
-		log.Fatalf("Failed to authenticate to server: %v", err)
+		log.Printf("Session tokens will not be cached: %v", err)
 	}
 
-	// Connect to server over TLS
-	conf := &tls.Config{
-		InsecureSkipVerify: true, // Should be set to false in production
+	command := flag.Arg(0)
+
+	// The chat keeps its identity key with the history, the other commands
+	// do not exchange messages and make do with a new one
+	var history *handlers.History
+	var client *handlers.Client
+	if command == "" {
+		history = openHistory(profile, username, addr)
+		client, err = newClient(username, history)
+	} else {
+		client, err = handlers.NewClient(username)
+	}
+	if err != nil {
+		log.Fatalf("Failed to create client: %v", err)
 	}
+	// Before connecting, mailbox messages arrive right after the login
+	restoreKnownKeys(client, history)
 
-	conn, err := tls.Dial("tcp", host+":8080", conf)
+	// Connect to server over TLS
+	conf, err := tlsOptions.Config(addr)
 	if err != nil {
+		log.Fatalf("Failed to set up TLS: %v", err)
+	}
+
+	if err := client.Connect(context.Background(), addr, conf); err != nil {
 		log.Fatalf("Failed to connect to server: %v", err)
 	}
-	client.Conn = conn
+
+	// "logout" revokes the cached session token instead of starting a chat
+	if command == "logout" {
+		logout(client, tokens, username, addr)
+		return
+	}
+
+	if len(conf.Certificates) > 0 {
+		err = client.LoginWithCertificate()
+	} else {
+		err = login(client, tokens, profile, scanner)
+	}
+	if err != nil {
+		log.Fatalf("Failed to authenticate to server: %v", err)
+	}
+
+	// "2fa enroll" and "2fa disable" manage the second factor
+	if command == "2fa" {
+		go func() {
+			for range client.Events() {
+			}
+		}()
+		twoFactor(client, scanner, flag.Args()[1:])
+		return
+	}
 
 	go func(client *handlers.Client) {
 		// Wait for the signal
@@ -58,12 +138,141 @@ func main() {
 		os.Exit(0)
 	}(client)
 
-	// Handle response from server
-	client.HandleServerMessages()
+	restoreTimers(client, history)
+
+	// Show what happens in the session and let the user select recipients
+	// and send messages. Without a terminal the line based UI is used.
+	if term.IsTerminal(int(os.Stdin.Fd())) && term.IsTerminal(int(os.Stdout.Fd())) {
+		if err := newTUI(client, username, history).run(); err != nil {
+			log.Printf("Failed to start the terminal UI: %v", err)
+		}
+	}
+
+	ui := newChat(client, username, history)
+	go ui.handleEvents()
+	go ui.expireMessages()
+	ui.run(scanner)
+}
 
-	// Send authentication request to the server
-	client.SendAuthRequest()
+// login authenticates with a cached session token when there is one and
+// falls back to asking for the password
+func login(client *handlers.Client, tokens *handlers.TokenCache, profile Profile, scanner *bufio.Scanner) error {
+	username := profile.User
+	addr := profile.Addr()
+
+	if tokens != nil {
+		token, ok, err := tokens.Get(username, addr)
+		if err != nil {
+			log.Printf("Failed to read cached session token: %v", err)
+		}
+
+		if ok {
+			err := client.LoginWithToken(token)
+			if err != handlers.ErrAuthFailed {
+				return err
+			}
+			tokens.Delete(username, addr)
+			fmt.Println("Session expired, please log in again.")
+		}
+	}
+
+	var password string
+	if profile.PasswordFile != "" {
+		var err error
+		password, err = readPasswordFile(profile.PasswordFile)
+		if err != nil {
+			return fmt.Errorf("could not read password file: %v", err)
+		}
+	} else if term.IsTerminal(int(syscall.Stdin)) {
+		fmt.Print("Enter Password: ")
+		bytePassword, _ := term.ReadPassword(int(syscall.Stdin))
+		fmt.Println()
+		password = string(bytePassword)
+	} else {
+		return errors.New("no password available, use -password-file when not running in a terminal")
+	}
+
+	err := client.Login(password)
+	for err == handlers.ErrCodeRequired {
+		fmt.Print("Enter authentication or recovery code: ")
+		scanner.Scan()
+		err = client.SendAuthCode(scanner.Text())
+	}
+	if err != nil {
+		return err
+	}
+
+	if tokens != nil {
+		if err := tokens.Put(username, addr, client.SessionToken()); err != nil {
+			log.Printf("Failed to cache session token: %v", err)
+		}
+	}
+	return nil
+}
+
+func logout(client *handlers.Client, tokens *handlers.TokenCache, username string, addr string) {
+	if tokens == nil {
+		log.Fatalf("No session token cache available")
+	}
+
+	token, ok, err := tokens.Get(username, addr)
+	if err != nil {
+		log.Fatalf("Failed to read cached session token: %v", err)
+	}
+	if !ok {
+		fmt.Println("Not logged in.")
+		return
+	}
+
+	if err := client.RevokeToken(token); err != nil {
+		log.Fatalf("Failed to log out: %v", err)
+	}
+	if err := tokens.Delete(username, addr); err != nil {
+		log.Fatalf("Failed to remove cached session token: %v", err)
+	}
+	fmt.Println("Logged out.")
+}
+
+func twoFactor(client *handlers.Client, scanner *bufio.Scanner, args []string) {
+	if len(args) != 1 {
+		log.Fatalf("Usage: client 2fa enroll|disable")
+	}
+
+	switch args[0] {
+	case "enroll":
+		fmt.Print("If two factor authentication is enabled already, enter an authentication or recovery code: ")
+		scanner.Scan()
+		uri, err := client.EnrollTwoFactor(scanner.Text())
+		if err != nil {
+			log.Fatalf("Failed to start enrollment: %v", err)
+		}
+		fmt.Println("Add this account to your authenticator app:")
+		fmt.Println(uri)
+
+		fmt.Print("Enter the code shown by the app: ")
+		scanner.Scan()
+		codes, err := client.ConfirmTwoFactor(scanner.Text())
+		if err != nil {
+			log.Fatalf("Failed to enable two factor authentication: %v", err)
+		}
+
+		fmt.Println("Two factor authentication enabled. Keep these recovery codes somewhere safe,")
+		fmt.Println("each of them can be used once instead of a code:")
+		for _, code := range codes {
+			fmt.Println("  " + code)
+		}
+
+	case "disable":
+		fmt.Print("Enter authentication or recovery code: ")
+		scanner.Scan()
+		if err := client.DisableTwoFactor(scanner.Text()); err != nil {
+			log.Fatalf("Failed to disable two factor authentication: %v", err)
+		}
+		fmt.Println("Two factor authentication disabled.")
+
+	default:
+		log.Fatalf("Unknown 2fa command %q, expected enroll or disable", args[0])
+	}
 
-	// Allow user to select recipient and send messages
-	client.StartMessagingUI()
+	client.SendDisconnectRequest()
 }
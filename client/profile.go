@@ -0,0 +1,206 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"scrp/client/handlers"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Profile holds the connection settings of one server. Profiles are stored
+// by name in a JSON file and every setting can be overridden with a flag.
+type Profile struct {
+	Server       string `json:"server"`
+	Port         int    `json:"port"`
+	User         string `json:"user"`
+	PasswordFile string `json:"password_file"`
+	Cert         string `json:"cert"`
+	Key          string `json:"key"`
+	CAFile       string `json:"ca"`
+	Pin          string `json:"pin"`
+	KnownHosts   string `json:"known_hosts"`
+	Insecure     bool   `json:"insecure"`
+
+	// Local message history, kept unless NoHistory is set
+	NoHistory             bool   `json:"no_history"`
+	HistoryPassphraseFile string `json:"history_passphrase_file"`
+	// How long messages are kept, e.g. "720h" or "30d". Empty keeps them
+	// forever.
+	HistoryRetention string `json:"history_retention"`
+}
+
+func defaultProfilesFile() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "srcp", "profiles.json")
+}
+
+// Addr returns the server address as host:port
+func (p Profile) Addr() string {
+	host := p.Server
+	// Bare IPv6 addresses need brackets before a port can be added
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		host = "[" + host + "]"
+	}
+	return fmt.Sprintf("%s:%d", host, p.Port)
+}
+
+// loadProfiles reads the profiles file. A missing file is not an error
+// unless a profile was asked for.
+func loadProfiles(path string) (map[string]Profile, error) {
+	profiles := make(map[string]Profile)
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return profiles, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(data, &profiles); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return profiles, nil
+}
+
+// parseProfile builds the profile from the profiles file and the
+// command-line flags, which take precedence
+func parseProfile(flags *flag.FlagSet, args []string) (Profile, error) {
+	profile := Profile{
+		Port:       8080,
+		KnownHosts: handlers.DefaultKnownHostsFile(),
+	}
+
+	profilesFile := flags.String("profiles", defaultProfilesFile(), "JSON file with named connection profiles")
+	profileName := flags.String("profile", "", "name of the profile to use")
+
+	var overrides Profile
+	flags.StringVar(&overrides.Server, "server", "", "server host name or address")
+	flags.IntVar(&overrides.Port, "port", 8080, "server port")
+	flags.StringVar(&overrides.User, "user", "", "username")
+	flags.StringVar(&overrides.PasswordFile, "password-file", "", "file whose first line is the password")
+	flags.StringVar(&overrides.Cert, "cert", "", "client certificate for certificate authentication")
+	flags.StringVar(&overrides.Key, "key", "", "private key of the client certificate")
+	flags.StringVar(&overrides.CAFile, "ca", "", "CA certificate used to verify the server instead of the system roots")
+	flags.StringVar(&overrides.Pin, "pin", "", "expected base64 SHA-256 hash of the server's public key")
+	flags.StringVar(&overrides.KnownHosts, "known-hosts", profile.KnownHosts, "file recording server keys trusted on first use")
+	flags.BoolVar(&overrides.Insecure, "insecure", false, "do not verify the server certificate at all")
+	flags.BoolVar(&overrides.NoHistory, "no-history", false, "do not keep a local message history")
+	flags.StringVar(&overrides.HistoryPassphraseFile, "history-passphrase-file", "", "file whose first line is the passphrase of the local history")
+	flags.StringVar(&overrides.HistoryRetention, "history-retention", "", "how long the local history keeps messages, e.g. 720h or 30d (default forever)")
+
+	if err := flags.Parse(args); err != nil {
+		return profile, err
+	}
+
+	if *profileName != "" {
+		profiles, err := loadProfiles(*profilesFile)
+		if err != nil {
+			return profile, err
+		}
+		stored, ok := profiles[*profileName]
+		if !ok {
+			return profile, fmt.Errorf("profile %q not found in %s", *profileName, *profilesFile)
+		}
+
+		if stored.Port == 0 {
+			stored.Port = profile.Port
+		}
+		if stored.KnownHosts == "" {
+			stored.KnownHosts = profile.KnownHosts
+		}
+		profile = stored
+	}
+
+	// Only flags given on the command line override the profile
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "server":
+			profile.Server = overrides.Server
+		case "port":
+			profile.Port = overrides.Port
+		case "user":
+			profile.User = overrides.User
+		case "password-file":
+			profile.PasswordFile = overrides.PasswordFile
+		case "cert":
+			profile.Cert = overrides.Cert
+		case "key":
+			profile.Key = overrides.Key
+		case "ca":
+			profile.CAFile = overrides.CAFile
+		case "pin":
+			profile.Pin = overrides.Pin
+		case "known-hosts":
+			profile.KnownHosts = overrides.KnownHosts
+		case "insecure":
+			profile.Insecure = overrides.Insecure
+		case "no-history":
+			profile.NoHistory = overrides.NoHistory
+		case "history-passphrase-file":
+			profile.HistoryPassphraseFile = overrides.HistoryPassphraseFile
+		case "history-retention":
+			profile.HistoryRetention = overrides.HistoryRetention
+		}
+	})
+
+	if profile.Port <= 0 || profile.Port > 65535 {
+		return profile, fmt.Errorf("invalid port %d", profile.Port)
+	}
+	if (profile.Cert == "") != (profile.Key == "") {
+		return profile, fmt.Errorf("-cert and -key must be given together")
+	}
+	if _, err := profile.Retention(); err != nil {
+		return profile, err
+	}
+	return profile, nil
+}
+
+// Retention returns how long the local history keeps messages, zero for
+// forever. A number of days can be given as e.g. "30d".
+func (p Profile) Retention() (time.Duration, error) {
+	if p.HistoryRetention == "" {
+		return 0, nil
+	}
+
+	if days, ok := strings.CutSuffix(p.HistoryRetention, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid history retention %q", p.HistoryRetention)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+
+	retention, err := time.ParseDuration(p.HistoryRetention)
+	if err != nil || retention < 0 {
+		return 0, fmt.Errorf("invalid history retention %q", p.HistoryRetention)
+	}
+	return retention, nil
+}
+
+// readPasswordFile returns the first line of the password file. The file
+// must not be readable by other users.
+func readPasswordFile(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("password file %s is accessible by other users, run chmod 600 on it", path)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	password, _, _ := strings.Cut(string(data), "\n")
+	return strings.TrimRight(password, "\r"), nil
+}
@@ -0,0 +1,1002 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"scrp/client/handlers"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/term"
+)
+
+const (
+	// Lines kept per conversation
+	maxScrollback = 1000
+	// Widest the contact sidebar gets
+	maxSidebarWidth = 24
+	// Conversation for command output when no other one is open
+	systemConversation = "*"
+)
+
+// conversation is the scrollback of one contact or "#room"
+type conversation struct {
+	name   string
+	lines  []line
+	unread int
+	online bool
+	// Lines scrolled up from the newest one
+	scroll int
+	// Set once the history was loaded into lines. Until then messages are
+	// only counted, they are in the history already.
+	loaded bool
+}
+
+// line is a message in the scrollback, or a note such as "* bob is online"
+// when message is nil
+type line struct {
+	message *handlers.HistoryEntry
+	note    string
+}
+
+// Replies are indented under the message they reply to
+func (l line) String() string {
+	if l.message != nil && l.message.ReplyTo != "" {
+		return "  ↳ " + formatEntry(*l.message)
+	}
+	if l.message != nil {
+		return formatEntry(*l.message)
+	}
+	return l.note
+}
+
+// add adds a note to the scrollback
+func (c *conversation) add(note string) {
+	c.append(line{note: note})
+}
+
+// addMessage adds a message to the scrollback. A reply goes after the last
+// message of its thread, other messages at the end.
+func (c *conversation) addMessage(entry handlers.HistoryEntry) {
+	parent := -1
+	if entry.ReplyTo != "" {
+		parent = c.find(entry.ReplyTo, "")
+	}
+	if parent < 0 {
+		c.append(line{message: &entry})
+		return
+	}
+
+	at := parent + 1
+	for at < len(c.lines) && c.lines[at].message != nil && c.lines[at].message.ReplyTo == entry.ReplyTo {
+		at++
+	}
+	c.lines = append(c.lines, line{})
+	copy(c.lines[at+1:], c.lines[at:])
+	c.lines[at] = line{message: &entry}
+	c.trim()
+}
+
+func (c *conversation) append(l line) {
+	c.lines = append(c.lines, l)
+	c.trim()
+}
+
+// trim drops the oldest lines beyond maxScrollback
+func (c *conversation) trim() {
+	if len(c.lines) > maxScrollback {
+		c.lines = c.lines[len(c.lines)-maxScrollback:]
+	}
+}
+
+// find returns the position of the message with the ID from sender, or from
+// anyone when sender is empty, -1 when it is not in the scrollback
+func (c *conversation) find(id string, sender string) int {
+	for i, l := range c.lines {
+		if l.message != nil && id != "" && l.message.ID == id && (sender == "" || l.message.Sender == sender) {
+			return i
+		}
+	}
+	return -1
+}
+
+// tui is the full-screen terminal UI. The screen is split into a sidebar
+// listing the conversations, the scrollback of the current conversation, a
+// status line and the input line. Everything is redrawn after each change
+// so incoming messages never overwrite what is being typed.
+type tui struct {
+	client   *handlers.Client
+	username string
+	// Local history, nil when it is turned off
+	history *handlers.History
+
+	mutex         sync.Mutex
+	conversations map[string]*conversation
+	current       string
+	status        string
+
+	input  []rune
+	cursor int
+
+	width    int
+	height   int
+	oldState *term.State
+	// Incomplete UTF-8 sequence left over from the last read
+	partial []byte
+}
+
+func newTUI(client *handlers.Client, username string, history *handlers.History) *tui {
+	return &tui{
+		client:        client,
+		username:      username,
+		history:       history,
+		conversations: make(map[string]*conversation),
+		status:        "Connected",
+	}
+}
+
+// run takes over the terminal until the user quits or the session ends
+func (t *tui) run() error {
+	fd := int(os.Stdin.Fd())
+	oldState, err := term.MakeRaw(fd)
+	if err != nil {
+		return err
+	}
+	t.oldState = oldState
+
+	// Switch to the alternate screen so the shell's scrollback survives
+	fmt.Print("\x1b[?1049h")
+
+	t.mutex.Lock()
+	if t.history != nil {
+		names, err := t.history.Conversations()
+		if err != nil {
+			t.status = fmt.Sprintf("Failed to read history: %v", err)
+		}
+		for _, name := range names {
+			t.conversation(name)
+		}
+	}
+	for _, contact := range t.client.Contacts() {
+		t.conversation(contact.Username).online = true
+	}
+	for _, room := range t.client.Rooms() {
+		t.conversation(roomPrefix + room).online = true
+	}
+	t.resize()
+	t.draw()
+	t.mutex.Unlock()
+
+	go t.watchSize()
+	go t.expireMessages()
+	go t.handleEvents()
+
+	buf := make([]byte, 256)
+	for {
+		n, err := os.Stdin.Read(buf)
+		if err != nil {
+			t.quit("")
+		}
+
+		t.mutex.Lock()
+		t.handleInput(buf[:n])
+		t.draw()
+		t.mutex.Unlock()
+	}
+}
+
+// quit restores the terminal, ends the session and exits
+func (t *tui) quit(message string) {
+	t.restore()
+	if message != "" {
+		fmt.Println(message)
+	}
+	t.client.SendDisconnectRequest()
+	os.Exit(0)
+}
+
+func (t *tui) restore() {
+	fmt.Print("\x1b[?1049l")
+	if t.oldState != nil {
+		term.Restore(int(os.Stdin.Fd()), t.oldState)
+	}
+}
+
+// watchSize redraws the screen when the terminal is resized
+func (t *tui) watchSize() {
+	ticker := time.NewTicker(250 * time.Millisecond)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		t.mutex.Lock()
+		if t.resize() {
+			t.draw()
+		}
+		t.mutex.Unlock()
+	}
+}
+
+// expireMessages drops disappearing messages from the scrollback and the
+// history once their time is up
+func (t *tui) expireMessages() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		var err error
+		if t.history != nil {
+			err = t.history.Expire()
+		}
+
+		t.mutex.Lock()
+		if err != nil {
+			t.status = fmt.Sprintf("Failed to drop disappeared messages from the history: %v", err)
+		}
+		changed := err != nil
+		for _, conv := range t.conversations {
+			lines := conv.lines[:0]
+			for _, l := range conv.lines {
+				if l.message != nil && !l.message.Expires.IsZero() && !now.Before(l.message.Expires) {
+					changed = true
+					continue
+				}
+				lines = append(lines, l)
+			}
+			conv.lines = lines
+		}
+		if changed {
+			t.draw()
+		}
+		t.mutex.Unlock()
+	}
+}
+
+// resize updates the terminal size and reports whether it changed
+func (t *tui) resize() bool {
+	width, height, err := term.GetSize(int(os.Stdout.Fd()))
+	if err != nil {
+		width, height = 80, 24
+	}
+	if width == t.width && height == t.height {
+		return false
+	}
+	t.width, t.height = width, height
+	return true
+}
+
+// conversation returns the conversation with a contact, creating it when
+// needed. The first conversation becomes the current one.
+func (t *tui) conversation(name string) *conversation {
+	conv, ok := t.conversations[name]
+	if !ok {
+		conv = &conversation{name: name}
+		t.conversations[name] = conv
+	}
+	if t.current == "" {
+		t.current = name
+		t.loadHistory(conv)
+	}
+	return conv
+}
+
+// loadHistory puts the messages kept for a conversation before its lines
+// the first time it is opened
+func (t *tui) loadHistory(conv *conversation) {
+	if t.history == nil || conv.loaded {
+		return
+	}
+	conv.loaded = true
+
+	entries, err := t.history.Load(conv.name)
+	if err != nil {
+		t.status = fmt.Sprintf("Failed to load history: %v", err)
+	}
+
+	// Threads are put together as if the messages had just arrived
+	loaded := &conversation{}
+	for _, entry := range entries {
+		loaded.addMessage(entry)
+	}
+	lines := append(loaded.lines, conv.lines...)
+	conv.lines = nil
+	for _, l := range lines {
+		conv.append(l)
+	}
+}
+
+// keepKnownKey remembers the key a contact published, messages from the
+// contact are checked against it in later sessions
+func (t *tui) keepKnownKey(event handlers.Event) {
+	if err := keepKnownKey(t.history, event.Contact, event.Fingerprint); err != nil {
+		t.status = fmt.Sprintf("Failed to save the key of %s: %v", event.Contact, err)
+	}
+}
+
+// addMessage records a message in the history and shows it in the
+// conversation
+func (t *tui) addMessage(entry handlers.HistoryEntry) *conversation {
+	if err := recordMessage(t.history, entry); err != nil {
+		t.status = fmt.Sprintf("Failed to save history: %v", err)
+	}
+
+	conv := t.conversation(entry.Conversation)
+	if t.history == nil || conv.loaded {
+		conv.addMessage(entry)
+	}
+	return conv
+}
+
+// edit replaces the text of a message from sender in the scrollback and the
+// history
+func (t *tui) edit(name string, sender string, id string, text string) {
+	if err := editRecorded(t.history, name, sender, id, text); err != nil {
+		t.status = fmt.Sprintf("Failed to edit the message in the history: %v", err)
+	}
+
+	conv := t.conversation(name)
+	if i := conv.find(id, sender); i >= 0 {
+		conv.lines[i].message.Text = text
+		conv.lines[i].message.Edited = true
+	}
+}
+
+// react adds a reaction of sender to a message in the scrollback and the
+// history
+func (t *tui) react(name string, sender string, id string, reaction string) {
+	if err := reactRecorded(t.history, name, sender, id, reaction); err != nil {
+		t.status = fmt.Sprintf("Failed to save the reaction in the history: %v", err)
+	}
+
+	conv := t.conversation(name)
+	if i := conv.find(id, ""); i >= 0 {
+		conv.lines[i].message.AddReaction(sender, reaction)
+	}
+}
+
+// timer keeps the disappearing message timer of a conversation and notes
+// who set it
+func (t *tui) timer(name string, sender string, timer time.Duration) {
+	if err := applyTimer(t.client, t.history, name, timer); err != nil {
+		t.status = fmt.Sprintf("Failed to save the timer in the history: %v", err)
+	}
+	t.conversation(name).add(formatTimer(sender, timer))
+}
+
+// message returns the back-th newest message in the scrollback of a
+// conversation
+func (t *tui) message(name string, back int) (handlers.HistoryEntry, bool) {
+	conv := t.conversation(name)
+	t.loadHistory(conv)
+	for i := len(conv.lines) - 1; i >= 0; i-- {
+		// Messages kept before there were IDs can not be referred to
+		if conv.lines[i].message == nil || conv.lines[i].message.ID == "" {
+			continue
+		}
+		back--
+		if back == 0 {
+			return *conv.lines[i].message, true
+		}
+	}
+	return handlers.HistoryEntry{}, false
+}
+
+// remove deletes a message from sender from the scrollback and the history
+func (t *tui) remove(name string, sender string, id string) {
+	if err := deleteRecorded(t.history, name, sender, id); err != nil {
+		t.status = fmt.Sprintf("Failed to delete the message from the history: %v", err)
+	}
+
+	conv := t.conversation(name)
+	if i := conv.find(id, sender); i >= 0 {
+		conv.lines = append(conv.lines[:i], conv.lines[i+1:]...)
+	}
+}
+
+// names returns the conversations in the order they are listed, sorted by
+// name so that they never move around
+func (t *tui) names() []string {
+	names := make([]string, 0, len(t.conversations))
+	for name := range t.conversations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (t *tui) handleEvents() {
+	for event := range t.client.Events() {
+		t.mutex.Lock()
+		t.handleEvent(event)
+		t.draw()
+		t.mutex.Unlock()
+	}
+
+	t.mutex.Lock()
+	t.quit("Session ended.")
+}
+
+func (t *tui) handleEvent(event handlers.Event) {
+	switch event.Type {
+	case handlers.MessageReceived:
+		name := event.Contact
+		if event.Room != "" {
+			name = roomPrefix + event.Room
+		}
+		conv := t.addMessage(handlers.HistoryEntry{
+			Conversation: name,
+			Sender:       event.Contact,
+			Text:         event.Text,
+			Time:         event.Time,
+			ID:           event.ID,
+			ReplyTo:      event.ReplyTo,
+			ContentType:  event.ContentType,
+			Meta:         event.Meta,
+			Expires:      event.Expires,
+		})
+		if event.ClockSkew != 0 {
+			conv.add(formatClockSkew(event.Contact, event.ClockSkew))
+		}
+		if name != t.current {
+			conv.unread++
+		}
+
+	case handlers.MessageEdited, handlers.MessageDeleted:
+		name := event.Contact
+		if event.Room != "" {
+			name = roomPrefix + event.Room
+		}
+		if event.Type == handlers.MessageEdited {
+			t.edit(name, event.Contact, event.ID, event.Text)
+		} else {
+			t.remove(name, event.Contact, event.ID)
+		}
+
+	case handlers.ReactionReceived:
+		name := event.Contact
+		if event.Room != "" {
+			name = roomPrefix + event.Room
+		}
+		t.react(name, event.Contact, event.ID, event.Text)
+
+	case handlers.TimerChanged:
+		name := event.Contact
+		if event.Room != "" {
+			name = roomPrefix + event.Room
+		}
+		t.timer(name, event.Contact, event.Timer)
+		if name != t.current {
+			t.conversation(name).unread++
+		}
+
+	case handlers.RoomChanged:
+		conv := t.conversation(roomPrefix + event.Room)
+		conv.online = event.Joined
+		if event.Joined {
+			conv.add(fmt.Sprintf("* members: %s", strings.Join(event.Members, ", ")))
+		} else {
+			conv.add("* you left the room")
+		}
+
+	case handlers.ContactOnline:
+		conv := t.conversation(event.Contact)
+		conv.online = true
+		conv.add(fmt.Sprintf("* %s is online", event.Contact))
+		t.keepKnownKey(event)
+
+	case handlers.ContactOffline:
+		conv := t.conversation(event.Contact)
+		conv.online = false
+		conv.add(fmt.Sprintf("* %s went offline", event.Contact))
+
+	case handlers.KeyChanged:
+		conv := t.conversation(event.Contact)
+		conv.add(fmt.Sprintf("* WARNING: the key of %s changed, new fingerprint %s", event.Contact, event.Fingerprint))
+		if event.Contact != t.current {
+			conv.unread++
+		}
+		t.keepKnownKey(event)
+
+	case handlers.Disconnected:
+		t.status = fmt.Sprintf("Connection lost: %v", event.Err)
+
+	case handlers.Reconnected:
+		t.status = "Reconnected"
+
+	case handlers.Error:
+		t.status = fmt.Sprintf("Error: %v", event.Err)
+	}
+}
+
+// handleInput applies the keys read from the terminal
+func (t *tui) handleInput(data []byte) {
+	data = append(t.partial, data...)
+	t.partial = nil
+
+	for len(data) > 0 {
+		b := data[0]
+		switch {
+		case b == 0x1b:
+			n := t.handleEscape(data)
+			data = data[n:]
+			continue
+
+		case b == '\r' || b == '\n':
+			t.submit()
+		case b == 0x7f || b == 0x08:
+			if t.cursor > 0 {
+				t.input = append(t.input[:t.cursor-1], t.input[t.cursor:]...)
+				t.cursor--
+			}
+		case b == 0x03:
+			t.quit("")
+		case b == 0x04:
+			if len(t.input) == 0 {
+				t.quit("")
+			}
+		case b == '\t' || b == 0x0e:
+			t.switchConversation(1)
+		case b == 0x10:
+			t.switchConversation(-1)
+		case b == 0x01:
+			t.cursor = 0
+		case b == 0x05:
+			t.cursor = len(t.input)
+		case b == 0x15:
+			t.input = t.input[:0]
+			t.cursor = 0
+		case b == 0x0c:
+			// Force a full redraw
+			t.width = 0
+			t.resize()
+		case b < 0x20:
+			// Other control characters are ignored
+
+		default:
+			if !utf8.FullRune(data) {
+				t.partial = append([]byte(nil), data...)
+				return
+			}
+			r, size := utf8.DecodeRune(data)
+			t.input = append(t.input[:t.cursor], append([]rune{r}, t.input[t.cursor:]...)...)
+			t.cursor++
+			data = data[size:]
+			continue
+		}
+		data = data[1:]
+	}
+}
+
+// handleEscape handles an escape sequence at the start of data and returns
+// its length
+func (t *tui) handleEscape(data []byte) int {
+	if len(data) < 2 || (data[1] != '[' && data[1] != 'O') {
+		// A lone ESC
+		return 1
+	}
+
+	// CSI and SS3 sequences end with a byte in 0x40-0x7e
+	end := 2
+	for end < len(data) && (data[end] < 0x40 || data[end] > 0x7e) {
+		end++
+	}
+	if end == len(data) {
+		return len(data)
+	}
+
+	switch string(data[2 : end+1]) {
+	case "A":
+		t.switchConversation(-1)
+	case "B":
+		t.switchConversation(1)
+	case "C":
+		if t.cursor < len(t.input) {
+			t.cursor++
+		}
+	case "D":
+		if t.cursor > 0 {
+			t.cursor--
+		}
+	case "H", "1~", "7~":
+		t.cursor = 0
+	case "F", "4~", "8~":
+		t.cursor = len(t.input)
+	case "3~":
+		if t.cursor < len(t.input) {
+			t.input = append(t.input[:t.cursor], t.input[t.cursor+1:]...)
+		}
+	case "Z":
+		t.switchConversation(-1)
+	case "5~":
+		t.scroll(t.paneHeight() / 2)
+	case "6~":
+		t.scroll(-t.paneHeight() / 2)
+	}
+	return end + 1
+}
+
+func (t *tui) switchConversation(step int) {
+	names := t.names()
+	if len(names) == 0 {
+		return
+	}
+
+	i := sort.SearchStrings(names, t.current)
+	i = (i + step + len(names)) % len(names)
+	t.current = names[i]
+
+	conv := t.conversations[t.current]
+	conv.unread = 0
+	conv.scroll = 0
+	t.loadHistory(conv)
+}
+
+func (t *tui) scroll(lines int) {
+	conv, ok := t.conversations[t.current]
+	if !ok {
+		return
+	}
+
+	conv.scroll += lines
+	max := len(t.wrapped(conv)) - t.paneHeight()
+	if conv.scroll > max {
+		conv.scroll = max
+	}
+	if conv.scroll < 0 {
+		conv.scroll = 0
+	}
+}
+
+// submit runs the input line as a command or sends it to the current
+// conversation
+func (t *tui) submit() {
+	text := strings.TrimSpace(string(t.input))
+	t.input = t.input[:0]
+	t.cursor = 0
+	if text == "" {
+		return
+	}
+
+	if isCommand(text) {
+		// Commands may wait for the server, which needs the events to be
+		// handled, so they run without holding the mutex
+		go runCommand(tuiCommands{t}, t.client, text)
+		return
+	}
+
+	if t.current == "" || t.current == systemConversation {
+		t.status = "Nobody to send to yet, pick a conversation with /to"
+		return
+	}
+	t.send(t.current, "", handlers.Content{Type: handlers.ContentText, Text: text})
+}
+
+// send sends content to a conversation, in the thread of parent if set, and
+// adds it to its scrollback
+func (t *tui) send(name string, parent string, content handlers.Content) {
+	id, err := sendTo(t.client, name, parent, content)
+	if err != nil {
+		t.status = fmt.Sprintf("Failed to send message: %v", err)
+		return
+	}
+
+	conv := t.addMessage(handlers.HistoryEntry{
+		Conversation: name,
+		Sender:       t.username,
+		Text:         content.Text,
+		Time:         time.Now(),
+		ID:           id,
+		ReplyTo:      parent,
+		ContentType:  content.Type,
+		Meta:         content.Meta,
+		Expires:      expiresAt(t.client, name),
+	})
+	conv.scroll = 0
+
+	if !conv.online && !strings.HasPrefix(name, roomPrefix) {
+		t.status = fmt.Sprintf("%s is offline, the message is sent when they come back", conv.name)
+	}
+}
+
+// open makes a conversation the current one
+func (t *tui) open(name string) {
+	conv := t.conversation(name)
+	t.current = name
+	conv.unread = 0
+	conv.scroll = 0
+	t.loadHistory(conv)
+}
+
+// jump scrolls the current conversation so that the message of a search
+// result is in the middle of the pane
+func (t *tui) jump(result handlers.SearchResult) {
+	conv, ok := t.conversations[t.current]
+	if !ok {
+		return
+	}
+
+	// The loaded lines start with the history, unless older lines were
+	// dropped from the scrollback. Messages kept before there were IDs
+	// are found by their time.
+	target := -1
+	for i, l := range conv.lines {
+		if l.message == nil {
+			continue
+		}
+		if (result.ID != "" && l.message.ID == result.ID) || (result.ID == "" && l.message.Time.Equal(result.Time) && l.message.Sender == result.Sender) {
+			target = i
+			break
+		}
+	}
+	if target < 0 {
+		t.status = "The message is no longer in the scrollback"
+		return
+	}
+
+	// Count the wrapped lines below the message
+	below := t.wrapped(&conversation{lines: conv.lines[target+1:]})
+	conv.scroll = 0
+	t.scroll(len(below) - t.paneHeight()/2)
+}
+
+// clear empties the scrollback of a conversation and deletes its history
+func (t *tui) clear(name string) error {
+	if conv, ok := t.conversations[name]; ok {
+		conv.lines = nil
+		conv.scroll = 0
+	}
+	if t.history == nil {
+		return nil
+	}
+	return t.history.Delete(name)
+}
+
+// tuiCommands runs commands against the terminal UI. Each call takes the
+// mutex and redraws the screen.
+type tuiCommands struct {
+	t *tui
+}
+
+func (c tuiCommands) show(line string) {
+	c.t.mutex.Lock()
+	defer c.t.mutex.Unlock()
+
+	name := c.t.current
+	if name == "" {
+		name = systemConversation
+	}
+	conv := c.t.conversation(name)
+	conv.add("* " + line)
+	conv.scroll = 0
+	c.t.draw()
+}
+
+func (c tuiCommands) open(name string) {
+	c.t.mutex.Lock()
+	defer c.t.mutex.Unlock()
+
+	c.t.open(name)
+	c.t.draw()
+}
+
+func (c tuiCommands) current() string {
+	c.t.mutex.Lock()
+	defer c.t.mutex.Unlock()
+
+	return c.t.current
+}
+
+func (c tuiCommands) send(name string, text string) {
+	c.t.mutex.Lock()
+	defer c.t.mutex.Unlock()
+
+	c.t.send(name, "", handlers.Content{Type: handlers.ContentText, Text: text})
+	c.t.draw()
+}
+
+func (c tuiCommands) post(name string, content handlers.Content) {
+	c.t.mutex.Lock()
+	defer c.t.mutex.Unlock()
+
+	c.t.send(name, "", content)
+	c.t.draw()
+}
+
+func (c tuiCommands) clear(name string) error {
+	c.t.mutex.Lock()
+	defer c.t.mutex.Unlock()
+
+	defer c.t.draw()
+	return c.t.clear(name)
+}
+
+func (c tuiCommands) localHistory() *handlers.History {
+	return c.t.history
+}
+
+func (c tuiCommands) jump(result handlers.SearchResult) {
+	c.t.mutex.Lock()
+	defer c.t.mutex.Unlock()
+
+	c.t.open(result.Conversation)
+	c.t.jump(result)
+	c.t.draw()
+}
+
+func (c tuiCommands) edit(name string, sender string, id string, text string) {
+	c.t.mutex.Lock()
+	defer c.t.mutex.Unlock()
+
+	c.t.edit(name, sender, id, text)
+	c.t.draw()
+}
+
+func (c tuiCommands) message(name string, back int) (handlers.HistoryEntry, bool) {
+	c.t.mutex.Lock()
+	defer c.t.mutex.Unlock()
+
+	return c.t.message(name, back)
+}
+
+func (c tuiCommands) reply(name string, parent string, text string) {
+	c.t.mutex.Lock()
+	defer c.t.mutex.Unlock()
+
+	c.t.send(name, parent, handlers.Content{Type: handlers.ContentText, Text: text})
+	c.t.draw()
+}
+
+func (c tuiCommands) react(name string, sender string, id string, reaction string) {
+	c.t.mutex.Lock()
+	defer c.t.mutex.Unlock()
+
+	c.t.react(name, sender, id, reaction)
+	c.t.draw()
+}
+
+func (c tuiCommands) timer(name string, sender string, timer time.Duration) {
+	c.t.mutex.Lock()
+	defer c.t.mutex.Unlock()
+
+	c.t.timer(name, sender, timer)
+	c.t.draw()
+}
+
+func (c tuiCommands) remove(name string, sender string, id string) {
+	c.t.mutex.Lock()
+	defer c.t.mutex.Unlock()
+
+	c.t.remove(name, sender, id)
+	c.t.draw()
+}
+
+func (c tuiCommands) quit() {
+	c.t.mutex.Lock()
+	c.t.quit("")
+}
+
+func (t *tui) sidebarWidth() int {
+	width := t.width / 4
+	if width > maxSidebarWidth {
+		width = maxSidebarWidth
+	}
+	return width
+}
+
+func (t *tui) paneWidth() int {
+	return t.width - t.sidebarWidth() - 1
+}
+
+func (t *tui) paneHeight() int {
+	return t.height - 2
+}
+
+// wrapped returns the conversation's lines wrapped to the pane width. Notes
+// may name contacts, so they are sanitized like messages.
+func (t *tui) wrapped(conv *conversation) []string {
+	width := t.paneWidth()
+	if width < 1 {
+		return nil
+	}
+
+	var lines []string
+	for _, line := range conv.lines {
+		runes := []rune(sanitize(line.String()))
+		for len(runes) > width {
+			lines = append(lines, string(runes[:width]))
+			runes = runes[width:]
+		}
+		lines = append(lines, string(runes))
+	}
+	return lines
+}
+
+// draw renders the whole screen in a single write
+func (t *tui) draw() {
+	if t.width < 20 || t.height < 4 {
+		return
+	}
+
+	var b strings.Builder
+	b.WriteString("\x1b[?25l")
+
+	names := t.names()
+	sideWidth := t.sidebarWidth()
+	rows := t.paneHeight()
+
+	var pane []string
+	if conv, ok := t.conversations[t.current]; ok {
+		pane = t.wrapped(conv)
+		end := len(pane) - conv.scroll
+		start := end - rows
+		if start < 0 {
+			start = 0
+		}
+		pane = pane[start:end]
+	}
+
+	for row := 0; row < rows; row++ {
+		fmt.Fprintf(&b, "\x1b[%d;1H", row+1)
+
+		if row < len(names) {
+			conv := t.conversations[names[row]]
+			entry := conv.name
+			if conv.unread > 0 {
+				entry = fmt.Sprintf("%s (%d)", entry, conv.unread)
+			}
+
+			switch {
+			case conv.name == t.current:
+				b.WriteString("\x1b[7m")
+			case !conv.online:
+				b.WriteString("\x1b[2m")
+			case conv.unread > 0:
+				b.WriteString("\x1b[1m")
+			}
+			b.WriteString(fit(" "+entry, sideWidth))
+			b.WriteString("\x1b[0m")
+		} else {
+			b.WriteString(strings.Repeat(" ", sideWidth))
+		}
+
+		b.WriteString("│")
+		if row < len(pane) {
+			b.WriteString(pane[row])
+		}
+		b.WriteString("\x1b[K")
+	}
+
+	// Status line
+	title := t.current
+	if title == "" {
+		title = "no conversation"
+	}
+	status := fmt.Sprintf(" %s | %s | %s", t.username, title, t.status)
+	fmt.Fprintf(&b, "\x1b[%d;1H\x1b[7m%s\x1b[0m", rows+1, fit(status, t.width))
+
+	// Input line, scrolled sideways so the cursor stays visible
+	visible := t.width - 3
+	start := 0
+	if t.cursor > visible {
+		start = t.cursor - visible
+	}
+	end := start + visible
+	if end > len(t.input) {
+		end = len(t.input)
+	}
+	fmt.Fprintf(&b, "\x1b[%d;1H> %s\x1b[K", rows+2, string(t.input[start:end]))
+	fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[?25h", rows+2, t.cursor-start+3)
+
+	os.Stdout.WriteString(b.String())
+}
+
+// fit pads or truncates s to exactly width runes
+func fit(s string, width int) string {
+	runes := []rune(sanitize(s))
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+	return string(runes) + strings.Repeat(" ", width-len(runes))
+}
@@ -0,0 +1,570 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"scrp/client/handlers"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// chat is the line based UI used when the client does not run in a
+// terminal: pick a participant or room from the list, or use /to, then type
+// messages to them. An empty message goes back to the list. Lines starting
+// with "/" are commands.
+type chat struct {
+	client   *handlers.Client
+	username string
+	// Local history, nil when it is turned off
+	history *handlers.History
+
+	mutex     sync.Mutex
+	selecting bool
+	// Contact or "#room" messages go to
+	target string
+	// Latest messages of each conversation, oldest first, for /reply and
+	// /react
+	recent map[string][]handlers.HistoryEntry
+}
+
+// Messages from the history shown when a conversation is opened
+const historyLines = 20
+
+// Messages remembered per conversation
+const maxRecent = 100
+
+func newChat(client *handlers.Client, username string, history *handlers.History) *chat {
+	return &chat{
+		client:   client,
+		username: username,
+		history:  history,
+		recent:   make(map[string][]handlers.HistoryEntry),
+	}
+}
+
+// handleEvents shows what happens in the session until it ends
+func (u *chat) handleEvents() {
+	for event := range u.client.Events() {
+		switch event.Type {
+		case handlers.MessageReceived:
+			clearLine()
+			name := event.Contact
+			if event.Room != "" {
+				name = roomPrefix + event.Room
+				printf("[%s] ", name)
+			}
+			entry := handlers.HistoryEntry{
+				Conversation: name,
+				Sender:       event.Contact,
+				Text:         event.Text,
+				Time:         event.Time,
+				ID:           event.ID,
+				ReplyTo:      event.ReplyTo,
+				ContentType:  event.ContentType,
+				Meta:         event.Meta,
+				Expires:      event.Expires,
+			}
+			fmt.Print(u.format(entry))
+			if event.ClockSkew != 0 {
+				printf("\n%s", formatClockSkew(event.Contact, event.ClockSkew))
+			}
+			printf("\nYour Message: ")
+
+			u.remember(entry)
+			if err := recordMessage(u.history, entry); err != nil {
+				printf("\nFailed to save history: %v\n", err)
+			}
+
+		case handlers.MessageEdited, handlers.MessageDeleted:
+			clearLine()
+			name := event.Contact
+			if event.Room != "" {
+				name = roomPrefix + event.Room
+			}
+			if event.Type == handlers.MessageEdited {
+				u.edit(name, event.Contact, event.ID, event.Text)
+			} else {
+				u.remove(name, event.Contact, event.ID)
+			}
+			printf("Your Message: ")
+
+		case handlers.ReactionReceived:
+			clearLine()
+			name := event.Contact
+			if event.Room != "" {
+				name = roomPrefix + event.Room
+			}
+			u.react(name, event.Contact, event.ID, event.Text)
+			printf("Your Message: ")
+
+		case handlers.TimerChanged:
+			clearLine()
+			name := event.Contact
+			if event.Room != "" {
+				name = roomPrefix + event.Room
+			}
+			u.timer(name, event.Contact, event.Timer)
+			printf("Your Message: ")
+
+		case handlers.RoomChanged:
+			clearLine()
+			if event.Joined {
+				printf("Members of %s%s: %s\n", roomPrefix, event.Room, strings.Join(event.Members, ", "))
+			} else {
+				printf("You left %s%s\n", roomPrefix, event.Room)
+			}
+			u.displayParticipants()
+
+		case handlers.ContactOnline:
+			u.keepKnownKey(event)
+			u.displayParticipants()
+
+		case handlers.ContactOffline:
+			u.displayParticipants()
+
+		case handlers.KeyChanged:
+			clearLine()
+			printf("WARNING: the key of %s changed, new fingerprint %s\n", event.Contact, event.Fingerprint)
+			u.keepKnownKey(event)
+
+		case handlers.Disconnected:
+			printf("\nConnection lost: %v\n", event.Err)
+
+		case handlers.Reconnected:
+			fmt.Println("Reconnected.")
+
+		case handlers.Error:
+			printf("\nError: %v\n", event.Err)
+		}
+	}
+
+	fmt.Println("Session ended.")
+	os.Exit(0)
+}
+
+func (u *chat) setSelecting(selecting bool) {
+	u.mutex.Lock()
+	u.selecting = selecting
+	u.mutex.Unlock()
+}
+
+func (u *chat) displayParticipants() {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	if !u.selecting {
+		return
+	}
+
+	clearScreen()
+	fmt.Println("Participant List:")
+	fmt.Println("=================")
+	for i, name := range u.participants() {
+		printf("%d. %s\n", i+1, name)
+	}
+	printf("=================\n\n")
+
+	printf("Enter participant number to chat, or /help: ")
+}
+
+// participants returns the online contacts followed by the rooms the user
+// is in
+func (u *chat) participants() []string {
+	var names []string
+	for _, contact := range u.client.Contacts() {
+		names = append(names, contact.Username)
+	}
+	for _, room := range u.client.Rooms() {
+		names = append(names, roomPrefix+room)
+	}
+	return names
+}
+
+// run reads participant choices, commands and messages from the terminal
+func (u *chat) run(scanner *bufio.Scanner) {
+	u.setSelecting(true)
+	u.displayParticipants()
+
+	for scanner.Scan() {
+		input := scanner.Text()
+		target := u.current()
+
+		switch {
+		case isCommand(input):
+			runCommand(u, u.client, input)
+
+			// Keep the output of the command on the screen
+			if u.current() == "" {
+				fmt.Print("Enter participant number to chat, or /help: ")
+				continue
+			}
+
+		case target == "":
+			participantNumber, err := strconv.Atoi(input)
+			participants := u.participants()
+			if err != nil || participantNumber < 1 || participantNumber > len(participants) {
+				fmt.Println("Invalid participant number. Please try again.")
+				break
+			}
+			u.open(participants[participantNumber-1])
+
+		case input == "":
+			u.open("")
+
+		// The participant left while we were typing
+		case !strings.HasPrefix(target, roomPrefix) && !u.online(target) && u.client.Connected():
+			printf("%s is no longer online.\n", target)
+			u.open("")
+
+		default:
+			u.send(target, input)
+		}
+
+		u.prompt()
+	}
+}
+
+// prompt asks for what the user should type next
+func (u *chat) prompt() {
+	if u.current() == "" {
+		u.displayParticipants()
+		return
+	}
+	fmt.Print("Your Message: ")
+}
+
+func (u *chat) show(line string) {
+	fmt.Println(sanitize(line))
+}
+
+// open sets the contact or room messages go to, or goes back to the
+// participant list when name is empty
+func (u *chat) open(name string) {
+	u.mutex.Lock()
+	u.target = name
+	u.mutex.Unlock()
+
+	u.setSelecting(name == "")
+	if name == "" {
+		return
+	}
+
+	if u.history != nil {
+		entries, err := u.history.Load(name)
+		if err != nil {
+			printf("Failed to load history: %v\n", err)
+		}
+		u.mutex.Lock()
+		seen := len(u.recent[name]) > 0
+		u.mutex.Unlock()
+		if !seen {
+			for _, entry := range entries {
+				u.remember(entry)
+			}
+		}
+
+		if len(entries) > historyLines {
+			entries = entries[len(entries)-historyLines:]
+		}
+		for _, entry := range entries {
+			fmt.Println(u.format(entry))
+		}
+	}
+	printf("Talking to %s, an empty message goes back to the list.\n", name)
+}
+
+func (u *chat) current() string {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	return u.target
+}
+
+func (u *chat) send(name string, text string) {
+	u.reply(name, "", text)
+}
+
+// reply sends text in the thread of parent
+func (u *chat) reply(name string, parent string, text string) {
+	u.postReply(name, parent, handlers.Content{Type: handlers.ContentText, Text: text})
+}
+
+// post sends content and shows it, unlike typed text it is not on the
+// screen yet
+func (u *chat) post(name string, content handlers.Content) {
+	if entry, ok := u.postReply(name, "", content); ok {
+		fmt.Println(u.format(entry))
+	}
+}
+
+// postReply sends content, in the thread of parent if set, and returns it
+// as kept
+func (u *chat) postReply(name string, parent string, content handlers.Content) (handlers.HistoryEntry, bool) {
+	id, err := sendTo(u.client, name, parent, content)
+	if err != nil {
+		printf("Failed to send message: %v\n", err)
+		return handlers.HistoryEntry{}, false
+	}
+	entry := handlers.HistoryEntry{
+		Conversation: name,
+		Sender:       u.username,
+		Text:         content.Text,
+		Time:         time.Now(),
+		ID:           id,
+		ReplyTo:      parent,
+		ContentType:  content.Type,
+		Meta:         content.Meta,
+		Expires:      expiresAt(u.client, name),
+	}
+	u.remember(entry)
+	if err := recordMessage(u.history, entry); err != nil {
+		printf("Failed to save history: %v\n", err)
+	}
+	return entry, true
+}
+
+// edit shows the new text of a message, the old one can not be taken back
+// from the terminal
+func (u *chat) edit(name string, sender string, id string, text string) {
+	if err := editRecorded(u.history, name, sender, id, text); err != nil {
+		printf("Failed to edit the message in the history: %v\n", err)
+	}
+	u.change(name, id, sender, func(entry *handlers.HistoryEntry) {
+		entry.Text = text
+		entry.Edited = true
+	})
+	printf("[%s] %s edited a message: %s\n", name, sender, text)
+}
+
+func (u *chat) remove(name string, sender string, id string) {
+	if err := deleteRecorded(u.history, name, sender, id); err != nil {
+		printf("Failed to delete the message from the history: %v\n", err)
+	}
+	u.change(name, id, sender, func(entry *handlers.HistoryEntry) {
+		entry.ID = ""
+	})
+	printf("[%s] %s deleted a message\n", name, sender)
+}
+
+func (u *chat) react(name string, sender string, id string, reaction string) {
+	if err := reactRecorded(u.history, name, sender, id, reaction); err != nil {
+		printf("Failed to save the reaction in the history: %v\n", err)
+	}
+
+	var target handlers.HistoryEntry
+	found := u.change(name, id, "", func(entry *handlers.HistoryEntry) {
+		entry.AddReaction(sender, reaction)
+		target = *entry
+	})
+	if found {
+		printf("[%s] %s reacted %s to %s\n", name, sender, reaction, quoteEntry(target))
+	} else {
+		printf("[%s] %s reacted %s to a message\n", name, sender, reaction)
+	}
+}
+
+func (u *chat) timer(name string, sender string, timer time.Duration) {
+	if err := applyTimer(u.client, u.history, name, timer); err != nil {
+		printf("Failed to save the timer in the history: %v\n", err)
+	}
+	printf("[%s] %s\n", name, formatTimer(sender, timer))
+}
+
+// expireMessages drops disappearing messages from the remembered ones and
+// the history once their time is up. Lines already printed can not be taken
+// back from the terminal.
+func (u *chat) expireMessages() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if u.history != nil {
+			if err := u.history.Expire(); err != nil {
+				printf("\nFailed to drop disappeared messages from the history: %v\n", err)
+			}
+		}
+
+		u.mutex.Lock()
+		for name, recent := range u.recent {
+			kept := recent[:0]
+			for _, entry := range recent {
+				if entry.Expires.IsZero() || now.Before(entry.Expires) {
+					kept = append(kept, entry)
+				}
+			}
+			u.recent[name] = kept
+		}
+		u.mutex.Unlock()
+	}
+}
+
+// format formats a message, quoting the message a reply is in the thread
+// of
+func (u *chat) format(entry handlers.HistoryEntry) string {
+	line := formatEntry(entry)
+	if entry.ReplyTo == "" {
+		return line
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+	for _, parent := range u.recent[entry.Conversation] {
+		if parent.ID == entry.ReplyTo {
+			return fmt.Sprintf("%s (in reply to %s)", line, quoteEntry(parent))
+		}
+	}
+	return line + " (reply)"
+}
+
+// remember keeps a message for /reply and /react
+func (u *chat) remember(entry handlers.HistoryEntry) {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	recent := append(u.recent[entry.Conversation], entry)
+	if len(recent) > maxRecent {
+		recent = recent[len(recent)-maxRecent:]
+	}
+	u.recent[entry.Conversation] = recent
+}
+
+// change applies update to a remembered message with the ID from sender, or
+// from anyone when sender is empty, and reports whether there was one
+func (u *chat) change(name string, id string, sender string, update func(*handlers.HistoryEntry)) bool {
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	for i := range u.recent[name] {
+		entry := &u.recent[name][i]
+		if id != "" && entry.ID == id && (sender == "" || entry.Sender == sender) {
+			update(entry)
+			return true
+		}
+	}
+	return false
+}
+
+// message returns the back-th newest message of a conversation, looking in
+// the history when none arrived yet
+func (u *chat) message(name string, back int) (handlers.HistoryEntry, bool) {
+	u.mutex.Lock()
+	empty := len(u.recent[name]) == 0
+	u.mutex.Unlock()
+
+	if empty && u.history != nil {
+		entries, err := u.history.Load(name)
+		if err != nil {
+			printf("Failed to load history: %v\n", err)
+		}
+		for _, entry := range entries {
+			u.remember(entry)
+		}
+	}
+
+	u.mutex.Lock()
+	defer u.mutex.Unlock()
+
+	// Deleted messages have lost their ID and are skipped
+	recent := u.recent[name]
+	for i := len(recent) - 1; i >= 0; i-- {
+		if recent[i].ID == "" {
+			continue
+		}
+		back--
+		if back == 0 {
+			return recent[i], true
+		}
+	}
+	return handlers.HistoryEntry{}, false
+}
+
+func (u *chat) localHistory() *handlers.History {
+	return u.history
+}
+
+// jump opens the conversation of a search result and shows the messages
+// around it
+func (u *chat) jump(result handlers.SearchResult) {
+	u.mutex.Lock()
+	u.target = result.Conversation
+	u.mutex.Unlock()
+	u.setSelecting(false)
+
+	entries, err := u.history.Load(result.Conversation)
+	if err != nil {
+		printf("Failed to load history: %v\n", err)
+	}
+
+	start := result.Index - historyLines/2
+	if start < 0 {
+		start = 0
+	}
+	end := result.Index + historyLines/2
+	if end > len(entries) {
+		end = len(entries)
+	}
+	for i := start; i < end; i++ {
+		marker := "  "
+		if i == result.Index {
+			marker = "> "
+		}
+		fmt.Println(marker + formatEntry(entries[i]))
+	}
+	printf("Talking to %s, an empty message goes back to the list.\n", result.Conversation)
+}
+
+func (u *chat) clear(name string) error {
+	if u.history == nil {
+		return nil
+	}
+	return u.history.Delete(name)
+}
+
+// quit ends the session and exits
+func (u *chat) quit() {
+	u.client.SendDisconnectRequest()
+	fmt.Println("Disconnected.")
+	os.Exit(0)
+}
+
+func (u *chat) online(username string) bool {
+	for _, contact := range u.client.Contacts() {
+		if contact.Username == username {
+			return true
+		}
+	}
+	return false
+}
+
+func clearScreen() {
+	fmt.Print("\033[H\033[2J")
+}
+
+func clearLine() {
+	fmt.Print("\033[2K\r")
+}
+
+// keepKnownKey remembers the key a contact published, messages from the
+// contact are checked against it in later sessions
+func (u *chat) keepKnownKey(event handlers.Event) {
+	if err := keepKnownKey(u.history, event.Contact, event.Fingerprint); err != nil {
+		printf("\nFailed to save the key of %s: %v\n", event.Contact, err)
+	}
+}
+
+// printf is fmt.Printf for lines with names and text from peers, the strings
+// and errors among args are sanitized
+func printf(format string, args ...any) {
+	for i, arg := range args {
+		switch arg := arg.(type) {
+		case string:
+			args[i] = sanitize(arg)
+		case error:
+			args[i] = sanitize(arg.Error())
+		}
+	}
+	fmt.Printf(format, args...)
+}
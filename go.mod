@@ -2,6 +2,9 @@ module scrp
 
 go 1.20
 
-require golang.org/x/term v0.8.0
+require (
+	golang.org/x/crypto v0.9.0
+	golang.org/x/term v0.8.0
+)
 
 require golang.org/x/sys v0.8.0 // indirect
@@ -9,6 +9,26 @@ type AuthRequestPayload struct {
 // AuthResponsePayload struct represents a SRCP AUTH_RESPONSE payload
 type AuthResponsePayload struct {
 	Status uint8
+	Token  [64]byte
+}
+
+// AuthCodePayload struct represents a SRCP AUTH_CODE payload. Code holds
+// either a TOTP code or a recovery code.
+type AuthCodePayload struct {
+	Code [16]byte
+}
+
+// TwoFactorPayload struct represents a SRCP TWO_FACTOR payload
+type TwoFactorPayload struct {
+	Action uint8
+	Code   [16]byte
+}
+
+// TwoFactorAckPayload struct represents a SRCP TWO_FACTOR_ACK payload
+type TwoFactorAckPayload struct {
+	Status        uint8
+	URI           [256]byte
+	RecoveryCodes [10][16]byte
 }
 
 // PublicKeyPayload struct represents a SRCP PUBLIC_KEY payload
@@ -17,12 +37,18 @@ type PublicKeyPayload struct {
 	Key      [512]byte
 }
 
-// MessagePayload struct represents a SRCP MESSAGE payload
+// MessagePayload struct represents a SRCP MESSAGE payload. Room is set
+// when the message is one copy of a message to a room. Timestamp is set by
+// the sender and Received by the server, both in seconds since the epoch.
+// Expires is when a disappearing message has to be dropped if it is still
+// queued, zero for messages that stay.
 type MessagePayload struct {
 	Timestamp uint32
+	Received  uint32
+	Expires   uint32
 	Sender    [32]byte
 	Recipient [32]byte
-	TextLen   uint16
+	Room      [32]byte
 	Data      [2048]byte
 }
 
@@ -35,3 +61,41 @@ type MessageAckPayload struct {
 type DisconnectPayload struct {
 	Reason uint8
 }
+
+// HeartbeatPayload struct represents a SRCP PING or PONG payload
+type HeartbeatPayload struct {
+	Nonce uint32
+}
+
+// TokenAuthPayload struct represents a SRCP TOKEN_AUTH payload
+type TokenAuthPayload struct {
+	Username [32]byte
+	Token    [64]byte
+}
+
+// LogoutPayload struct represents a SRCP LOGOUT payload
+type LogoutPayload struct {
+	Username [32]byte
+	Token    [64]byte
+}
+
+// RoomPayload struct represents a SRCP ROOM_JOIN or ROOM_LEAVE payload
+type RoomPayload struct {
+	Room [32]byte
+}
+
+// RoomMembersPayload struct represents a SRCP ROOM_MEMBERS payload, sent to
+// every member when a room's membership changes
+type RoomMembersPayload struct {
+	Room    [32]byte
+	Status  uint8
+	Count   uint8
+	Members [32][32]byte
+}
+
+// RoomListPayload struct represents a SRCP ROOM_LIST payload. The client
+// sends it empty, the server answers with the rooms it knows.
+type RoomListPayload struct {
+	Count uint8
+	Rooms [64][32]byte
+}
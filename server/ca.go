@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"scrp/server/utils"
+	"strings"
+	"time"
+)
+
+const caUsage = `Usage: server ca <command> [flags]
+
+Commands:
+  init     create a new certificate authority
+  server   issue a server certificate signed by the CA
+  client   issue a client certificate signed by the CA
+
+Run "server ca <command> -h" for the flags of a command.`
+
+// runCA implements the srcp-ca subcommand for managing a local certificate
+// authority
+func runCA(args []string) {
+	if len(args) == 0 {
+		log.Fatal(caUsage)
+	}
+
+	flags := flag.NewFlagSet("ca "+args[0], flag.ExitOnError)
+	dir := flags.String("dir", "./ca", "directory holding the CA certificate and key")
+	days := flags.Int("days", 0, "validity in days (default depends on the command)")
+
+	caCert := func() string { return filepath.Join(*dir, "ca.pem") }
+	caKey := func() string { return filepath.Join(*dir, "ca-key.pem") }
+	validity := func(defaultDays int) time.Duration {
+		if *days > 0 {
+			return time.Duration(*days) * 24 * time.Hour
+		}
+		return time.Duration(defaultDays) * 24 * time.Hour
+	}
+
+	switch args[0] {
+	case "init":
+		name := flags.String("name", "SRCP Local CA", "common name of the CA")
+		force := flags.Bool("force", false, "replace an existing CA, which invalidates every certificate it issued")
+		flags.Parse(args[1:])
+
+		err := utils.GenerateCA(caCert(), caKey(), *name, validity(3650), *force)
+		if errors.Is(err, os.ErrExist) {
+			log.Fatalf("Failed to create CA: %v, use -force to replace it and invalidate every certificate it issued", err)
+		}
+		if err != nil {
+			log.Fatalf("Failed to create CA: %v", err)
+		}
+		fmt.Printf("CA written to %s and %s\n", caCert(), caKey())
+
+	case "server":
+		hosts := flags.String("hosts", "localhost,127.0.0.1", "comma separated DNS names and IP addresses")
+		out := flags.String("out", "./server/cert.pem", "certificate output file")
+		keyOut := flags.String("key-out", "./server/key.pem", "private key output file")
+		flags.Parse(args[1:])
+
+		if err := utils.IssueServerCert(caCert(), caKey(), *out, *keyOut, splitList(*hosts), validity(397)); err != nil {
+			log.Fatalf("Failed to issue server certificate: %v", err)
+		}
+		fmt.Printf("Server certificate written to %s and %s\n", *out, *keyOut)
+
+	case "client":
+		name := flags.String("name", "", "username the certificate authenticates as")
+		out := flags.String("out", "", "certificate output file (default <name>.pem)")
+		keyOut := flags.String("key-out", "", "private key output file (default <name>-key.pem)")
+		flags.Parse(args[1:])
+
+		if *out == "" {
+			*out = *name + ".pem"
+		}
+		if *keyOut == "" {
+			*keyOut = *name + "-key.pem"
+		}
+
+		if err := utils.IssueClientCert(caCert(), caKey(), *out, *keyOut, *name, validity(365)); err != nil {
+			log.Fatalf("Failed to issue client certificate: %v", err)
+		}
+		fmt.Printf("Client certificate for %s written to %s and %s\n", *name, *out, *keyOut)
+
+	default:
+		log.Fatal(caUsage)
+	}
+}
+
+func splitList(list string) []string {
+	var items []string
+	for _, item := range strings.Split(list, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
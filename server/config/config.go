@@ -0,0 +1,358 @@
+// Package config loads the server configuration from a JSON file,
+// environment variables and command-line flags, in increasing order of
+// precedence.
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Duration is a time.Duration that is written as a string such as "30s" in
+// the configuration file
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"30s\": %v", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+type Config struct {
+	Listen  ListenConfig  `json:"listen"`
+	TLS     TLSConfig     `json:"tls"`
+	Auth    AuthConfig    `json:"auth"`
+	Limits  LimitsConfig  `json:"limits"`
+	Logging LoggingConfig `json:"logging"`
+	Storage StorageConfig `json:"storage"`
+}
+
+type ListenConfig struct {
+	// Address the SRCP listener binds to, host:port
+	Address string `json:"address"`
+	// Address of the metrics endpoint, empty to disable it
+	MetricsAddress string `json:"metrics_address"`
+}
+
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+	// Names a generated self-signed certificate is valid for
+	CertHosts      []string `json:"cert_hosts"`
+	ReloadInterval Duration `json:"reload_interval"`
+
+	ClientCAFile      string `json:"client_ca_file"`
+	RequireClientCert bool   `json:"require_client_cert"`
+}
+
+type AuthConfig struct {
+	// "any" accepts every password, "file" checks bcrypt hashes in UsersFile
+	Backend    string   `json:"backend"`
+	UsersFile  string   `json:"users_file"`
+	SessionTTL Duration `json:"session_ttl"`
+}
+
+type LimitsConfig struct {
+	WriteTimeout Duration `json:"write_timeout"`
+	QueueSize    int      `json:"queue_size"`
+	// "drop", "spool" or "disconnect"
+	SlowConsumer string `json:"slow_consumer"`
+	SpoolDir     string `json:"spool_dir"`
+	// Bytes spooled for one client before it is disconnected
+	SpoolLimit int64 `json:"spool_limit"`
+
+	HeartbeatInterval Duration `json:"heartbeat_interval"`
+	HeartbeatTimeout  Duration `json:"heartbeat_timeout"`
+
+	// How long a shutdown waits for clients to receive their DISCONNECT
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+
+	// How far the timestamp of a message may be from the server's clock
+	// before it is logged as skewed
+	MaxClockSkew Duration `json:"max_clock_skew"`
+
+	// How often expired disappearing messages are purged from mailboxes
+	MailboxPurgeInterval Duration `json:"mailbox_purge_interval"`
+}
+
+type LoggingConfig struct {
+	// Log file, empty for standard error
+	File string `json:"file"`
+	// Log the (encrypted) body of every relayed message
+	LogMessages bool `json:"log_messages"`
+}
+
+type StorageConfig struct {
+	// Directory for persistent server state such as the token secret
+	Dir string `json:"dir"`
+}
+
+// Default returns the configuration used when nothing is overridden
+func Default() Config {
+	return Config{
+		Listen: ListenConfig{
+			Address:        ":8080",
+			MetricsAddress: "localhost:9090",
+		},
+		TLS: TLSConfig{
+			CertFile:       "./server/cert.pem",
+			KeyFile:        "./server/key.pem",
+			ReloadInterval: Duration(10 * time.Second),
+		},
+		Auth: AuthConfig{
+			Backend:    "any",
+			SessionTTL: Duration(7 * 24 * time.Hour),
+		},
+		Limits: LimitsConfig{
+			WriteTimeout:      Duration(10 * time.Second),
+			QueueSize:         256,
+			SlowConsumer:      "disconnect",
+			SpoolDir:          os.TempDir(),
+			SpoolLimit:        64 << 20,
+			HeartbeatInterval: Duration(30 * time.Second),
+			HeartbeatTimeout:  Duration(30 * time.Second),
+			ShutdownTimeout:   Duration(10 * time.Second),
+			MaxClockSkew:      Duration(5 * time.Minute),
+
+			MailboxPurgeInterval: Duration(time.Minute),
+		},
+		Logging: LoggingConfig{
+			LogMessages: true,
+		},
+		Storage: StorageConfig{
+			Dir: "./server/data",
+		},
+	}
+}
+
+// LoadFile overlays the JSON file at path on the configuration. Unknown
+// keys are rejected so that typos do not go unnoticed.
+func (c *Config) LoadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	decoder := json.NewDecoder(f)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return nil
+}
+
+// envOverrides maps environment variables to the settings they override
+var envOverrides = []struct {
+	name  string
+	apply func(c *Config, value string) error
+}{
+	{"SRCP_LISTEN_ADDRESS", func(c *Config, v string) error { c.Listen.Address = v; return nil }},
+	{"SRCP_METRICS_ADDRESS", func(c *Config, v string) error { c.Listen.MetricsAddress = v; return nil }},
+	{"SRCP_TLS_CERT_FILE", func(c *Config, v string) error { c.TLS.CertFile = v; return nil }},
+	{"SRCP_TLS_KEY_FILE", func(c *Config, v string) error { c.TLS.KeyFile = v; return nil }},
+	{"SRCP_TLS_CLIENT_CA_FILE", func(c *Config, v string) error { c.TLS.ClientCAFile = v; return nil }},
+	{"SRCP_TLS_REQUIRE_CLIENT_CERT", func(c *Config, v string) error { return parseBool(v, &c.TLS.RequireClientCert) }},
+	{"SRCP_AUTH_BACKEND", func(c *Config, v string) error { c.Auth.Backend = v; return nil }},
+	{"SRCP_AUTH_USERS_FILE", func(c *Config, v string) error { c.Auth.UsersFile = v; return nil }},
+	{"SRCP_LIMITS_QUEUE_SIZE", func(c *Config, v string) error { return parseInt(v, &c.Limits.QueueSize) }},
+	{"SRCP_LIMITS_SLOW_CONSUMER", func(c *Config, v string) error { c.Limits.SlowConsumer = v; return nil }},
+	{"SRCP_LOGGING_FILE", func(c *Config, v string) error { c.Logging.File = v; return nil }},
+	{"SRCP_STORAGE_DIR", func(c *Config, v string) error { c.Storage.Dir = v; return nil }},
+}
+
+// LoadEnv applies the SRCP_* environment variables
+func (c *Config) LoadEnv() error {
+	for _, override := range envOverrides {
+		value, ok := os.LookupEnv(override.name)
+		if !ok {
+			continue
+		}
+		if err := override.apply(c, value); err != nil {
+			return fmt.Errorf("%s: %v", override.name, err)
+		}
+	}
+	return nil
+}
+
+func parseBool(value string, target *bool) error {
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return err
+	}
+	*target = b
+	return nil
+}
+
+func parseInt(value string, target *int) error {
+	i, err := strconv.Atoi(value)
+	if err != nil {
+		return err
+	}
+	*target = i
+	return nil
+}
+
+// Load builds the configuration from the defaults, the file given with
+// -config, the environment and the remaining flags
+func Load(flags *flag.FlagSet, args []string) (Config, error) {
+	cfg := Default()
+
+	configFile := flags.String("config", "", "JSON configuration file")
+	listen := flags.String("listen", "", "address to listen on, host:port")
+	metrics := flags.String("metrics", "", "address of the metrics endpoint")
+	certFile := flags.String("cert", "", "server certificate, generated if missing")
+	keyFile := flags.String("key", "", "server private key, generated if missing")
+	clientCA := flags.String("client-ca", "", "CA certificate used to verify client certificates")
+	requireClientCert := flags.Bool("require-client-cert", false, "reject clients without a certificate signed by -client-ca")
+	authBackend := flags.String("auth", "", `authentication backend, "any" or "file"`)
+	usersFile := flags.String("users", "", "users file for the file authentication backend")
+	logFile := flags.String("log", "", "log file")
+	storageDir := flags.String("data", "", "directory for persistent server state")
+
+	if err := flags.Parse(args); err != nil {
+		return cfg, err
+	}
+
+	if *configFile != "" {
+		if err := cfg.LoadFile(*configFile); err != nil {
+			return cfg, err
+		}
+	}
+	if err := cfg.LoadEnv(); err != nil {
+		return cfg, err
+	}
+
+	// Only flags given on the command line override the file and environment
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.Listen.Address = *listen
+		case "metrics":
+			cfg.Listen.MetricsAddress = *metrics
+		case "cert":
+			cfg.TLS.CertFile = *certFile
+		case "key":
+			cfg.TLS.KeyFile = *keyFile
+		case "client-ca":
+			cfg.TLS.ClientCAFile = *clientCA
+		case "require-client-cert":
+			cfg.TLS.RequireClientCert = *requireClientCert
+		case "auth":
+			cfg.Auth.Backend = *authBackend
+		case "users":
+			cfg.Auth.UsersFile = *usersFile
+		case "log":
+			cfg.Logging.File = *logFile
+		case "data":
+			cfg.Storage.Dir = *storageDir
+		}
+	})
+
+	return cfg, cfg.Validate()
+}
+
+// Validate checks the configuration and reports every problem at once
+func (c *Config) Validate() error {
+	var problems []string
+	problem := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if _, _, err := net.SplitHostPort(c.Listen.Address); err != nil {
+		problem("listen.address %q is not host:port: %v", c.Listen.Address, err)
+	}
+	if c.Listen.MetricsAddress != "" {
+		if _, _, err := net.SplitHostPort(c.Listen.MetricsAddress); err != nil {
+			problem("listen.metrics_address %q is not host:port: %v", c.Listen.MetricsAddress, err)
+		}
+	}
+
+	if c.TLS.CertFile == "" || c.TLS.KeyFile == "" {
+		problem("tls.cert_file and tls.key_file are required")
+	}
+	if c.TLS.ReloadInterval <= 0 {
+		problem("tls.reload_interval must be positive")
+	}
+	if c.TLS.RequireClientCert && c.TLS.ClientCAFile == "" {
+		problem("tls.require_client_cert needs tls.client_ca_file")
+	}
+	if c.TLS.ClientCAFile != "" {
+		if _, err := os.Stat(c.TLS.ClientCAFile); err != nil {
+			problem("tls.client_ca_file: %v", err)
+		}
+	}
+
+	switch c.Auth.Backend {
+	case "any":
+	case "file":
+		if c.Auth.UsersFile == "" {
+			problem("auth.users_file is required for the file backend")
+		} else if _, err := os.Stat(c.Auth.UsersFile); err != nil {
+			problem("auth.users_file: %v", err)
+		}
+	default:
+		problem("auth.backend %q is unknown, expected \"any\" or \"file\"", c.Auth.Backend)
+	}
+	if c.Auth.SessionTTL <= 0 {
+		problem("auth.session_ttl must be positive")
+	}
+
+	if c.Limits.WriteTimeout <= 0 {
+		problem("limits.write_timeout must be positive")
+	}
+	if c.Limits.QueueSize <= 0 {
+		problem("limits.queue_size must be positive")
+	}
+	switch c.Limits.SlowConsumer {
+	case "drop", "disconnect":
+	case "spool":
+		if c.Limits.SpoolDir == "" {
+			problem("limits.spool_dir is required for the spool policy")
+		}
+		if c.Limits.SpoolLimit <= 0 {
+			problem("limits.spool_limit must be positive for the spool policy")
+		}
+	default:
+		problem("limits.slow_consumer %q is unknown, expected \"drop\", \"spool\" or \"disconnect\"", c.Limits.SlowConsumer)
+	}
+	if c.Limits.HeartbeatInterval <= 0 || c.Limits.HeartbeatTimeout <= 0 {
+		problem("limits.heartbeat_interval and limits.heartbeat_timeout must be positive")
+	}
+	if c.Limits.ShutdownTimeout <= 0 {
+		problem("limits.shutdown_timeout must be positive")
+	}
+	if c.Limits.MaxClockSkew <= 0 {
+		problem("limits.max_clock_skew must be positive")
+	}
+	if c.Limits.MailboxPurgeInterval <= 0 {
+		problem("limits.mailbox_purge_interval must be positive")
+	}
+
+	if c.Storage.Dir == "" {
+		problem("storage.dir is required")
+	}
+
+	if len(problems) > 0 {
+		return errors.New("invalid configuration:\n  " + strings.Join(problems, "\n  "))
+	}
+	return nil
+}
@@ -0,0 +1,342 @@
+package server
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"errors"
+	"scrp/models"
+	"scrp/server/utils"
+	"scrp/variables"
+	"strings"
+	"time"
+)
+
+const (
+	// Number of recovery codes issued when two factor authentication is
+	// enabled
+	recoveryCodeCount = 10
+	// Wrong AUTH_CODEs accepted before the login is rejected
+	maxAuthCodeAttempts = 3
+	// Every maxAuthCodeAttempts wrong codes for an account lock its second
+	// factor, for twice as long each time up to maxCodeLockout
+	codeLockout    = time.Minute
+	maxCodeLockout = time.Hour
+)
+
+// errCodeLocked is returned by verifySecondFactor while an account is locked
+// after too many wrong codes
+var errCodeLocked = errors.New("too many wrong codes, try again later")
+
+// Account holds per user settings that outlive a connection
+type Account struct {
+	Username string `json:"username"`
+
+	// TOTP second factor. PendingTOTPSecret is set between enrollment and
+	// confirmation.
+	TOTPSecret        []byte `json:"totp_secret,omitempty"`
+	PendingTOTPSecret []byte `json:"pending_totp_secret,omitempty"`
+	// SHA-256 hashes of the unused recovery codes
+	RecoveryCodes [][32]byte `json:"recovery_codes,omitempty"`
+	// TOTP period of the last code used, which is not accepted again
+	LastTOTPStep int64 `json:"last_totp_step,omitempty"`
+
+	// Wrong codes since the last right one, and until when no code is
+	// accepted because of them
+	FailedCodes int       `json:"failed_codes,omitempty"`
+	LockedUntil time.Time `json:"locked_until"`
+}
+
+func (a *Account) TwoFactorEnabled() bool {
+	return len(a.TOTPSecret) > 0
+}
+
+func (a *Account) clone() *Account {
+	c := *a
+	c.TOTPSecret = append([]byte(nil), a.TOTPSecret...)
+	c.PendingTOTPSecret = append([]byte(nil), a.PendingTOTPSecret...)
+	c.RecoveryCodes = append([][32]byte(nil), a.RecoveryCodes...)
+	return &c
+}
+
+// account returns the stored account of the user, or a new one on first use
+func (s *Server) account(username string) (*Account, error) {
+	account, err := s.store.Account(username)
+	if err != nil {
+		return nil, err
+	}
+	if account == nil {
+		account = &Account{Username: username}
+	}
+	return account, nil
+}
+
+// updateAccount loads the user's account, applies update and saves the
+// account if update reports a change
+func (s *Server) updateAccount(username string, update func(account *Account) bool) error {
+	s.accountsMutex.Lock()
+	defer s.accountsMutex.Unlock()
+
+	account, err := s.account(username)
+	if err != nil {
+		return err
+	}
+	if !update(account) {
+		return nil
+	}
+	return s.store.SaveAccount(account)
+}
+
+// verifySecondFactor accepts a current TOTP code that was not used before or
+// an unused recovery code. Recovery codes are consumed. Wrong codes count
+// against the account, which is locked for a while after too many of them.
+func (s *Server) verifySecondFactor(username string, code string) (bool, error) {
+	valid, locked := false, false
+	err := s.updateAccount(username, func(account *Account) bool {
+		if !account.TwoFactorEnabled() {
+			return false
+		}
+
+		now := time.Now()
+		if now.Before(account.LockedUntil) {
+			locked = true
+			return false
+		}
+
+		if step, ok := utils.VerifyTOTP(account.TOTPSecret, code, now, account.LastTOTPStep); ok {
+			account.LastTOTPStep = step
+			account.FailedCodes = 0
+			valid = true
+			return true
+		}
+
+		hash := sha256.Sum256([]byte(normalizeRecoveryCode(code)))
+		for i, stored := range account.RecoveryCodes {
+			if subtle.ConstantTimeCompare(hash[:], stored[:]) == 1 {
+				account.RecoveryCodes = append(account.RecoveryCodes[:i], account.RecoveryCodes[i+1:]...)
+				account.FailedCodes = 0
+				valid = true
+				return true
+			}
+		}
+
+		account.FailedCodes++
+		if account.FailedCodes%maxAuthCodeAttempts == 0 {
+			account.LockedUntil = now.Add(lockout(account.FailedCodes / maxAuthCodeAttempts))
+		}
+		return true
+	})
+	if err != nil {
+		return false, err
+	}
+	if locked {
+		return false, errCodeLocked
+	}
+	return valid, nil
+}
+
+// lockout returns how long an account is locked the nth time in a row
+func lockout(n int) time.Duration {
+	duration := codeLockout
+	for i := 1; i < n && duration < maxCodeLockout; i++ {
+		duration *= 2
+	}
+	if duration > maxCodeLockout {
+		duration = maxCodeLockout
+	}
+	return duration
+}
+
+// HandleAuthCode completes a login that was answered with AuthChallenge
+func (s *Server) HandleAuthCode(client *Client, payload models.AuthCodePayload) {
+	if client.State != AUTH_REQ_RECVD {
+		s.logger.Printf("Unexpected AUTH_CODE from %s", clientName(client))
+		s.sendAuthFailure(client)
+		return
+	}
+
+	code := string(bytes.Trim(payload.Code[:], "\x00"))
+	username := string(bytes.Trim(client.pendingUsername[:], "\x00"))
+
+	valid, err := s.verifySecondFactor(username, code)
+	if err == errCodeLocked {
+		s.logger.Printf("Second factor of %s is locked after too many wrong codes", username)
+		client.State = INIT
+		s.sendAuthFailure(client)
+		return
+	}
+	if err != nil {
+		s.logger.Printf("Failed to check second factor for %s: %v", username, err)
+		client.State = INIT
+		s.sendAuthFailure(client)
+		return
+	}
+
+	if !valid {
+		client.authAttempts++
+		s.logger.Printf("Wrong second factor for %s", username)
+
+		if client.authAttempts >= maxAuthCodeAttempts {
+			client.State = INIT
+			s.sendAuthFailure(client)
+			return
+		}
+
+		// Ask again
+		s.sendAuthStatus(client, variables.AuthChallenge)
+		return
+	}
+
+	s.logger.Println("User Authenticated: ", username)
+	s.completeLogin(client, client.pendingUsername, [64]byte{})
+}
+
+// HandleTwoFactor enrolls, confirms or disables TOTP for a logged in user
+func (s *Server) HandleTwoFactor(client *Client, payload models.TwoFactorPayload) {
+	response := models.TwoFactorAckPayload{
+		Status: variables.TwoFactorFailure,
+	}
+	defer func() {
+		if err := s.Send(client, variables.TwoFactorAck, &response); err != nil {
+			s.logger.Printf("Failed to send TWO_FACTOR_ACK to client: %v", err)
+		}
+	}()
+
+	if client.State < AUTHENTICATED || client.State >= DISCONNECTING {
+		return
+	}
+
+	username := clientName(client)
+	code := string(bytes.Trim(payload.Code[:], "\x00"))
+
+	switch payload.Action {
+	case variables.TwoFactorEnroll:
+		// Replacing an active secret takes a code of the current one, a
+		// stolen session alone can not take over the second factor
+		account, err := s.account(username)
+		if err != nil {
+			s.logger.Printf("Failed to load account %s: %v", username, err)
+			return
+		}
+		if account.TwoFactorEnabled() {
+			valid, err := s.verifySecondFactor(username, code)
+			if err != nil {
+				s.logger.Printf("Failed to check second factor for %s: %v", username, err)
+				return
+			}
+			if !valid {
+				return
+			}
+		}
+
+		secret, err := utils.GenerateTOTPSecret()
+		if err != nil {
+			s.logger.Printf("Failed to generate TOTP secret: %v", err)
+			return
+		}
+
+		err = s.updateAccount(username, func(account *Account) bool {
+			account.PendingTOTPSecret = secret
+			return true
+		})
+		if err != nil {
+			s.logger.Printf("Failed to save account %s: %v", username, err)
+			return
+		}
+
+		copy(response.URI[:], utils.TOTPProvisioningURI("SRCP", username, secret))
+		response.Status = variables.TwoFactorSuccess
+
+	case variables.TwoFactorConfirm:
+		var codes []string
+		err := s.updateAccount(username, func(account *Account) bool {
+			if len(account.PendingTOTPSecret) == 0 {
+				return false
+			}
+			step, ok := utils.VerifyTOTP(account.PendingTOTPSecret, code, time.Now(), 0)
+			if !ok {
+				return false
+			}
+
+			var hashes [][32]byte
+			var err error
+			codes, hashes, err = generateRecoveryCodes()
+			if err != nil {
+				s.logger.Printf("Failed to generate recovery codes: %v", err)
+				codes = nil
+				return false
+			}
+
+			account.TOTPSecret = account.PendingTOTPSecret
+			account.PendingTOTPSecret = nil
+			account.RecoveryCodes = hashes
+			account.LastTOTPStep = step
+			return true
+		})
+		if err != nil {
+			s.logger.Printf("Failed to save account %s: %v", username, err)
+			return
+		}
+		if codes == nil {
+			return
+		}
+
+		for i, code := range codes {
+			copy(response.RecoveryCodes[i][:], code)
+		}
+		response.Status = variables.TwoFactorSuccess
+		s.logger.Printf("Two factor authentication enabled for %s", username)
+
+	case variables.TwoFactorDisable:
+		valid, err := s.verifySecondFactor(username, code)
+		if err != nil {
+			s.logger.Printf("Failed to check second factor for %s: %v", username, err)
+			return
+		}
+		if !valid {
+			return
+		}
+
+		err = s.updateAccount(username, func(account *Account) bool {
+			account.TOTPSecret = nil
+			// An enrollment started before cannot be confirmed afterwards
+			account.PendingTOTPSecret = nil
+			account.RecoveryCodes = nil
+			account.LastTOTPStep = 0
+			return true
+		})
+		if err != nil {
+			s.logger.Printf("Failed to save account %s: %v", username, err)
+			return
+		}
+
+		response.Status = variables.TwoFactorSuccess
+		s.logger.Printf("Two factor authentication disabled for %s", username)
+	}
+}
+
+// generateRecoveryCodes returns new recovery codes and their hashes
+func generateRecoveryCodes() ([]string, [][32]byte, error) {
+	const alphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+	codes := make([]string, recoveryCodeCount)
+	hashes := make([][32]byte, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 10)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, nil, err
+		}
+		for j := range raw {
+			raw[j] = alphabet[int(raw[j])%len(alphabet)]
+		}
+
+		codes[i] = string(raw[:5]) + "-" + string(raw[5:])
+		hashes[i] = sha256.Sum256([]byte(normalizeRecoveryCode(codes[i])))
+	}
+	return codes, hashes, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Longest password that fits in an AUTH_REQUEST
+const MaxPasswordLength = 32
+
+// Compared against when a user does not exist, so that a missing user takes
+// as long to reject as a wrong password
+var dummyHash, _ = bcrypt.GenerateFromPassword([]byte("srcp"), bcrypt.DefaultCost)
+
+// Authenticator checks the password of an AUTH_REQUEST
+type Authenticator interface {
+	Authenticate(username string, password string) bool
+}
+
+// AllowAll accepts any password. It is the default so that the server works
+// without any setup.
+type AllowAll struct{}
+
+func (AllowAll) Authenticate(username string, password string) bool {
+	return username != ""
+}
+
+// FileAuthenticator checks passwords against bcrypt hashes stored in a JSON
+// file mapping usernames to hashes
+type FileAuthenticator struct {
+	Path  string
+	mutex sync.Mutex
+	users map[string]string
+}
+
+func NewFileAuthenticator(path string) (*FileAuthenticator, error) {
+	a := &FileAuthenticator{
+		Path:  path,
+		users: make(map[string]string),
+	}
+
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return a, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &a.users); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *FileAuthenticator) Authenticate(username string, password string) bool {
+	a.mutex.Lock()
+	hash, ok := a.users[username]
+	a.mutex.Unlock()
+
+	if !ok {
+		bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// SetPassword stores a new password for the user and saves the file
+func (a *FileAuthenticator) SetPassword(username string, password string) error {
+	if username == "" || len(username) > 32 {
+		return errors.New("username must be 1 to 32 bytes")
+	}
+	// A longer password could never be sent at login
+	if len(password) > MaxPasswordLength {
+		return fmt.Errorf("password must be at most %d bytes", MaxPasswordLength)
+	}
+
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.users[username] = string(hash)
+	data, err := json.MarshalIndent(a.users, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := a.Path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, a.Path)
+}
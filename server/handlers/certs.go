@@ -0,0 +1,140 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Certificates expiring sooner than this are logged as a warning
+const certExpiryWarning = 30 * 24 * time.Hour
+
+// certReloader serves the server certificate to new TLS handshakes and
+// replaces it when the files change. Established connections keep the
+// certificate they were made with.
+type certReloader struct {
+	certFile string
+	keyFile  string
+	logger   *log.Logger
+
+	mutex    sync.RWMutex
+	cert     *tls.Certificate
+	expiry   time.Time
+	certTime time.Time
+	keyTime  time.Time
+}
+
+func newCertReloader(certFile string, keyFile string, logger *log.Logger) (*certReloader, error) {
+	r := &certReloader{
+		certFile: certFile,
+		keyFile:  keyFile,
+		logger:   logger,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.cert, nil
+}
+
+func (r *certReloader) Expiry() time.Time {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return r.expiry
+}
+
+// reload loads the certificate and key from disk. On failure the current
+// certificate stays in use.
+func (r *certReloader) reload() error {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return err
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return err
+	}
+	cert.Leaf = leaf
+
+	r.mutex.Lock()
+	r.cert = &cert
+	r.expiry = leaf.NotAfter
+	r.certTime = certInfo.ModTime()
+	r.keyTime = keyInfo.ModTime()
+	r.mutex.Unlock()
+
+	remaining := time.Until(leaf.NotAfter)
+	if remaining < certExpiryWarning {
+		r.logger.Printf("WARNING: server certificate %s expires %s (in %v)", r.certFile, leaf.NotAfter.Format(time.RFC3339), remaining.Round(time.Hour))
+	} else {
+		r.logger.Printf("Loaded server certificate %s, expires %s", r.certFile, leaf.NotAfter.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// changed reports whether the certificate or key file was modified since the
+// last reload
+func (r *certReloader) changed() bool {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return false
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return false
+	}
+
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+
+	return !certInfo.ModTime().Equal(r.certTime) || !keyInfo.ModTime().Equal(r.keyTime)
+}
+
+// Reload loads the certificate again whether or not its files changed. On
+// failure the current certificate stays in use.
+func (r *certReloader) Reload() error {
+	if err := r.reload(); err != nil {
+		r.logger.Printf("Failed to reload server certificate, keeping the current one: %v", err)
+		return err
+	}
+	return nil
+}
+
+// watch reloads the certificate when its files change, until quit is closed
+func (r *certReloader) watch(interval time.Duration, quit <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+
+		if r.changed() {
+			r.logger.Println("Server certificate changed on disk, reloading")
+			r.Reload()
+		}
+	}
+}
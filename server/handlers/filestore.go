@@ -0,0 +1,518 @@
+package server
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	// Snapshot of the whole state, rewritten when the journal is compacted
+	snapshotFile = "store.json"
+	// Changes since the snapshot, one JSON record per line
+	journalFile = "store.journal"
+
+	// Journal records after which the journal is folded into the snapshot
+	maxJournalRecords = 10000
+)
+
+// storeMigration upgrades a snapshot written by an older server to version
+type storeMigration struct {
+	version     int
+	description string
+	migrate     func(snapshot *storeSnapshot) error
+}
+
+// storeMigrations are applied in order to snapshots with a lower version.
+// New ones go at the end, existing ones must never change.
+var storeMigrations = []storeMigration{
+	{1, "initial layout", func(snapshot *storeSnapshot) error { return nil }},
+	{2, "number mailbox messages", numberMailboxes},
+}
+
+// numberMailboxes gives the messages kept by version 1, which emptied a
+// mailbox at once, the Seq that lets them be removed as they are delivered
+func numberMailboxes(snapshot *storeSnapshot) error {
+	usernames := make([]string, 0, len(snapshot.Mailboxes))
+	for username := range snapshot.Mailboxes {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	var seq uint64
+	for _, username := range usernames {
+		messages := snapshot.Mailboxes[username]
+		for i := range messages {
+			seq++
+			messages[i].Seq = seq
+		}
+	}
+	return nil
+}
+
+// storeSnapshot is the on-disk form of the state
+type storeSnapshot struct {
+	Version   int                         `json:"version"`
+	Accounts  map[string]*Account         `json:"accounts"`
+	Keys      map[string][]byte           `json:"keys"`
+	Rooms     map[string][]string         `json:"rooms"`
+	Mailboxes map[string][]MailboxMessage `json:"mailboxes"`
+	// Revoked token IDs in hex with the time they expire
+	Revoked map[string]time.Time `json:"revoked"`
+}
+
+// journalRecord is a single change. Op says which fields are set.
+type journalRecord struct {
+	Op       string          `json:"op"`
+	Account  *Account        `json:"account,omitempty"`
+	Username string          `json:"username,omitempty"`
+	Room     string          `json:"room,omitempty"`
+	Key      []byte          `json:"key,omitempty"`
+	Message  *MailboxMessage `json:"message,omitempty"`
+	Seq      uint64          `json:"seq,omitempty"`
+	Token    string          `json:"token,omitempty"`
+	Expires  time.Time       `json:"expires,omitempty"`
+}
+
+// FileStore is a Store that keeps its state in memory and on disk in a
+// directory: a snapshot and a journal of the changes made since, which is
+// synced after every change. The journal is folded into the snapshot when
+// the store is opened, when it grows long and when the store is closed.
+type FileStore struct {
+	dir string
+
+	mutex   sync.Mutex
+	mem     *MemoryStore
+	journal *os.File
+	records int
+}
+
+// OpenFileStore opens the store in dir, creating it on first use and
+// migrating a store written by an older version
+func OpenFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	fs := &FileStore{
+		dir: dir,
+		mem: NewMemoryStore(),
+	}
+
+	snapshot := storeSnapshot{}
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, &snapshot); err != nil {
+			return nil, fmt.Errorf("could not parse %s: %v", snapshotFile, err)
+		}
+	}
+
+	version := snapshot.Version
+	current := storeMigrations[len(storeMigrations)-1].version
+	if version > current {
+		return nil, fmt.Errorf("store in %s has version %d, this server only knows up to %d", dir, version, current)
+	}
+
+	if err := fs.mem.restore(snapshot); err != nil {
+		return nil, err
+	}
+	if err := fs.replay(version); err != nil {
+		return nil, err
+	}
+
+	// The journal belongs to the version of the snapshot, so migrations run
+	// after it has been replayed
+	snapshot = fs.mem.snapshot()
+	snapshot.Version = version
+	for _, migration := range storeMigrations {
+		if migration.version <= snapshot.Version {
+			continue
+		}
+		if err := migration.migrate(&snapshot); err != nil {
+			return nil, fmt.Errorf("store migration %d (%s) failed: %v", migration.version, migration.description, err)
+		}
+		snapshot.Version = migration.version
+	}
+	fs.mem = NewMemoryStore()
+	if err := fs.mem.restore(snapshot); err != nil {
+		return nil, err
+	}
+
+	if err := fs.compact(); err != nil {
+		return nil, err
+	}
+	return fs, nil
+}
+
+// replay applies the journal left by the last run, written for a snapshot
+// of version
+func (fs *FileStore) replay(version int) error {
+	file, err := os.Open(filepath.Join(fs.dir, journalFile))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var lines [][]byte
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		lines = append(lines, append([]byte(nil), scanner.Bytes()...))
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	for i, line := range lines {
+		var record journalRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			// A crash in the middle of a write leaves a partial last line,
+			// that change was never acknowledged
+			if i == len(lines)-1 {
+				return nil
+			}
+			return fmt.Errorf("corrupt %s at line %d: %v", journalFile, i+1, err)
+		}
+		// Version 1 emptied a mailbox at once, migration 2 numbers what is
+		// left
+		if record.Op == "mailbox_take" && version < 2 {
+			record = journalRecord{Op: "mailbox_remove", Username: record.Username, Seq: math.MaxUint64}
+		}
+		if err := fs.apply(record); err != nil {
+			return fmt.Errorf("%s line %d: %v", journalFile, i+1, err)
+		}
+	}
+	return nil
+}
+
+// apply makes the change described by a journal record in memory
+func (fs *FileStore) apply(record journalRecord) error {
+	switch record.Op {
+	case "account":
+		if record.Account == nil {
+			return fmt.Errorf("account record without account")
+		}
+		return fs.mem.SaveAccount(record.Account)
+	case "key":
+		var key [512]byte
+		copy(key[:], record.Key)
+		return fs.mem.SaveKey(record.Username, key)
+	case "join":
+		return fs.mem.AddRoomMember(record.Room, record.Username)
+	case "leave":
+		return fs.mem.RemoveRoomMember(record.Room, record.Username)
+	case "mailbox_push":
+		if record.Message == nil {
+			return fmt.Errorf("mailbox record without message")
+		}
+		return fs.mem.PushMailbox(record.Username, *record.Message)
+	case "mailbox_remove":
+		return fs.mem.RemoveMailbox(record.Username, record.Seq)
+	case "revoke":
+		id, err := parseTokenID(record.Token)
+		if err != nil {
+			return err
+		}
+		return fs.mem.RevokeToken(id, record.Expires)
+	default:
+		return fmt.Errorf("unknown operation %q", record.Op)
+	}
+}
+
+// write appends a record to the journal and syncs it before the change is
+// made in memory
+func (fs *FileStore) write(record journalRecord) error {
+	if fs.journal == nil {
+		return fmt.Errorf("store is closed")
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.journal.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := fs.journal.Sync(); err != nil {
+		return err
+	}
+	if err := fs.apply(record); err != nil {
+		return err
+	}
+
+	fs.records++
+	if fs.records >= maxJournalRecords {
+		return fs.compact()
+	}
+	return nil
+}
+
+// compact writes the state to a new snapshot and starts an empty journal
+func (fs *FileStore) compact() error {
+	snapshot := fs.mem.snapshot()
+	snapshot.Version = storeMigrations[len(storeMigrations)-1].version
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated
+	// snapshot
+	path := filepath.Join(fs.dir, snapshotFile)
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return err
+	}
+
+	if fs.journal != nil {
+		fs.journal.Close()
+	}
+	journal, err := os.OpenFile(filepath.Join(fs.dir, journalFile), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		fs.journal = nil
+		return err
+	}
+	fs.journal = journal
+	fs.records = 0
+	return nil
+}
+
+func (fs *FileStore) Account(username string) (*Account, error) {
+	return fs.mem.Account(username)
+}
+
+func (fs *FileStore) SaveAccount(account *Account) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	return fs.write(journalRecord{Op: "account", Account: account})
+}
+
+func (fs *FileStore) SaveKey(username string, key [512]byte) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	return fs.write(journalRecord{Op: "key", Username: username, Key: trimKey(key)})
+}
+
+func (fs *FileStore) Key(username string) ([512]byte, bool, error) {
+	return fs.mem.Key(username)
+}
+
+func (fs *FileStore) Rooms() ([]string, error) {
+	return fs.mem.Rooms()
+}
+
+func (fs *FileStore) RoomMembers(room string) ([]string, error) {
+	return fs.mem.RoomMembers(room)
+}
+
+func (fs *FileStore) UserRooms(username string) ([]string, error) {
+	return fs.mem.UserRooms(username)
+}
+
+func (fs *FileStore) AddRoomMember(room string, username string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	return fs.write(journalRecord{Op: "join", Room: room, Username: username})
+}
+
+func (fs *FileStore) RemoveRoomMember(room string, username string) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	return fs.write(journalRecord{Op: "leave", Room: room, Username: username})
+}
+
+func (fs *FileStore) PushMailbox(recipient string, message MailboxMessage) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.mem.mailboxLen(recipient) >= MaxMailboxMessages {
+		return ErrMailboxFull
+	}
+	// The journal keeps Seq so that removals apply to the same messages
+	message.Seq = fs.mem.nextMailboxSeq()
+	return fs.write(journalRecord{Op: "mailbox_push", Username: recipient, Message: &message})
+}
+
+func (fs *FileStore) Mailbox(recipient string) ([]MailboxMessage, error) {
+	return fs.mem.Mailbox(recipient)
+}
+
+func (fs *FileStore) RemoveMailbox(recipient string, seq uint64) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	messages, err := fs.mem.Mailbox(recipient)
+	if err != nil || len(messages) == 0 || messages[0].Seq > seq {
+		return err
+	}
+	return fs.write(journalRecord{Op: "mailbox_remove", Username: recipient, Seq: seq})
+}
+
+// PurgeMailboxes drops the expired messages and compacts the journal so
+// that their ciphertext does not stay in it
+func (fs *FileStore) PurgeMailboxes(now time.Time) (int, error) {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.journal == nil {
+		return 0, fmt.Errorf("store is closed")
+	}
+	purged, err := fs.mem.PurgeMailboxes(now)
+	if err != nil || purged == 0 {
+		return purged, err
+	}
+	return purged, fs.compact()
+}
+
+func (fs *FileStore) RevokeToken(id [16]byte, expires time.Time) error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	return fs.write(journalRecord{Op: "revoke", Token: hex.EncodeToString(id[:]), Expires: expires})
+}
+
+func (fs *FileStore) TokenRevoked(id [16]byte) (bool, error) {
+	return fs.mem.TokenRevoked(id)
+}
+
+// Close folds the journal into the snapshot
+func (fs *FileStore) Close() error {
+	fs.mutex.Lock()
+	defer fs.mutex.Unlock()
+
+	if fs.journal == nil {
+		return nil
+	}
+	err := fs.compact()
+	if fs.journal != nil {
+		fs.journal.Close()
+		fs.journal = nil
+	}
+	return err
+}
+
+func (m *MemoryStore) mailboxLen(recipient string) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return len(m.mailboxes[recipient])
+}
+
+func (m *MemoryStore) nextMailboxSeq() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.mailboxSeq + 1
+}
+
+// snapshot returns a copy of the state, without the version
+func (m *MemoryStore) snapshot() storeSnapshot {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	snapshot := storeSnapshot{
+		Accounts:  make(map[string]*Account, len(m.accounts)),
+		Keys:      make(map[string][]byte, len(m.keys)),
+		Rooms:     make(map[string][]string, len(m.rooms)),
+		Mailboxes: make(map[string][]MailboxMessage, len(m.mailboxes)),
+		Revoked:   make(map[string]time.Time, len(m.revoked)),
+	}
+	for username, account := range m.accounts {
+		snapshot.Accounts[username] = account.clone()
+	}
+	for username, key := range m.keys {
+		snapshot.Keys[username] = trimKey(key)
+	}
+	for room, members := range m.rooms {
+		for username := range members {
+			snapshot.Rooms[room] = append(snapshot.Rooms[room], username)
+		}
+	}
+	for username, messages := range m.mailboxes {
+		snapshot.Mailboxes[username] = append([]MailboxMessage(nil), messages...)
+	}
+	now := time.Now()
+	for id, expires := range m.revoked {
+		if now.Before(expires) {
+			snapshot.Revoked[hex.EncodeToString(id[:])] = expires
+		}
+	}
+	return snapshot
+}
+
+// restore replaces the state with the one in a snapshot
+func (m *MemoryStore) restore(snapshot storeSnapshot) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for username, account := range snapshot.Accounts {
+		m.accounts[username] = account.clone()
+	}
+	for username, key := range snapshot.Keys {
+		var stored [512]byte
+		copy(stored[:], key)
+		m.keys[username] = stored
+	}
+	for room, members := range snapshot.Rooms {
+		m.rooms[room] = make(map[string]struct{}, len(members))
+		for _, username := range members {
+			m.rooms[room][username] = struct{}{}
+		}
+	}
+	for username, messages := range snapshot.Mailboxes {
+		m.mailboxes[username] = append([]MailboxMessage(nil), messages...)
+		for _, message := range messages {
+			if message.Seq > m.mailboxSeq {
+				m.mailboxSeq = message.Seq
+			}
+		}
+	}
+	for token, expires := range snapshot.Revoked {
+		id, err := parseTokenID(token)
+		if err != nil {
+			return err
+		}
+		m.revoked[id] = expires
+	}
+	return nil
+}
+
+// trimKey drops the zero padding of a public key
+func trimKey(key [512]byte) []byte {
+	end := len(key)
+	for end > 0 && key[end-1] == 0 {
+		end--
+	}
+	return append([]byte(nil), key[:end]...)
+}
+
+func parseTokenID(token string) ([16]byte, error) {
+	var id [16]byte
+	decoded, err := hex.DecodeString(token)
+	if err != nil || len(decoded) != len(id) {
+		return id, fmt.Errorf("invalid token ID %q", token)
+	}
+	copy(id[:], decoded)
+	return id, nil
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeStore puts a snapshot and journal in a new directory
+func writeStore(t *testing.T, snapshot string, journal string) string {
+	t.Helper()
+
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, snapshotFile), []byte(snapshot), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, journalFile), []byte(journal), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+func TestFileStoreMigrateMailboxes(t *testing.T) {
+	// Version 1 had no Seq and emptied a mailbox with mailbox_take
+	dir := writeStore(t, `{
+  "version": 1,
+  "mailboxes": {
+    "bob": [{"data": "AQ==", "queued": "2026-01-01T00:00:00Z"}],
+    "carol": [{"data": "Ag==", "queued": "2026-01-01T00:00:00Z"}]
+  }
+}`, `{"op":"mailbox_take","username":"carol"}
+{"op":"mailbox_push","username":"bob","message":{"data":"Aw==","queued":"2026-01-01T00:00:01Z"}}
+{"op":"mailbox_push","username":"carol","message":{"data":"BA==","queued":"2026-01-01T00:00:02Z"}}
+`)
+
+	fs, err := OpenFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fs.Close()
+
+	bob, _ := fs.Mailbox("bob")
+	carol, _ := fs.Mailbox("carol")
+	if len(bob) != 2 || len(carol) != 1 || carol[0].Data[0] != 4 {
+		t.Fatalf("mailboxes after migration: bob %v, carol %v", bob, carol)
+	}
+	if bob[0].Seq == 0 || bob[1].Seq <= bob[0].Seq || carol[0].Seq == 0 {
+		t.Fatalf("messages not numbered in order: bob %v, carol %v", bob, carol)
+	}
+
+	// Delivering bob's first message leaves the second
+	if err := fs.RemoveMailbox("bob", bob[0].Seq); err != nil {
+		t.Fatal(err)
+	}
+	if err := fs.PushMailbox("bob", MailboxMessage{Data: []byte{5}}); err != nil {
+		t.Fatal(err)
+	}
+	bob, _ = fs.Mailbox("bob")
+	if len(bob) != 2 || bob[0].Data[0] != 3 || bob[1].Seq <= bob[0].Seq {
+		t.Fatalf("bob's mailbox after delivery: %v", bob)
+	}
+}
+
+func TestFileStoreRejectsOldOperations(t *testing.T) {
+	dir := writeStore(t, `{"version": 2}`, `{"op":"mailbox_take","username":"bob"}
+`)
+	if fs, err := OpenFileStore(dir); err == nil {
+		fs.Close()
+		t.Fatal("mailbox_take accepted in a version 2 journal")
+	}
+}
+
+func TestFileStoreReplay(t *testing.T) {
+	const (
+		first  = `{"op":"mailbox_push","username":"bob","message":{"data":"AQ==","seq":1,"queued":"2026-01-01T00:00:00Z"}}`
+		second = `{"op":"mailbox_push","username":"bob","message":{"data":"Ag==","seq":2,"queued":"2026-01-01T00:00:01Z"}}`
+	)
+
+	tests := []struct {
+		name    string
+		journal string
+		// Messages in bob's mailbox afterwards, -1 when the store must not
+		// open
+		kept int
+	}{
+		{"empty", "", 0},
+		{"complete", first + "\n" + second + "\n", 2},
+		{"truncated last line", first + "\n" + second[:40], 1},
+		{"truncated only line", first[:40], 0},
+		{"corrupt line before the last", first[:40] + "\n" + second + "\n", -1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dir := writeStore(t, `{"version": 2}`, test.journal)
+
+			fs, err := OpenFileStore(dir)
+			if test.kept < 0 {
+				if err == nil {
+					fs.Close()
+					t.Fatal("store opened with a corrupt journal")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer fs.Close()
+
+			bob, _ := fs.Mailbox("bob")
+			if len(bob) != test.kept {
+				t.Fatalf("%d messages kept, expected %d", len(bob), test.kept)
+			}
+
+			// The partial line is gone once the store is compacted, new
+			// changes do not end up behind it
+			if err := fs.PushMailbox("bob", MailboxMessage{Data: []byte{3}}); err != nil {
+				t.Fatal(err)
+			}
+			fs.Close()
+			if fs, err = OpenFileStore(dir); err != nil {
+				t.Fatalf("reopening after a change: %v", err)
+			}
+			defer fs.Close()
+			if bob, _ = fs.Mailbox("bob"); len(bob) != test.kept+1 {
+				t.Fatalf("%d messages after reopening, expected %d", len(bob), test.kept+1)
+			}
+		})
+	}
+}
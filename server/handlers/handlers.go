@@ -2,94 +2,198 @@ package server
 
 import (
 	"bytes"
+	"crypto/tls"
 	"encoding/binary"
 	"fmt"
-	"log"
-	"net"
 	"scrp/models"
 	"scrp/variables"
+	"time"
 )
 
-func (s *Server) HandleAuthRequest(conn net.Conn, payload models.AuthRequestPayload) {
-	// Assume that the username and password are correct
+func (s *Server) HandleAuthRequest(client *Client, payload models.AuthRequestPayload) {
 	// Retrieve the client's username from the payload
 	username := string(bytes.Trim(payload.Username[:], "\x00"))
 
-	log.Println("User Authenticated: ", username)
-
-	// Perform authentication logic here (e.g., checking against stored credentials)
-	authenticated := true // Replace with your authentication logic
+	// A client that is logged in or asked for a code must not log in again
+	// as someone else on the same connection
+	s.mutex.Lock()
+	state := client.State
+	s.mutex.Unlock()
+	if state != INIT {
+		s.logger.Printf("Unexpected AUTH_REQUEST from %s", clientName(client))
+		s.sendAuthFailure(client)
+		return
+	}
 
-	// Send the authentication response
-	var response models.AuthResponsePayload
-	if authenticated {
-		response = models.AuthResponsePayload{
-			Status: variables.AuthSuccess,
+	// A verified client certificate replaces the password and second factor
+	if certUsername := certificateUsername(client); certUsername != "" {
+		if username != "" && username != certUsername {
+			s.logger.Printf("Rejected login as %s with certificate for %s", username, certUsername)
+			s.sendAuthFailure(client)
+			return
 		}
 
-		// Store the client's connection information after successful authentication
-		client := &Client{
-			Username: payload.Username,
-			Conn:     conn,
-			State:    AUTHENTICATED,
-		}
-		s.AddClient(client)
-
-		// Send the authentication response with header
-		header := models.Header{
-			Version:  variables.Version,
-			Type:     variables.AuthResponse,
-			Length:   uint16(binary.Size(response)),
-			Sequence: 0, // Sequence number, update this as needed
-		}
+		s.logger.Println("User Authenticated with certificate: ", certUsername)
+		s.completeLogin(client, stringToByteArray32(certUsername), [64]byte{})
+		return
+	}
 
-		// Write header
-		err := binary.Write(conn, binary.BigEndian, &header)
-		if err != nil {
-			log.Printf("Failed to send header to client: %v", err)
-			return
-		}
+	password := string(bytes.Trim(payload.Password[:], "\x00"))
+	if !s.Auth.Authenticate(username, password) {
+		s.logger.Printf("Wrong password for %s", username)
+		s.sendAuthFailure(client)
+		return
+	}
 
-		// Write payload
-		err = binary.Write(conn, binary.BigEndian, &response)
-		if err != nil {
-			log.Printf("Failed to send AUTH_RESPONSE to client: %v", err)
-			return
-		}
-	} else {
-		response = models.AuthResponsePayload{
-			Status: variables.AuthFailure,
-		}
+	// With two factor authentication enabled the password alone is not
+	// enough, ask for a code
+	account, err := s.account(username)
+	if err != nil {
+		s.logger.Printf("Failed to load account %s: %v", username, err)
+		s.sendAuthFailure(client)
+		return
+	}
+	if account.TwoFactorEnabled() {
+		client.pendingUsername = payload.Username
+		client.authAttempts = 0
+		s.mutex.Lock()
+		client.State = AUTH_REQ_RECVD
+		s.mutex.Unlock()
+		s.sendAuthStatus(client, variables.AuthChallenge)
+		return
+	}
 
-		// Send the authentication response with header
-		header := models.Header{
-			Version:  variables.Version,
-			Type:     variables.AuthResponse,
-			Length:   uint16(binary.Size(response)),
-			Sequence: 0, // Sequence number, update this as needed
-		}
+	s.logger.Println("User Authenticated: ", username)
+	s.completeLogin(client, payload.Username, [64]byte{})
+}
 
-		// Write header
-		err := binary.Write(conn, binary.BigEndian, &header)
-		if err != nil {
-			log.Printf("Failed to send header to client: %v", err)
-			return
+// HandleTokenAuth authenticates a client with a session token issued at an
+// earlier password login
+func (s *Server) HandleTokenAuth(client *Client, payload models.TokenAuthPayload) {
+	username := string(bytes.Trim(payload.Username[:], "\x00"))
+
+	if err := s.verifyToken(username, payload.Token); err != nil {
+		s.logger.Printf("Rejected session token for %s: %v", username, err)
+		s.sendAuthFailure(client)
+		return
+	}
+
+	s.logger.Println("User Authenticated with token: ", username)
+	s.completeLogin(client, payload.Username, payload.Token)
+}
+
+// HandleLogout revokes a session token and ends the connection
+func (s *Server) HandleLogout(client *Client, payload models.LogoutPayload) {
+	username := string(bytes.Trim(payload.Username[:], "\x00"))
+
+	// Only a correctly signed token can be revoked, anything else is ignored
+	if err := s.verifyToken(username, payload.Token); err == nil {
+		if err := s.revokeToken(payload.Token); err != nil {
+			s.logger.Printf("Failed to revoke session token of %s: %v", username, err)
+		} else {
+			s.logger.Printf("User %s logged out", username)
 		}
+	}
+
+	s.RemoveClient(client)
+	client.Conn.Close()
+}
 
-		// Write payload
-		err = binary.Write(conn, binary.BigEndian, &response)
+// completeLogin registers an authenticated client and sends it a successful
+// AUTH_RESPONSE carrying its session token. A zero token means a new one is
+// issued.
+func (s *Server) completeLogin(client *Client, username [32]byte, token [64]byte) {
+	if token == [64]byte{} {
+		var err error
+		token, err = s.issueToken(string(bytes.Trim(username[:], "\x00")))
 		if err != nil {
-			log.Printf("Failed to send AUTH_RESPONSE to client: %v", err)
+			s.logger.Printf("Failed to issue session token: %v", err)
+			s.sendAuthFailure(client)
 			return
 		}
 	}
+
+	// Store the client's connection information after successful authentication
+	client.mutex.Lock()
+	client.Username = username
+	client.mutex.Unlock()
+	client.Token = token
+	s.mutex.Lock()
+	client.State = AUTHENTICATED
+	s.mutex.Unlock()
+	s.AddClient(client)
+
+	if s.hooks.OnLogin != nil {
+		s.hooks.OnLogin(string(bytes.Trim(username[:], "\x00")))
+	}
+
+	// Send the authentication response with header
+	response := models.AuthResponsePayload{
+		Status: variables.AuthSuccess,
+		Token:  token,
+	}
+	if err := s.Send(client, variables.AuthResponse, &response); err != nil {
+		s.logger.Printf("Failed to send AUTH_RESPONSE to client: %v", err)
+		return
+	}
+
+	s.sendUserRooms(client)
+}
+
+// certificateUsername returns the common name of the client's verified TLS
+// certificate, or an empty string if it did not present one
+func certificateUsername(client *Client) string {
+	tlsConn, ok := client.Conn.(*tls.Conn)
+	if !ok {
+		return ""
+	}
+
+	state := tlsConn.ConnectionState()
+	if len(state.VerifiedChains) == 0 || len(state.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return state.VerifiedChains[0][0].Subject.CommonName
+}
+
+func stringToByteArray32(s string) [32]byte {
+	var byteArray [32]byte
+	copy(byteArray[:], s)
+	return byteArray
+}
+
+func (s *Server) sendAuthFailure(client *Client) {
+	s.sendAuthStatus(client, variables.AuthFailure)
+}
+
+func (s *Server) sendAuthStatus(client *Client, status uint8) {
+	response := models.AuthResponsePayload{
+		Status: status,
+	}
+	if err := s.Send(client, variables.AuthResponse, &response); err != nil {
+		s.logger.Printf("Failed to send AUTH_RESPONSE to client: %v", err)
+	}
 }
 
 func (s *Server) AddClient(client *Client) {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
 
-	s.Clients[string(bytes.Trim(client.Username[:], "\x00"))] = client
+	username := string(bytes.Trim(client.Username[:], "\x00"))
+
+	// A reconnecting client may log in again before its old connection has
+	// timed out, the new connection takes over. The old one is told so, a
+	// client still running there does not reconnect and take it back.
+	if previous, ok := s.Clients[username]; ok && previous != client {
+		previous.State = TERMINATED
+		frame, err := encodeFrame(variables.Disconnect, models.DisconnectPayload{
+			Reason: variables.SessionReplaced,
+		})
+		if err != nil {
+			frame = nil
+		}
+		previous.queue.close(frame)
+	}
+	s.Clients[username] = client
 }
 
 func (s *Server) StoreCertificate(client *Client, cert [512]byte) {
@@ -99,13 +203,29 @@ func (s *Server) StoreCertificate(client *Client, cert [512]byte) {
 	s.Clients[string(bytes.Trim(client.Username[:], "\x00"))].Key = cert
 }
 
-func (s *Server) HandleKeyExchange(conn net.Conn, payload models.PublicKeyPayload) error {
+// otherClients returns every registered client except the given one
+func (s *Server) otherClients(client *Client) []*Client {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	others := make([]*Client, 0, len(s.Clients))
+	for _, otherClient := range s.Clients {
+		if otherClient.Username != client.Username {
+			others = append(others, otherClient)
+		}
+	}
+	return others
+}
+
+func (s *Server) HandleKeyExchange(client *Client, payload models.PublicKeyPayload) error {
 	username := string(bytes.Trim(payload.Username[:], "\x00"))
 	// Store the client's public key
 
-	client, ok := s.Clients[username]
+	s.mutex.Lock()
+	registered, ok := s.Clients[username]
+	s.mutex.Unlock()
 
-	if !ok {
+	if !ok || registered != client {
 		return fmt.Errorf("unknown client: %s", username)
 	}
 
@@ -114,179 +234,374 @@ func (s *Server) HandleKeyExchange(conn net.Conn, payload models.PublicKeyPayloa
 	}
 
 	s.StoreCertificate(client, payload.Key)
+	if err := s.store.SaveKey(username, payload.Key); err != nil {
+		s.logger.Printf("Failed to save key of %s: %v", username, err)
+	}
 
 	s.mutex.Lock()
 	client.State = PUBLIC_KEY_RECVD
 	s.mutex.Unlock()
 
-	// Send the public keys of other clients to the newly connected client
-	header := models.Header{
-		Version:  variables.Version,
-		Type:     variables.KeyExchange,
-		Sequence: 0, // Sequence number, update this as needed
-	}
+	others := s.otherClients(client)
 
 	// Send public keys of existing clients to the new client
-	for _, otherClient := range s.Clients {
-		if otherClient.Username != payload.Username {
-			publicKeyPayload := models.PublicKeyPayload{
-				Username: otherClient.Username,
-				Key:      otherClient.Key,
-			}
-
-			// Write header
-			err := binary.Write(conn, binary.BigEndian, &header)
-			if err != nil {
-				return fmt.Errorf("failed to send header to client: %v", err)
-			}
+	for _, otherClient := range others {
+		publicKeyPayload := models.PublicKeyPayload{
+			Username: otherClient.Username,
+			Key:      otherClient.Key,
+		}
 
-			// Write payload
-			err = binary.Write(conn, binary.BigEndian, &publicKeyPayload)
-			if err != nil {
-				return fmt.Errorf("failed to send PUBLIC_KEY to client: %v", err)
-			}
+		if err := s.Send(client, variables.KeyExchange, &publicKeyPayload); err != nil {
+			return fmt.Errorf("failed to send PUBLIC_KEY to client: %v", err)
 		}
 	}
 
 	// Send the new client's public key to existing clients
-	for _, otherClient := range s.Clients {
-		if otherClient.Username != payload.Username {
-			publicKeyPayload := models.PublicKeyPayload{
-				Username: client.Username,
-				Key:      client.Key,
-			}
-
-			// Write header
-			err := binary.Write(otherClient.Conn, binary.BigEndian, &header)
-			if err != nil {
-				return fmt.Errorf("failed to send header to client: %v", err)
-			}
+	for _, otherClient := range others {
+		publicKeyPayload := models.PublicKeyPayload{
+			Username: client.Username,
+			Key:      client.Key,
+		}
 
-			// Write payload
-			err = binary.Write(otherClient.Conn, binary.BigEndian, &publicKeyPayload)
-			if err != nil {
-				return fmt.Errorf("failed to send PUBLIC_KEY to client: %v", err)
-			}
+		if err := s.Send(otherClient, variables.KeyExchange, &publicKeyPayload); err != nil {
+			s.logger.Printf("Failed to send PUBLIC_KEY to %s: %v", clientName(otherClient), err)
 		}
 	}
+	// Reading the mailbox with the state change keeps HandleMessage from
+	// putting anything in it afterwards
 	s.mutex.Lock()
 	client.State = PUBLIC_KEY_SENT
+	messages, err := s.store.Mailbox(username)
 	s.mutex.Unlock()
+	if err != nil {
+		s.logger.Printf("Failed to load mailbox of %s: %v", username, err)
+	}
+
+	s.deliverMailbox(client, username, messages)
 	return nil
 }
 
-func (s *Server) HandleMessage(conn net.Conn, payload models.MessagePayload) error {
+func (s *Server) HandleMessage(client *Client, sequence uint32, payload models.MessagePayload) error {
 	// Extract sender, recipient, and message text from the payload
 	sender := string(bytes.Trim(payload.Sender[:], "\x00"))
 	recipient := string(bytes.Trim(payload.Recipient[:], "\x00"))
 	messageText := string(bytes.Trim(payload.Data[:], "\x00"))
 
-	// Look up the sender and recipient's connection
+	// Look up the sender's connection
 	s.mutex.Lock()
 	senderClient, ok := s.Clients[sender]
-
-	if !ok {
+	if !ok || senderClient != client || (senderClient.State != PUBLIC_KEY_SENT && senderClient.State != CHAT) {
+		s.mutex.Unlock()
 		return fmt.Errorf("unknown sender: %s", sender)
 	}
+	s.mutex.Unlock()
 
-	if senderClient.State != PUBLIC_KEY_SENT && senderClient.State != CHAT {
-		return fmt.Errorf("unknown sender: %s", sender)
+	// The recipient gets the server's time along with the sender's, the
+	// message is relayed even when the sender's clock is off
+	received := time.Now()
+	payload.Received = uint32(received.Unix())
+	if skew := clockSkew(payload.Timestamp, received); skew > s.MaxClockSkew {
+		s.logger.Printf("Clock of %s is off by %v", sender, skew.Round(time.Second))
 	}
 
-	recipientClient, ok := s.Clients[recipient]
+	// A copy of a room message needs both users in the room
+	if room := string(bytes.Trim(payload.Room[:], "\x00")); room != "" {
+		senderIn, err := s.inRoom(room, sender)
+		if err != nil {
+			return fmt.Errorf("failed to load room %s: %v", room, err)
+		}
+		recipientIn, err := s.inRoom(room, recipient)
+		if err != nil {
+			return fmt.Errorf("failed to load room %s: %v", room, err)
+		}
+		if !senderIn || !recipientIn {
+			return fmt.Errorf("%s or %s is not in room %s", sender, recipient, room)
+		}
+	}
 
-	if !ok {
-		return fmt.Errorf("unknown recipient: %s", recipient)
+	frame, err := encodeFrame(variables.Message, &payload)
+	if err != nil {
+		return err
+	}
+	recipientClient, position, err := s.relayMessage(recipient, frame, payload, nil)
+	if err != nil {
+		return err
+	}
+	online := recipientClient != nil
+
+	// The sender stops tracking the message once it is acknowledged, so
+	// that waits until the message is written to the recipient's
+	// connection. The wait goes on beside the read loop, a slow recipient
+	// must not hold up the sender.
+	if online {
+		s.mutex.Lock()
+		if client.State == PUBLIC_KEY_SENT {
+			client.State = CHAT
+		}
+		s.mutex.Unlock()
+
+		s.handlers.Add(1)
+		go func() {
+			defer s.handlers.Done()
+			s.confirmMessage(client, sequence, recipient, frame, payload, recipientClient, position)
+		}()
+	} else {
+		s.ackMessage(client, sequence)
 	}
 
-	if recipientClient.State != PUBLIC_KEY_SENT && recipientClient.State != CHAT {
-		return fmt.Errorf("unknown recipient: %s", recipient)
+	// Print the received message
+	status := ""
+	if !online {
+		status = " (kept in mailbox)"
+	}
+	if s.LogMessages {
+		s.logger.Printf("Message from %s to %s%s: %s\n", sender, recipient, status, messageText)
+	} else {
+		s.logger.Printf("Message from %s to %s%s\n", sender, recipient, status)
+	}
+
+	if s.hooks.OnMessage != nil {
+		s.hooks.OnMessage(sender, recipient)
+	}
+
+	return nil
+}
+
+// relayMessage queues a MESSAGE frame for the recipient's connection and
+// returns the connection and the position to wait for. A recipient that is
+// away, or whose connection is skip because it failed to take the message
+// before, is kept a copy in its mailbox instead and no connection is
+// returned.
+func (s *Server) relayMessage(recipient string, frame []byte, payload models.MessagePayload, skip *Client) (*Client, uint64, error) {
+	s.mutex.Lock()
+	recipientClient, online := s.Clients[recipient]
+	if online && (recipientClient == skip || (recipientClient.State != PUBLIC_KEY_SENT && recipientClient.State != CHAT)) {
+		online = false
 	}
 
-	senderClient.State = CHAT
+	// The mailbox is delivered when the recipient has logged in again. The
+	// mutex keeps the delivery from missing it.
+	if !online {
+		err := s.keepMessage(recipient, payload)
+		s.mutex.Unlock()
+		return nil, 0, err
+	}
 	recipientClient.State = CHAT
 	s.mutex.Unlock()
 
-	// Send the message to the recipient
-	header := models.Header{
-		Version:  variables.Version,
-		Type:     variables.Message,
-		Length:   uint16(binary.Size(payload)),
-		Sequence: 0, // Sequence number, update this as needed
+	position, err := s.sendFrame(recipientClient, frame)
+	if err != nil {
+		// Dropped or the connection is going away, it is not coming back
+		// for this message
+		return s.relayMessage(recipient, frame, payload, recipientClient)
 	}
+	return recipientClient, position, nil
+}
 
-	// Write header
-	err := binary.Write(recipientClient.Conn, binary.BigEndian, &header)
-	if err != nil {
-		return fmt.Errorf("failed to send header to recipient: %v", err)
+// confirmMessage acknowledges a relayed message to the sender once it is
+// written to the recipient's connection. When that connection goes away
+// first the message is relayed again, to the recipient's new connection or
+// its mailbox, so an acknowledged message is never lost.
+func (s *Server) confirmMessage(client *Client, sequence uint32, recipient string, frame []byte, payload models.MessagePayload, recipientClient *Client, position uint64) {
+	for recipientClient != nil {
+		if recipientClient.queue.waitSent(position) == nil {
+			break
+		}
+
+		var err error
+		recipientClient, position, err = s.relayMessage(recipient, frame, payload, recipientClient)
+		if err != nil {
+			s.logger.Printf("Failed to relay MESSAGE from %s to %s: %v", clientName(client), recipient, err)
+			return
+		}
+		if recipientClient == nil {
+			s.logger.Printf("Message from %s to %s kept in mailbox after the connection went away", clientName(client), recipient)
+		}
+	}
+	s.ackMessage(client, sequence)
+}
+
+// ackMessage acknowledges a message so the sender can stop tracking it
+func (s *Server) ackMessage(client *Client, sequence uint32) {
+	ack := models.MessageAckPayload{
+		Sequence: sequence,
+	}
+	if err := s.Send(client, variables.MessageAck, &ack); err != nil {
+		s.logger.Printf("Failed to send MESSAGE_ACK to %s: %v", clientName(client), err)
 	}
+}
 
-	// Write payload
-	err = binary.Write(recipientClient.Conn, binary.BigEndian, &payload)
+// keepMessage puts a message in the mailbox of a recipient that is away. Only
+// users that published a key before can have messages kept for them.
+func (s *Server) keepMessage(recipient string, payload models.MessagePayload) error {
+	_, known, err := s.store.Key(recipient)
 	if err != nil {
-		return fmt.Errorf("failed to send MESSAGE to recipient: %v", err)
+		return fmt.Errorf("failed to load key of %s: %v", recipient, err)
+	}
+	if !known {
+		return fmt.Errorf("unknown recipient: %s", recipient)
 	}
 
-	// Print the received message
-	log.Printf("Message from %s to %s: %s\n", sender, recipient, messageText)
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, &payload); err != nil {
+		return err
+	}
 
+	message := MailboxMessage{Data: buf.Bytes(), Queued: time.Now()}
+	if payload.Expires != 0 {
+		message.Expires = time.Unix(int64(payload.Expires), 0)
+	}
+	err = s.store.PushMailbox(recipient, message)
+	if err != nil {
+		return fmt.Errorf("failed to keep MESSAGE for %s: %v", recipient, err)
+	}
 	return nil
 }
 
-func (s *Server) HandleDisconnect(conn net.Conn, payload models.DisconnectPayload) error {
-	// Close the connection
-	conn.Close()
+// purgeMailboxes drops the disappearing messages kept in mailboxes once they
+// expire, until quit is closed
+func (s *Server) purgeMailboxes(interval time.Duration, quit <-chan struct{}) {
+	if interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
 
-	// Find and remove the client from the clients map
-	var disconnectedClient *Client
-	var disconnectedUsername string
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
 
-	s.mutex.Lock()
+		purged, err := s.store.PurgeMailboxes(time.Now())
+		if err != nil {
+			s.logger.Printf("Failed to purge expired mailbox messages: %v", err)
+		}
+		if purged > 0 {
+			s.logger.Printf("Purged %d expired mailbox messages", purged)
+		}
+	}
+}
 
-	for username, client := range s.Clients {
-		if client.Conn == conn {
-			disconnectedClient = client
-			disconnectedClient.State = DISCONNECTING
-			disconnectedUsername = username
-			delete(s.Clients, username)
-			disconnectedClient.State = TERMINATED
+// Mailbox messages written to the client before they are removed from the
+// store
+const mailboxBatch = 64
+
+// deliverMailbox sends the messages kept while the client's user was away.
+// It waits for room in the client's queue rather than treating it as a slow
+// consumer, and removes messages from the store only once they are written
+// to the connection, so whatever is not delivered stays for the next login.
+func (s *Server) deliverMailbox(client *Client, username string, messages []MailboxMessage) {
+	delivered := 0
+	for len(messages) > 0 {
+		batch := messages
+		if len(batch) > mailboxBatch {
+			batch = batch[:mailboxBatch]
+		}
+		messages = messages[len(batch):]
+
+		if err := s.deliverBatch(client, batch); err != nil {
+			s.logger.Printf("Failed to deliver mailbox to %s: %v", clientName(client), err)
+			break
+		}
+		err := s.store.RemoveMailbox(username, batch[len(batch)-1].Seq)
+		if err != nil {
+			s.logger.Printf("Failed to remove delivered messages from the mailbox of %s: %v", username, err)
 			break
 		}
+		delivered += len(batch)
 	}
 
-	s.mutex.Unlock()
+	if delivered > 0 {
+		s.logger.Printf("Delivered %d kept messages to %s", delivered, clientName(client))
+	}
+}
+
+// deliverBatch queues mailbox messages for the client and waits until they
+// are written
+func (s *Server) deliverBatch(client *Client, messages []MailboxMessage) error {
+	now := time.Now()
+	var sent uint64
+	for _, message := range messages {
+		// Not purged yet, but gone for the recipient
+		if message.expired(now) {
+			continue
+		}
+
+		var payload models.MessagePayload
+		if err := binary.Read(bytes.NewReader(message.Data), binary.BigEndian, &payload); err != nil {
+			s.logger.Printf("Dropped invalid mailbox message for %s: %v", clientName(client), err)
+			continue
+		}
 
-	header := models.Header{
-		Version:  variables.Version,
-		Type:     variables.KeyExchange,
-		Sequence: 0, // Sequence number, update this as needed
+		frame, err := encodeFrame(variables.Message, &payload)
+		if err != nil {
+			return err
+		}
+		if sent, err = client.queue.pushWait(frame); err != nil {
+			return err
+		}
 	}
+	return client.queue.waitSent(sent)
+}
 
-	// Inform other clients about disconnect.
-	for _, otherClient := range s.Clients {
-		if otherClient.Username != disconnectedClient.Username {
-			publicKeyPayload := models.PublicKeyPayload{
-				Username: disconnectedClient.Username,
-			}
+func (s *Server) HandleDisconnect(client *Client, payload models.DisconnectPayload) {
+	s.logger.Printf("Client %s requested disconnect (reason %d)", clientName(client), payload.Reason)
+
+	s.RemoveClient(client)
+
+	// Close the connection
+	client.Conn.Close()
+}
+
+// RemoveClient removes the client from the clients map and informs the other
+// clients that it went away. It is safe to call more than once.
+func (s *Server) RemoveClient(client *Client) {
+	username := string(bytes.Trim(client.Username[:], "\x00"))
 
-			// Write header
-			err := binary.Write(otherClient.Conn, binary.BigEndian, &header)
-			if err != nil {
-				return fmt.Errorf("failed to send header to client: %v", err)
+	s.mutex.Lock()
+	registered, ok := s.Clients[username]
+	if !ok || registered != client {
+		s.mutex.Unlock()
+		return
+	}
+	client.State = DISCONNECTING
+	delete(s.Clients, username)
+	client.State = TERMINATED
+	s.mutex.Unlock()
+
+	// Inform other clients about disconnect. During shutdown everybody is
+	// leaving anyway.
+	if !s.shuttingDown() {
+		for _, otherClient := range s.otherClients(client) {
+			publicKeyPayload := models.PublicKeyPayload{
+				Username: client.Username,
 			}
 
-			// Write payload
-			err = binary.Write(otherClient.Conn, binary.BigEndian, &publicKeyPayload)
-			if err != nil {
-				return fmt.Errorf("failed to send PUBLIC_KEY to client: %v", err)
+			if err := s.Send(otherClient, variables.KeyExchange, &publicKeyPayload); err != nil {
+				s.logger.Printf("Failed to send PUBLIC_KEY to %s: %v", clientName(otherClient), err)
 			}
 		}
 	}
 
 	// Print the disconnection message
-	if disconnectedClient != nil && disconnectedClient.State == TERMINATED {
-		fmt.Printf("Client %s disconnected\n", disconnectedUsername)
-		disconnectedClient.Conn.Close()
+	s.logger.Printf("Client %s disconnected", username)
+
+	if s.hooks.OnDisconnect != nil {
+		s.hooks.OnDisconnect(username)
 	}
-	return nil
+}
+
+// clockSkew returns how far a timestamp set by a client is from now. An
+// unset timestamp is not skewed.
+func clockSkew(timestamp uint32, now time.Time) time.Duration {
+	if timestamp == 0 {
+		return 0
+	}
+	skew := now.Sub(time.Unix(int64(timestamp), 0))
+	if skew < 0 {
+		skew = -skew
+	}
+	return skew
 }
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"log"
+	"scrp/models"
+	"scrp/variables"
+	"testing"
+)
+
+// newTestServer returns a server that logs nothing
+func newTestServer(t *testing.T) *Server {
+	t.Helper()
+
+	s, err := NewServer(WithLogger(log.New(io.Discard, "", 0)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// addTestClient registers a logged in client whose queue nobody writes out
+func addTestClient(s *Server, username string) *Client {
+	client := &Client{
+		Username: stringToByteArray32(username),
+		State:    CHAT,
+		queue:    newOutQueue(8, DisconnectClient, "", 0),
+		done:     make(chan struct{}),
+	}
+	s.Clients[username] = client
+	return client
+}
+
+// readAck returns the sequence of the MESSAGE_ACK queued for the client, if
+// there is one
+func readAck(t *testing.T, client *Client) (uint32, bool) {
+	t.Helper()
+
+	if client.queue.stats().Depth == 0 {
+		return 0, false
+	}
+	frame, _ := client.queue.next()
+	reader := bytes.NewReader(frame)
+
+	var header models.Header
+	var ack models.MessageAckPayload
+	if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	if header.Type != variables.MessageAck {
+		t.Fatalf("queued message type %d, expected MESSAGE_ACK", header.Type)
+	}
+	if err := binary.Read(reader, binary.BigEndian, &ack); err != nil {
+		t.Fatal(err)
+	}
+	return ack.Sequence, true
+}
+
+func TestMessageAckedOnceSafe(t *testing.T) {
+	tests := []struct {
+		name string
+		// What happens to bob's connection after the message is queued
+		written bool
+		// Messages in bob's mailbox afterwards
+		kept int
+	}{
+		{"written to the recipient", true, 0},
+		{"connection dies before writing", false, 1},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			alice := addTestClient(s, "alice")
+			bob := addTestClient(s, "bob")
+			if err := s.store.SaveKey("bob", [512]byte{1}); err != nil {
+				t.Fatal(err)
+			}
+
+			payload := models.MessagePayload{
+				Sender:    stringToByteArray32("alice"),
+				Recipient: stringToByteArray32("bob"),
+			}
+			if err := s.HandleMessage(alice, 7, payload); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := readAck(t, alice); ok {
+				t.Fatal("message acknowledged before it was written")
+			}
+
+			if test.written {
+				bob.queue.next()
+				bob.queue.markSent()
+			} else {
+				bob.queue.close(nil)
+			}
+			s.handlers.Wait()
+
+			sequence, ok := readAck(t, alice)
+			if !ok || sequence != 7 {
+				t.Fatalf("ack %d, %v, expected 7", sequence, ok)
+			}
+			messages, err := s.store.Mailbox("bob")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(messages) != test.kept {
+				t.Errorf("%d messages in the mailbox, expected %d", len(messages), test.kept)
+			}
+		})
+	}
+}
+
+func TestAuthRequestOnlyOnce(t *testing.T) {
+	s := newTestServer(t)
+	alice := addTestClient(s, "alice")
+
+	// AllowAll accepts any password, only the state keeps alice from
+	// becoming mallory
+	s.HandleAuthRequest(alice, models.AuthRequestPayload{
+		Username: stringToByteArray32("mallory"),
+		Password: stringToByteArray32("password"),
+	})
+
+	if name := clientName(alice); name != "alice" {
+		t.Fatalf("logged in client became %s", name)
+	}
+	if _, ok := s.Clients["mallory"]; ok {
+		t.Fatal("second AUTH_REQUEST registered another user")
+	}
+
+	frame, _ := alice.queue.next()
+	reader := bytes.NewReader(frame)
+	var header models.Header
+	var response models.AuthResponsePayload
+	if err := binary.Read(reader, binary.BigEndian, &header); err != nil {
+		t.Fatal(err)
+	}
+	if err := binary.Read(reader, binary.BigEndian, &response); err != nil {
+		t.Fatal(err)
+	}
+	if header.Type != variables.AuthResponse || response.Status != variables.AuthFailure {
+		t.Fatalf("got type %d status %d, expected a failed AUTH_RESPONSE", header.Type, response.Status)
+	}
+}
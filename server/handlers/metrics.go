@@ -0,0 +1,57 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Metrics is the snapshot served on the metrics endpoint
+type Metrics struct {
+	Queues []QueueStats `json:"queues"`
+
+	// Expiry of the server certificate currently served
+	CertExpiry        time.Time `json:"cert_expiry"`
+	CertExpirySeconds float64   `json:"cert_expiry_seconds"`
+}
+
+func (s *Server) Metrics() Metrics {
+	metrics := Metrics{
+		Queues: s.QueueStats(),
+	}
+
+	s.mutex.Lock()
+	certs := s.certs
+	s.mutex.Unlock()
+
+	if certs != nil {
+		metrics.CertExpiry = certs.Expiry()
+		metrics.CertExpirySeconds = time.Until(metrics.CertExpiry).Seconds()
+	}
+	return metrics
+}
+
+// ServeMetrics serves the server metrics as JSON on /metrics until the
+// server is shut down
+func (s *Server) ServeMetrics(addr string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s.Metrics())
+	})
+	srv := &http.Server{Addr: addr, Handler: mux}
+
+	s.mutex.Lock()
+	if s.closing {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.metrics = srv
+	s.mutex.Unlock()
+
+	err := srv.ListenAndServe()
+	if err == http.ErrServerClosed {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+package server
+
+import (
+	"log"
+	"net"
+)
+
+// Option configures a Server created with NewServer
+type Option func(*Server)
+
+// WithAuthenticator sets the backend that checks passwords, AllowAll by
+// default
+func WithAuthenticator(auth Authenticator) Option {
+	return func(s *Server) {
+		s.Auth = auth
+	}
+}
+
+// WithStore sets where accounts, keys, rooms, offline messages and revoked
+// tokens are kept, a MemoryStore by default. Shutdown closes the store.
+func WithStore(store Store) Option {
+	return func(s *Server) {
+		s.store = store
+	}
+}
+
+// WithLogger sets the logger for server events, the standard logger by
+// default
+func WithLogger(logger *log.Logger) Option {
+	return func(s *Server) {
+		s.logger = logger
+	}
+}
+
+// WithHooks sets functions called on connection and session events
+func WithHooks(hooks Hooks) Option {
+	return func(s *Server) {
+		s.hooks = hooks
+	}
+}
+
+// Hooks are called on connection and session events. Any of them may be
+// nil. They run on the connection's goroutine and should return quickly.
+type Hooks struct {
+	// A connection was accepted
+	OnConnect func(addr net.Addr)
+	// A user logged in with a password, certificate or session token
+	OnLogin func(username string)
+	// A logged in user went away
+	OnDisconnect func(username string)
+	// A message was relayed. The body stays end-to-end encrypted.
+	OnMessage func(sender string, recipient string)
+}
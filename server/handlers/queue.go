@@ -0,0 +1,322 @@
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// SlowConsumerPolicy decides what happens to outbound frames for a client
+// whose queue is full.
+type SlowConsumerPolicy int
+
+const (
+	// DropMessages discards frames that do not fit in the queue
+	DropMessages SlowConsumerPolicy = iota
+	// SpoolToDisk appends overflowing frames to a temporary file and
+	// delivers them once the client catches up. A client whose spool grows
+	// beyond its limit is disconnected.
+	SpoolToDisk
+	// DisconnectClient sends a DISCONNECT with reason ServerRequest and
+	// closes the connection
+	DisconnectClient
+)
+
+var (
+	errQueueFull   = errors.New("outbound queue full")
+	errSpoolFull   = errors.New("outbound spool full")
+	errQueueClosed = errors.New("outbound queue closed")
+)
+
+// QueueStats is a snapshot of a client's outbound queue
+type QueueStats struct {
+	Username  string    `json:"username"`
+	Depth     int       `json:"depth"`
+	Spooled   int       `json:"spooled"`
+	Sent      uint64    `json:"sent"`
+	Dropped   uint64    `json:"dropped"`
+	LastWrite time.Time `json:"last_write"`
+}
+
+// outQueue is a bounded FIFO of encoded frames waiting to be written to a
+// client connection. Frames that overflow the queue are handled according
+// to the configured SlowConsumerPolicy.
+type outQueue struct {
+	mutex  sync.Mutex
+	cond   *sync.Cond
+	frames [][]byte
+	limit  int
+	policy SlowConsumerPolicy
+
+	spoolDir   string
+	spoolLimit int64
+	spool      *os.File
+	spoolRead  int64
+	spoolWrite int64
+	spooled    int
+
+	sent      uint64
+	dropped   uint64
+	lastWrite time.Time
+
+	closed   bool
+	draining bool
+	final    []byte
+}
+
+func newOutQueue(limit int, policy SlowConsumerPolicy, spoolDir string, spoolLimit int64) *outQueue {
+	q := &outQueue{
+		limit:      limit,
+		policy:     policy,
+		spoolDir:   spoolDir,
+		spoolLimit: spoolLimit,
+	}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+// push appends a frame to the queue. It returns errQueueFull when the frame
+// was dropped or the client has to be disconnected, errSpoolFull when the
+// spool reached its limit. Otherwise it returns the
+// number of frames that have to be sent before this one is written, for
+// waitSent.
+func (q *outQueue) push(frame []byte) (uint64, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed || q.draining {
+		return 0, errQueueClosed
+	}
+
+	// Once frames are spooled everything goes through the spool until it is
+	// drained, otherwise frames would be delivered out of order
+	if q.spooled > 0 || len(q.frames) >= q.limit {
+		switch q.policy {
+		case SpoolToDisk:
+			if q.spoolWrite+int64(4+len(frame)) > q.spoolLimit {
+				q.dropped++
+				return 0, errSpoolFull
+			}
+			if err := q.writeSpool(frame); err != nil {
+				q.dropped++
+				return 0, fmt.Errorf("failed to spool frame: %v", err)
+			}
+			q.cond.Broadcast()
+			return q.position(), nil
+		case DropMessages:
+			q.dropped++
+			return 0, errQueueFull
+		default:
+			return 0, errQueueFull
+		}
+	}
+
+	q.frames = append(q.frames, frame)
+	q.cond.Broadcast()
+	return q.position(), nil
+}
+
+// pushWait appends a frame to the queue, waiting for room instead of
+// applying the SlowConsumerPolicy. It returns the number of frames that
+// have to be sent before this one is written, for waitSent.
+func (q *outQueue) pushWait(frame []byte) (uint64, error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for !q.closed && !q.draining && (q.spooled > 0 || len(q.frames) >= q.limit) {
+		q.cond.Wait()
+	}
+	if q.closed || q.draining {
+		return 0, errQueueClosed
+	}
+
+	q.frames = append(q.frames, frame)
+	q.cond.Broadcast()
+	return q.position(), nil
+}
+
+// position returns the number of frames sent once the last one queued is
+// written. Frames are written in order and never skipped without closing
+// the queue.
+func (q *outQueue) position() uint64 {
+	return q.sent + uint64(len(q.frames)) + uint64(q.spooled)
+}
+
+// waitSent blocks until sent frames have been written to the connection or
+// the queue is closed before
+func (q *outQueue) waitSent(sent uint64) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for q.sent < sent {
+		if q.closed {
+			return errQueueClosed
+		}
+		q.cond.Wait()
+	}
+	return nil
+}
+
+// next blocks until a frame is available. The second return value is false
+// once the queue has been closed or drained, in which case the frame (if
+// any) is the last one to be written.
+func (q *outQueue) next() ([]byte, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	for len(q.frames) == 0 && q.spooled == 0 && !q.closed && !q.draining {
+		q.cond.Wait()
+	}
+
+	if q.closed {
+		final := q.final
+		q.final = nil
+		return final, false
+	}
+
+	if len(q.frames) > 0 {
+		frame := q.frames[0]
+		q.frames[0] = nil
+		q.frames = q.frames[1:]
+		// Wake pushWait
+		q.cond.Broadcast()
+		return frame, true
+	}
+
+	// A drained queue is closed once everything queued has been handed out
+	if q.spooled == 0 {
+		q.closed = true
+		q.removeSpool()
+		final := q.final
+		q.final = nil
+		return final, false
+	}
+
+	frame, err := q.readSpool()
+	if err != nil {
+		// The spool is unusable. The client is cut off rather than missing
+		// its contents without noticing.
+		q.dropped += uint64(q.spooled)
+		q.closed = true
+		q.removeSpool()
+		q.cond.Broadcast()
+		return nil, false
+	}
+	q.cond.Broadcast()
+	return frame, true
+}
+
+// close stops the queue. Pending frames are discarded and final, when not
+// nil, is handed to the writer as the last frame.
+func (q *outQueue) close(final []byte) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed {
+		return
+	}
+	q.closed = true
+	q.final = final
+	q.frames = nil
+	q.removeSpool()
+	q.cond.Broadcast()
+}
+
+// drain stops accepting new frames. Frames already queued or spooled are
+// still delivered, followed by final when it is not nil.
+func (q *outQueue) drain(final []byte) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if q.closed || q.draining {
+		return
+	}
+	q.draining = true
+	q.final = final
+	q.cond.Broadcast()
+}
+
+func (q *outQueue) markSent() {
+	q.mutex.Lock()
+	q.sent++
+	q.lastWrite = time.Now()
+	q.cond.Broadcast()
+	q.mutex.Unlock()
+}
+
+func (q *outQueue) stats() QueueStats {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	return QueueStats{
+		Depth:     len(q.frames) + q.spooled,
+		Spooled:   q.spooled,
+		Sent:      q.sent,
+		Dropped:   q.dropped,
+		LastWrite: q.lastWrite,
+	}
+}
+
+// writeSpool appends a length prefixed frame to the spool file
+func (q *outQueue) writeSpool(frame []byte) error {
+	if q.spool == nil {
+		f, err := os.CreateTemp(q.spoolDir, "srcp-spool-*")
+		if err != nil {
+			return err
+		}
+		q.spool = f
+	}
+
+	buf := make([]byte, 4+len(frame))
+	binary.BigEndian.PutUint32(buf, uint32(len(frame)))
+	copy(buf[4:], frame)
+
+	if _, err := q.spool.WriteAt(buf, q.spoolWrite); err != nil {
+		return err
+	}
+	q.spoolWrite += int64(len(buf))
+	q.spooled++
+	return nil
+}
+
+// readSpool returns the oldest spooled frame
+func (q *outQueue) readSpool() ([]byte, error) {
+	var size [4]byte
+	if _, err := q.spool.ReadAt(size[:], q.spoolRead); err != nil {
+		return nil, err
+	}
+
+	frame := make([]byte, binary.BigEndian.Uint32(size[:]))
+	if _, err := q.spool.ReadAt(frame, q.spoolRead+4); err != nil && err != io.EOF {
+		return nil, err
+	}
+	q.spoolRead += int64(4 + len(frame))
+	q.spooled--
+
+	if q.spooled == 0 {
+		q.resetSpool()
+	}
+	return frame, nil
+}
+
+func (q *outQueue) removeSpool() {
+	if q.spool != nil {
+		q.spool.Close()
+		os.Remove(q.spool.Name())
+		q.spool = nil
+	}
+	q.resetSpool()
+}
+
+func (q *outQueue) resetSpool() {
+	if q.spool != nil {
+		q.spool.Truncate(0)
+	}
+	q.spoolRead = 0
+	q.spoolWrite = 0
+	q.spooled = 0
+}
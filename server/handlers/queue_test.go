@@ -0,0 +1,142 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"scrp/models"
+	"scrp/variables"
+	"testing"
+)
+
+func TestOutQueuePolicies(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy SlowConsumerPolicy
+		// Error of each of four frames pushed into a queue of two
+		errs      []error
+		delivered int
+		dropped   uint64
+	}{
+		{"drop", DropMessages, []error{nil, nil, errQueueFull, errQueueFull}, 2, 2},
+		{"spool", SpoolToDisk, []error{nil, nil, nil, nil}, 4, 0},
+		{"disconnect", DisconnectClient, []error{nil, nil, errQueueFull, errQueueFull}, 2, 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newOutQueue(2, test.policy, t.TempDir(), 1<<20)
+			defer q.close(nil)
+
+			for i, want := range test.errs {
+				if _, err := q.push([]byte{byte(i)}); err != want {
+					t.Fatalf("frame %d: %v, expected %v", i, err, want)
+				}
+			}
+
+			// Frames that were accepted arrive in order
+			for i := 0; i < test.delivered; i++ {
+				frame, ok := q.next()
+				if !ok || !bytes.Equal(frame, []byte{byte(i)}) {
+					t.Fatalf("frame %d not delivered, got %v", i, frame)
+				}
+				q.markSent()
+			}
+
+			stats := q.stats()
+			if stats.Depth != 0 || stats.Sent != uint64(test.delivered) || stats.Dropped != test.dropped {
+				t.Fatalf("stats %+v, expected %d sent and %d dropped", stats, test.delivered, test.dropped)
+			}
+		})
+	}
+}
+
+func TestSlowConsumer(t *testing.T) {
+	tests := []struct {
+		name         string
+		policy       SlowConsumerPolicy
+		disconnected bool
+	}{
+		{"drop", DropMessages, false},
+		{"spool", SpoolToDisk, false},
+		{"disconnect", DisconnectClient, true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			s.SlowConsumer = test.policy
+			client := addTestClient(s, "bob")
+			client.queue = newOutQueue(1, test.policy, t.TempDir(), 1<<20)
+
+			for i := 0; i < 3; i++ {
+				s.Send(client, variables.Ping, &models.HeartbeatPayload{Nonce: uint32(i)})
+			}
+
+			// A disconnected client gets nothing but the DISCONNECT, the
+			// others keep receiving
+			frame, ok := client.queue.next()
+			if test.disconnected {
+				var header models.Header
+				if err := binary.Read(bytes.NewReader(frame), binary.BigEndian, &header); err != nil {
+					t.Fatal(err)
+				}
+				if ok || header.Type != variables.Disconnect {
+					t.Fatalf("got type %d with the queue open %v, expected the final DISCONNECT", header.Type, ok)
+				}
+				return
+			}
+			if !ok {
+				t.Fatal("queue closed")
+			}
+			if _, err := s.sendFrame(client, frame); err != nil {
+				t.Fatalf("queue does not accept frames once there is room: %v", err)
+			}
+		})
+	}
+}
+
+func TestOutQueueSpoolLimit(t *testing.T) {
+	// One frame fits in the queue, two of 12 bytes with their length in the
+	// spool
+	q := newOutQueue(1, SpoolToDisk, t.TempDir(), 32)
+	defer q.close(nil)
+
+	frame := bytes.Repeat([]byte{1}, 12)
+	for i := 0; i < 3; i++ {
+		if _, err := q.push(frame); err != nil {
+			t.Fatalf("frame %d: %v", i+1, err)
+		}
+	}
+	if _, err := q.push(frame); err != errSpoolFull {
+		t.Fatalf("frame beyond the spool limit: %v, expected %v", err, errSpoolFull)
+	}
+
+	// Once delivered the spool has room again
+	for i := 0; i < 3; i++ {
+		if got, ok := q.next(); !ok || !bytes.Equal(got, frame) {
+			t.Fatalf("frame %d not delivered", i+1)
+		}
+	}
+	if _, err := q.push(frame); err != nil {
+		t.Fatalf("frame after the spool was drained: %v", err)
+	}
+}
+
+func TestSpoolLimitDisconnects(t *testing.T) {
+	s := newTestServer(t)
+	s.SlowConsumer = SpoolToDisk
+	client := addTestClient(s, "bob")
+	client.queue = newOutQueue(1, SpoolToDisk, t.TempDir(), 16)
+
+	payload := struct{ Data [16]byte }{}
+	var err error
+	for i := 0; i < 3 && err == nil; i++ {
+		err = s.Send(client, 0, &payload)
+	}
+	if err != errSpoolFull {
+		t.Fatalf("sent beyond the spool limit: %v", err)
+	}
+	if _, ok := client.queue.next(); ok {
+		t.Fatal("queue still open after the spool limit was reached")
+	}
+}
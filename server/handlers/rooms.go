@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bytes"
+	"regexp"
+	"scrp/models"
+	"scrp/variables"
+)
+
+// Members a room can have, as many as fit in a ROOM_MEMBERS payload
+const maxRoomMembers = len(models.RoomMembersPayload{}.Members)
+
+var roomNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,31}$`)
+
+// HandleRoomJoin adds the client's user to a room, creating the room if
+// needed, and sends the new membership to every member
+func (s *Server) HandleRoomJoin(client *Client, payload models.RoomPayload) {
+	if !s.loggedIn(client) {
+		s.logger.Printf("Unexpected ROOM_JOIN from %s", clientName(client))
+		return
+	}
+
+	room := string(bytes.Trim(payload.Room[:], "\x00"))
+	username := clientName(client)
+
+	if !roomNamePattern.MatchString(room) {
+		s.sendRoomStatus(client, payload.Room, variables.RoomInvalid)
+		return
+	}
+
+	s.roomsMutex.Lock()
+	members, err := s.store.RoomMembers(room)
+	if err != nil {
+		s.roomsMutex.Unlock()
+		s.logger.Printf("Failed to load room %s: %v", room, err)
+		return
+	}
+	if !contains(members, username) && len(members) >= maxRoomMembers {
+		s.roomsMutex.Unlock()
+		s.sendRoomStatus(client, payload.Room, variables.RoomFull)
+		return
+	}
+	err = s.store.AddRoomMember(room, username)
+	s.roomsMutex.Unlock()
+	if err != nil {
+		s.logger.Printf("Failed to add %s to room %s: %v", username, room, err)
+		return
+	}
+
+	s.logger.Printf("%s joined room %s", username, room)
+	s.broadcastRoomMembers(room, nil)
+}
+
+// HandleRoomLeave removes the client's user from a room. The room goes away
+// with its last member.
+func (s *Server) HandleRoomLeave(client *Client, payload models.RoomPayload) {
+	if !s.loggedIn(client) {
+		s.logger.Printf("Unexpected ROOM_LEAVE from %s", clientName(client))
+		return
+	}
+
+	room := string(bytes.Trim(payload.Room[:], "\x00"))
+	username := clientName(client)
+
+	s.roomsMutex.Lock()
+	err := s.store.RemoveRoomMember(room, username)
+	s.roomsMutex.Unlock()
+	if err != nil {
+		s.logger.Printf("Failed to remove %s from room %s: %v", username, room, err)
+		return
+	}
+
+	s.logger.Printf("%s left room %s", username, room)
+
+	// The leaver is told as well so it knows it is no longer a member
+	s.broadcastRoomMembers(room, client)
+}
+
+// HandleRoomList answers with the names of the rooms on the server
+func (s *Server) HandleRoomList(client *Client) {
+	if !s.loggedIn(client) {
+		s.logger.Printf("Unexpected ROOM_LIST from %s", clientName(client))
+		return
+	}
+
+	names, err := s.store.Rooms()
+	if err != nil {
+		s.logger.Printf("Failed to list rooms: %v", err)
+	}
+
+	var response models.RoomListPayload
+	for i, room := range names {
+		if i == len(response.Rooms) {
+			break
+		}
+		copy(response.Rooms[i][:], room)
+		response.Count++
+	}
+
+	if err := s.Send(client, variables.RoomList, &response); err != nil {
+		s.logger.Printf("Failed to send ROOM_LIST to %s: %v", clientName(client), err)
+	}
+}
+
+// sendUserRooms sends the membership of every room the client's user is in,
+// so that a client picks up its rooms again after logging in
+func (s *Server) sendUserRooms(client *Client) {
+	username := clientName(client)
+
+	rooms, err := s.store.UserRooms(username)
+	if err != nil {
+		s.logger.Printf("Failed to load the rooms of %s: %v", username, err)
+		return
+	}
+
+	for _, room := range rooms {
+		payload, err := s.roomMembersPayload(room)
+		if err != nil {
+			s.logger.Printf("Failed to load room %s: %v", room, err)
+			continue
+		}
+		if err := s.Send(client, variables.RoomMembers, &payload); err != nil {
+			s.logger.Printf("Failed to send ROOM_MEMBERS to %s: %v", username, err)
+		}
+	}
+}
+
+// broadcastRoomMembers sends the membership of a room to its members that
+// are online, and to extra if it is not nil
+func (s *Server) broadcastRoomMembers(room string, extra *Client) {
+	members, err := s.store.RoomMembers(room)
+	if err != nil {
+		s.logger.Printf("Failed to load room %s: %v", room, err)
+		return
+	}
+	payload := roomMembersPayload(room, members)
+
+	s.mutex.Lock()
+	var recipients []*Client
+	for _, username := range members {
+		if client, ok := s.Clients[username]; ok {
+			recipients = append(recipients, client)
+		}
+	}
+	s.mutex.Unlock()
+	if extra != nil {
+		recipients = append(recipients, extra)
+	}
+
+	for _, client := range recipients {
+		if err := s.Send(client, variables.RoomMembers, &payload); err != nil {
+			s.logger.Printf("Failed to send ROOM_MEMBERS to %s: %v", clientName(client), err)
+		}
+	}
+}
+
+func (s *Server) roomMembersPayload(room string) (models.RoomMembersPayload, error) {
+	members, err := s.store.RoomMembers(room)
+	if err != nil {
+		return models.RoomMembersPayload{}, err
+	}
+	return roomMembersPayload(room, members), nil
+}
+
+func roomMembersPayload(room string, members []string) models.RoomMembersPayload {
+	payload := models.RoomMembersPayload{
+		Status: variables.RoomOK,
+	}
+	copy(payload.Room[:], room)
+	for i, username := range members {
+		if i == len(payload.Members) {
+			break
+		}
+		copy(payload.Members[i][:], username)
+		payload.Count++
+	}
+	return payload
+}
+
+// inRoom reports whether the user is a member of the room
+func (s *Server) inRoom(room string, username string) (bool, error) {
+	members, err := s.store.RoomMembers(room)
+	if err != nil {
+		return false, err
+	}
+	return contains(members, username), nil
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) sendRoomStatus(client *Client, room [32]byte, status uint8) {
+	payload := models.RoomMembersPayload{
+		Room:   room,
+		Status: status,
+	}
+	if err := s.Send(client, variables.RoomMembers, &payload); err != nil {
+		s.logger.Printf("Failed to send ROOM_MEMBERS to %s: %v", clientName(client), err)
+	}
+}
+
+// loggedIn reports whether the client completed a login on this connection
+func (s *Server) loggedIn(client *Client) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	registered, ok := s.Clients[clientName(client)]
+	return ok && registered == client && client.State >= AUTHENTICATED && client.State < DISCONNECTING
+}
@@ -1,15 +1,22 @@
 package server
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/tls"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
 	"scrp/models"
 	"scrp/server/utils"
 	"scrp/variables"
 	"sync"
+	"time"
 )
 
 type State int
@@ -29,57 +36,266 @@ type Server struct {
 	Listener net.Listener
 	Clients  map[string]*Client
 	mutex    sync.Mutex
+
+	// Server certificate and key. A self-signed pair for CertHosts is
+	// generated when they do not exist.
+	CertFile  string
+	KeyFile   string
+	CertHosts []string
+
+	// How often the certificate files are checked for changes. They are
+	// also reloaded on SIGHUP.
+	CertReloadInterval time.Duration
+
+	// Outbound queue settings applied to every new connection
+	WriteTimeout time.Duration
+	QueueSize    int
+	SlowConsumer SlowConsumerPolicy
+	SpoolDir     string
+	// Most bytes spooled to disk for one client with SpoolToDisk
+	SpoolLimit int64
+
+	// Heartbeat settings. A PING is sent every HeartbeatInterval and a
+	// client that stays silent for HeartbeatInterval+HeartbeatTimeout is
+	// dropped.
+	HeartbeatInterval time.Duration
+	HeartbeatTimeout  time.Duration
+
+	// Messages stamped further than MaxClockSkew from the server's clock
+	// are logged as skewed
+	MaxClockSkew time.Duration
+
+	// How often disappearing messages are purged from mailboxes once they
+	// expire
+	MailboxPurgeInterval time.Duration
+
+	// Checks passwords of AUTH_REQUESTs
+	Auth Authenticator
+	// Log the (encrypted) body of every relayed message
+	LogMessages bool
+
+	// Session tokens are signed with TokenSecret, at least
+	// MinTokenSecretLength bytes, and stay valid for SessionTTL unless
+	// revoked with a LOGOUT
+	SessionTTL  time.Duration
+	TokenSecret []byte
+
+	// When ClientCAFile is set, clients may present a certificate signed by
+	// that CA and are logged in as the certificate's common name without a
+	// password. RequireClientCert makes a certificate mandatory.
+	ClientCAFile      string
+	RequireClientCert bool
+
+	store   Store
+	logger  *log.Logger
+	hooks   Hooks
+	conns   map[*Client]struct{}
+	certs   *certReloader
+	metrics *http.Server
+
+	// Serializes read-modify-write cycles of stored accounts and rooms
+	accountsMutex sync.Mutex
+	roomsMutex    sync.Mutex
+
+	// Set by Shutdown. handlers counts the read and write goroutines of
+	// every connection.
+	closing  bool
+	quit     chan struct{}
+	handlers sync.WaitGroup
 }
 
 type Client struct {
+	// Set at login. Other goroutines read it with clientName, which takes
+	// mutex.
 	Username [32]byte
 	Key      [512]byte
 	Conn     net.Conn
 	State    State
+	Token    [64]byte
+	queue    *outQueue
+	done     chan struct{}
+
+	// Set while the client is asked for a second factor
+	pendingUsername [32]byte
+	authAttempts    int
+
+	mutex sync.Mutex
 }
 
-func NewServer() *Server {
-	return &Server{
-		Clients: make(map[string]*Client),
+// ErrServerClosed is returned by Serve and ListenAndServe after Shutdown
+var ErrServerClosed = errors.New("server closed")
+
+// NewServer creates a server with default settings. The exported fields can
+// be changed until the server starts serving.
+func NewServer(opts ...Option) (*Server, error) {
+	secret := make([]byte, MinTokenSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, fmt.Errorf("failed to generate token secret: %v", err)
+	}
+
+	s := &Server{
+		Clients:   make(map[string]*Client),
+		CertFile:  "./server/cert.pem",
+		KeyFile:   "./server/key.pem",
+		CertHosts: defaultCertHosts(),
+
+		CertReloadInterval: 10 * time.Second,
+
+		Auth:        AllowAll{},
+		LogMessages: true,
+
+		WriteTimeout: 10 * time.Second,
+		QueueSize:    256,
+		SlowConsumer: DisconnectClient,
+		SpoolDir:     os.TempDir(),
+		SpoolLimit:   64 << 20,
+
+		HeartbeatInterval: 30 * time.Second,
+		HeartbeatTimeout:  30 * time.Second,
+
+		MaxClockSkew:         5 * time.Minute,
+		MailboxPurgeInterval: time.Minute,
+
+		SessionTTL:  7 * 24 * time.Hour,
+		TokenSecret: secret,
+
+		store:  NewMemoryStore(),
+		logger: log.Default(),
+		conns:  make(map[*Client]struct{}),
+		quit:   make(chan struct{}),
 	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s, nil
 }
 
-func (s *Server) Listen(port string) {
-	certFile := "cert.pem"
-	keyFile := "key.pem"
+// defaultCertHosts are the names a generated self-signed certificate is
+// valid for
+func defaultCertHosts() []string {
+	hosts := []string{"localhost", "127.0.0.1", "::1"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		hosts = append(hosts, hostname)
+	}
+	return hosts
+}
 
-	_, certInfo := os.Stat(certFile)
-	_, keyInfo := os.Stat(keyFile)
+// TLSConfig returns the TLS configuration for the server's listener. A
+// self-signed certificate is generated when CertFile or KeyFile do not
+// exist. The certificate is reloaded when its files change until the server
+// is shut down.
+func (s *Server) TLSConfig() (*tls.Config, error) {
+	_, certInfo := os.Stat(s.CertFile)
+	_, keyInfo := os.Stat(s.KeyFile)
 
 	if os.IsNotExist(certInfo) || os.IsNotExist(keyInfo) {
-		log.Println("Generating server certificates and key...")
-		if err := utils.GenerateServerCert(certFile, keyFile); err != nil {
-			log.Fatalf("Failed to generate server certificates and key: %v", err)
+		s.logger.Println("Generating server certificates and key...")
+		if err := utils.GenerateServerCert(s.CertFile, s.KeyFile, s.CertHosts); err != nil {
+			return nil, fmt.Errorf("failed to generate server certificates and key: %v", err)
 		}
-		log.Println("Server certificates and key generated.")
+		s.logger.Println("Server certificates and key generated.")
 	}
 
-	cert, err := tls.LoadX509KeyPair("./server/"+certFile, "./server/"+keyFile)
+	certs, err := newCertReloader(s.CertFile, s.KeyFile, s.logger)
 	if err != nil {
-		log.Fatalf("Failed to load server certificate: %v", err)
+		return nil, fmt.Errorf("failed to load server certificate: %v", err)
+	}
+
+	config := &tls.Config{
+		GetCertificate: certs.GetCertificate,
 	}
 
-	config := tls.Config{
-		Certificates: []tls.Certificate{cert},
+	if s.ClientCAFile != "" {
+		pool, err := utils.LoadCertPool(s.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client CA: %v", err)
+		}
+
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if s.RequireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
 	}
 
-	s.Listener, err = tls.Listen("tcp", ":8080", &config)
+	s.mutex.Lock()
+	s.certs = certs
+	s.mutex.Unlock()
+	go certs.watch(s.CertReloadInterval, s.quit)
+
+	return config, nil
+}
+
+// Reload loads the server certificate and key again, e.g. when the process
+// receives SIGHUP. On failure the current certificate stays in use.
+func (s *Server) Reload() error {
+	s.mutex.Lock()
+	certs := s.certs
+	s.mutex.Unlock()
+
+	if certs == nil {
+		return errors.New("no server certificate loaded")
+	}
+	return certs.Reload()
+}
+
+// ListenAndServe listens for TLS connections on addr and serves them until
+// ctx is done or Shutdown is called
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	config, err := s.TLSConfig()
 	if err != nil {
-		log.Fatalf("Failed to start server: %v", err)
+		return err
 	}
 
-	log.Println("Listening on port 8080...")
+	listener, err := tls.Listen("tcp", addr, config)
+	if err != nil {
+		return fmt.Errorf("failed to start server: %v", err)
+	}
+
+	s.logger.Printf("Listening on %s...", addr)
+	return s.Serve(ctx, listener)
+}
+
+// Serve handles connections accepted on listener until ctx is done or
+// Shutdown is called. The listener is used as is, for TLS wrap it with
+// tls.NewListener and TLSConfig. When ctx is done the server shuts down as
+// with Shutdown. Serve always returns a non-nil error, ErrServerClosed once
+// the server is shut down.
+func (s *Server) Serve(ctx context.Context, listener net.Listener) error {
+	s.mutex.Lock()
+	if s.closing {
+		s.mutex.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	if s.Listener != nil {
+		s.mutex.Unlock()
+		return errors.New("server is already serving")
+	}
+	s.Listener = listener
+	s.mutex.Unlock()
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			s.Shutdown(context.Background())
+		case <-s.quit:
+		}
+	}()
+	go s.purgeMailboxes(s.MailboxPurgeInterval, s.quit)
 
 	for {
-		conn, err := s.Listener.Accept()
+		conn, err := listener.Accept()
 		if err != nil {
-			log.Printf("Failed to accept connection: %v", err)
-			continue
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				s.logger.Printf("Failed to accept connection: %v", err)
+				continue
+			}
+			return err
 		}
 
 		go s.HandleClient(conn)
@@ -87,16 +303,60 @@ func (s *Server) Listen(port string) {
 }
 
 func (s *Server) HandleClient(conn net.Conn) {
-	defer conn.Close()
+	client := &Client{
+		Conn:  conn,
+		State: INIT,
+		queue: newOutQueue(s.QueueSize, s.SlowConsumer, s.SpoolDir, s.SpoolLimit),
+		done:  make(chan struct{}),
+	}
+
+	s.mutex.Lock()
+	if s.closing {
+		s.mutex.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[client] = struct{}{}
+	s.handlers.Add(2)
+	s.mutex.Unlock()
+	defer s.handlers.Done()
+
+	if s.hooks.OnConnect != nil {
+		s.hooks.OnConnect(conn.RemoteAddr())
+	}
+
+	go s.writeLoop(client)
+	go s.heartbeat(client)
+
+	// However the read loop ends, the client is removed and its peers are
+	// told that it went away
+	defer func() {
+		close(client.done)
+		s.RemoveClient(client)
+
+		s.mutex.Lock()
+		delete(s.conns, client)
+		s.mutex.Unlock()
+
+		client.queue.close(nil)
+		conn.Close()
+	}()
 
 	// Read and process messages from the client
 	for {
+		// Any PDU, including a PONG, keeps the connection alive
+		conn.SetReadDeadline(time.Now().Add(s.HeartbeatInterval + s.HeartbeatTimeout))
+
 		// Read the header
 		var header models.Header
 		err := binary.Read(conn, binary.BigEndian, &header)
 
 		if err != nil {
-			log.Printf("Failed to read header from client: %v", err)
+			s.logger.Printf("Failed to read header from client: %v", err)
+			return
+		}
+		if header.Version != variables.Version {
+			s.logger.Printf("Client %s speaks protocol version %d, expected %d", clientName(client), header.Version, variables.Version)
 			return
 		}
 		// Read the payload based on the message type
@@ -105,45 +365,332 @@ func (s *Server) HandleClient(conn net.Conn) {
 			var payload models.AuthRequestPayload
 			err = binary.Read(conn, binary.BigEndian, &payload)
 			if err != nil {
-				log.Printf("Failed to read AUTH_REQUEST payload from client: %v", err)
+				s.logger.Printf("Failed to read AUTH_REQUEST payload from client: %v", err)
+				return
+			}
+			s.HandleAuthRequest(client, payload)
+
+		case variables.TokenAuth:
+			var payload models.TokenAuthPayload
+			err = binary.Read(conn, binary.BigEndian, &payload)
+			if err != nil {
+				s.logger.Printf("Failed to read TOKEN_AUTH payload from client: %v", err)
+				return
+			}
+			s.HandleTokenAuth(client, payload)
+
+		case variables.AuthCode:
+			var payload models.AuthCodePayload
+			err = binary.Read(conn, binary.BigEndian, &payload)
+			if err != nil {
+				s.logger.Printf("Failed to read AUTH_CODE payload from client: %v", err)
+				return
+			}
+			s.HandleAuthCode(client, payload)
+
+		case variables.TwoFactor:
+			var payload models.TwoFactorPayload
+			err = binary.Read(conn, binary.BigEndian, &payload)
+			if err != nil {
+				s.logger.Printf("Failed to read TWO_FACTOR payload from client: %v", err)
 				return
 			}
-			s.HandleAuthRequest(conn, payload)
+			s.HandleTwoFactor(client, payload)
+
+		case variables.Logout:
+			var payload models.LogoutPayload
+			err = binary.Read(conn, binary.BigEndian, &payload)
+			if err != nil {
+				s.logger.Printf("Failed to read LOGOUT payload from client: %v", err)
+				return
+			}
+			s.HandleLogout(client, payload)
+			return
 
 		case variables.KeyExchange:
 			var payload models.PublicKeyPayload
 			err = binary.Read(conn, binary.BigEndian, &payload)
 			if err != nil {
-				log.Printf("Failed to read KEY_EXCHANGE payload from client: %v", err)
+				s.logger.Printf("Failed to read KEY_EXCHANGE payload from client: %v", err)
 				return
 			}
 
-			s.HandleKeyExchange(conn, payload)
-			// TODO: Handle public key exchange
+			if err := s.HandleKeyExchange(client, payload); err != nil {
+				s.logger.Printf("Failed to handle KEY_EXCHANGE: %v", err)
+			}
 
 		case variables.Message:
 			var payload models.MessagePayload
 			err = binary.Read(conn, binary.BigEndian, &payload)
 			if err != nil {
-				log.Printf("Failed to read MESSAGE payload from client: %v", err)
+				s.logger.Printf("Failed to read MESSAGE payload from client: %v", err)
+				return
+			}
+
+			if err := s.HandleMessage(client, header.Sequence, payload); err != nil {
+				s.logger.Printf("Failed to handle MESSAGE: %v", err)
+			}
+
+		case variables.RoomJoin:
+			var payload models.RoomPayload
+			err = binary.Read(conn, binary.BigEndian, &payload)
+			if err != nil {
+				s.logger.Printf("Failed to read ROOM_JOIN payload from client: %v", err)
 				return
 			}
-			s.HandleMessage(conn, payload)
-			// TODO: Handle incoming message
+			s.HandleRoomJoin(client, payload)
+
+		case variables.RoomLeave:
+			var payload models.RoomPayload
+			err = binary.Read(conn, binary.BigEndian, &payload)
+			if err != nil {
+				s.logger.Printf("Failed to read ROOM_LEAVE payload from client: %v", err)
+				return
+			}
+			s.HandleRoomLeave(client, payload)
+
+		case variables.RoomList:
+			var payload models.RoomListPayload
+			err = binary.Read(conn, binary.BigEndian, &payload)
+			if err != nil {
+				s.logger.Printf("Failed to read ROOM_LIST payload from client: %v", err)
+				return
+			}
+			s.HandleRoomList(client)
 
 		case variables.Disconnect:
 			var payload models.DisconnectPayload
 			err = binary.Read(conn, binary.BigEndian, &payload)
 			if err != nil {
-				log.Printf("Failed to read DISCONNECT payload from client: %v", err)
+				s.logger.Printf("Failed to read DISCONNECT payload from client: %v", err)
 				return
 			}
 
-			s.HandleDisconnect(conn, payload)
+			s.HandleDisconnect(client, payload)
+			return
+
+		case variables.Ping:
+			var payload models.HeartbeatPayload
+			err = binary.Read(conn, binary.BigEndian, &payload)
+			if err != nil {
+				s.logger.Printf("Failed to read PING payload from client: %v", err)
+				return
+			}
+
+			if err := s.Send(client, variables.Pong, &payload); err != nil {
+				s.logger.Printf("Failed to send PONG to client: %v", err)
+			}
+
+		case variables.Pong:
+			var payload models.HeartbeatPayload
+			err = binary.Read(conn, binary.BigEndian, &payload)
+			if err != nil {
+				s.logger.Printf("Failed to read PONG payload from client: %v", err)
+				return
+			}
 
 		default:
-			log.Printf("Unknown message type received from client: %d", header.Type)
+			s.logger.Printf("Unknown message type received from client: %d", header.Type)
+			return
+		}
+	}
+}
+
+// Send encodes a PDU and queues it for delivery to the client. When the
+// queue is full the server's SlowConsumer policy is applied.
+func (s *Server) Send(client *Client, msgType uint8, payload interface{}) error {
+	frame, err := encodeFrame(msgType, payload)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.sendFrame(client, frame)
+	return err
+}
+
+// sendFrame queues an encoded PDU like Send and returns its position in the
+// queue for waitSent
+func (s *Server) sendFrame(client *Client, frame []byte) (uint64, error) {
+	position, err := client.queue.push(frame)
+	if err == errSpoolFull || (err == errQueueFull && s.SlowConsumer == DisconnectClient) {
+		s.disconnectSlowConsumer(client)
+	}
+	return position, err
+}
+
+// heartbeat sends a PING to the client every HeartbeatInterval until the
+// connection is closed
+func (s *Server) heartbeat(client *Client) {
+	ticker := time.NewTicker(s.HeartbeatInterval)
+	defer ticker.Stop()
+
+	var nonce uint32
+	for {
+		select {
+		case <-client.done:
+			return
+		case <-ticker.C:
+			nonce++
+			payload := models.HeartbeatPayload{Nonce: nonce}
+			if err := s.Send(client, variables.Ping, &payload); err == errQueueClosed {
+				return
+			}
+		}
+	}
+}
+
+// writeLoop writes queued frames to the client connection until the queue is
+// closed or a write fails
+func (s *Server) writeLoop(client *Client) {
+	defer s.handlers.Done()
+
+	for {
+		frame, ok := client.queue.next()
+		if frame != nil {
+			client.Conn.SetWriteDeadline(time.Now().Add(s.WriteTimeout))
+			if _, err := client.Conn.Write(frame); err != nil {
+				s.logger.Printf("Failed to write to client %s: %v", clientName(client), err)
+				client.queue.close(nil)
+				client.Conn.Close()
+				return
+			}
+			// The final DISCONNECT is not counted, frames discarded before
+			// it must not look written
+			if ok {
+				client.queue.markSent()
+			}
+		}
+
+		if !ok {
+			client.Conn.Close()
 			return
 		}
 	}
 }
+
+// disconnectSlowConsumer drops everything queued for the client and closes
+// the connection after telling the client why
+func (s *Server) disconnectSlowConsumer(client *Client) {
+	s.logger.Printf("Disconnecting slow consumer %s", clientName(client))
+
+	frame, err := encodeFrame(variables.Disconnect, models.DisconnectPayload{
+		Reason: variables.ServerRequest,
+	})
+	if err != nil {
+		frame = nil
+	}
+	client.queue.close(frame)
+}
+
+// Shutdown stops accepting connections and sends a DISCONNECT with reason
+// ServerRequest to every client after the frames already queued for it.
+// It waits until all connections are closed or ctx is done, in which case
+// the remaining connections are closed without further delivery, and then
+// closes the store.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mutex.Lock()
+	if s.closing {
+		s.mutex.Unlock()
+		return errors.New("server is already shut down")
+	}
+	s.closing = true
+	close(s.quit)
+
+	listener := s.Listener
+	metrics := s.metrics
+	clients := make([]*Client, 0, len(s.conns))
+	for client := range s.conns {
+		clients = append(clients, client)
+	}
+	s.mutex.Unlock()
+
+	s.logger.Printf("Shutting down, disconnecting %d clients", len(clients))
+
+	if listener != nil {
+		listener.Close()
+	}
+	if metrics != nil {
+		metrics.Shutdown(ctx)
+	}
+
+	frame, err := encodeFrame(variables.Disconnect, models.DisconnectPayload{
+		Reason: variables.ServerRequest,
+	})
+	if err != nil {
+		frame = nil
+	}
+	for _, client := range clients {
+		client.queue.drain(frame)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.handlers.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		// Whoever did not take their DISCONNECT in time is cut off
+		for _, client := range clients {
+			client.queue.close(nil)
+			client.Conn.Close()
+		}
+		<-done
+	}
+
+	if err := s.store.Close(); err != nil {
+		return fmt.Errorf("failed to close store: %v", err)
+	}
+	return ctx.Err()
+}
+
+func (s *Server) shuttingDown() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.closing
+}
+
+// QueueStats returns a snapshot of the outbound queue of every connection
+func (s *Server) QueueStats() []QueueStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	stats := make([]QueueStats, 0, len(s.conns))
+	for client := range s.conns {
+		st := client.queue.stats()
+		st.Username = clientName(client)
+		stats = append(stats, st)
+	}
+	return stats
+}
+
+func encodeFrame(msgType uint8, payload interface{}) ([]byte, error) {
+	header := models.Header{
+		Version:  variables.Version,
+		Type:     msgType,
+		Length:   uint16(binary.Size(payload)),
+		Sequence: 0, // Sequence number, update this as needed
+	}
+
+	var buf bytes.Buffer
+	if err := binary.Write(&buf, binary.BigEndian, &header); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.BigEndian, payload); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func clientName(client *Client) string {
+	client.mutex.Lock()
+	name := string(bytes.Trim(client.Username[:], "\x00"))
+	client.mutex.Unlock()
+	if name == "" {
+		return client.Conn.RemoteAddr().String()
+	}
+	return name
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Messages kept for a user that is offline, further ones are refused
+const MaxMailboxMessages = 1000
+
+// ErrMailboxFull is returned by PushMailbox when the recipient already has
+// MaxMailboxMessages waiting
+var ErrMailboxFull = errors.New("mailbox full")
+
+// MailboxMessage is an encoded MESSAGE payload waiting for its recipient to
+// come back. A disappearing message is dropped at Expires. Seq is set by the
+// store and grows with every message kept.
+type MailboxMessage struct {
+	Seq     uint64    `json:"seq"`
+	Data    []byte    `json:"data"`
+	Queued  time.Time `json:"queued"`
+	Expires time.Time `json:"expires"`
+}
+
+// expired reports whether a disappearing message is past its expiry
+func (m MailboxMessage) expired(now time.Time) bool {
+	return !m.Expires.IsZero() && !now.Before(m.Expires)
+}
+
+// Store keeps the server state that outlives a connection. Implementations
+// must be safe for concurrent use.
+type Store interface {
+	// Account returns a copy of the user's account, nil if there is none
+	Account(username string) (*Account, error)
+	SaveAccount(account *Account) error
+
+	// SaveKey records the public key a user published at login. Key reports
+	// whether the user ever published one.
+	SaveKey(username string, key [512]byte) error
+	Key(username string) ([512]byte, bool, error)
+
+	// Rooms exist while they have members. Names are returned sorted.
+	Rooms() ([]string, error)
+	RoomMembers(room string) ([]string, error)
+	UserRooms(username string) ([]string, error)
+	AddRoomMember(room string, username string) error
+	RemoveRoomMember(room string, username string) error
+
+	// PushMailbox keeps a message for a user that is offline. Mailbox
+	// returns the waiting messages, oldest first, which stay in the mailbox
+	// until RemoveMailbox drops those up to and including Seq once they are
+	// delivered.
+	PushMailbox(recipient string, message MailboxMessage) error
+	Mailbox(recipient string) ([]MailboxMessage, error)
+	RemoveMailbox(recipient string, seq uint64) error
+	// PurgeMailboxes drops the messages that expired by now, also from
+	// disk, and returns how many there were
+	PurgeMailboxes(now time.Time) (int, error)
+
+	// RevokeToken remembers a revoked session token ID until the token
+	// would have expired anyway
+	RevokeToken(id [16]byte, expires time.Time) error
+	TokenRevoked(id [16]byte) (bool, error)
+
+	// Close flushes pending writes. The store is not used afterwards.
+	Close() error
+}
+
+// MemoryStore is a Store that keeps everything in memory and loses it when
+// the process exits
+type MemoryStore struct {
+	mutex     sync.Mutex
+	accounts  map[string]*Account
+	keys      map[string][512]byte
+	rooms     map[string]map[string]struct{}
+	mailboxes map[string][]MailboxMessage
+	// Seq of the last message kept
+	mailboxSeq uint64
+	revoked    map[[16]byte]time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		accounts:  make(map[string]*Account),
+		keys:      make(map[string][512]byte),
+		rooms:     make(map[string]map[string]struct{}),
+		mailboxes: make(map[string][]MailboxMessage),
+		revoked:   make(map[[16]byte]time.Time),
+	}
+}
+
+func (m *MemoryStore) Account(username string) (*Account, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	account, ok := m.accounts[username]
+	if !ok {
+		return nil, nil
+	}
+	return account.clone(), nil
+}
+
+func (m *MemoryStore) SaveAccount(account *Account) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.accounts[account.Username] = account.clone()
+	return nil
+}
+
+func (m *MemoryStore) SaveKey(username string, key [512]byte) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	m.keys[username] = key
+	return nil
+}
+
+func (m *MemoryStore) Key(username string) ([512]byte, bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	key, ok := m.keys[username]
+	return key, ok, nil
+}
+
+func (m *MemoryStore) Rooms() ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	rooms := make([]string, 0, len(m.rooms))
+	for room := range m.rooms {
+		rooms = append(rooms, room)
+	}
+	sort.Strings(rooms)
+	return rooms, nil
+}
+
+func (m *MemoryStore) RoomMembers(room string) ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	members := make([]string, 0, len(m.rooms[room]))
+	for username := range m.rooms[room] {
+		members = append(members, username)
+	}
+	sort.Strings(members)
+	return members, nil
+}
+
+func (m *MemoryStore) UserRooms(username string) ([]string, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var rooms []string
+	for room, members := range m.rooms {
+		if _, ok := members[username]; ok {
+			rooms = append(rooms, room)
+		}
+	}
+	sort.Strings(rooms)
+	return rooms, nil
+}
+
+func (m *MemoryStore) AddRoomMember(room string, username string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	members, ok := m.rooms[room]
+	if !ok {
+		members = make(map[string]struct{})
+		m.rooms[room] = members
+	}
+	members[username] = struct{}{}
+	return nil
+}
+
+func (m *MemoryStore) RemoveRoomMember(room string, username string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.rooms[room], username)
+	if len(m.rooms[room]) == 0 {
+		delete(m.rooms, room)
+	}
+	return nil
+}
+
+func (m *MemoryStore) PushMailbox(recipient string, message MailboxMessage) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if len(m.mailboxes[recipient]) >= MaxMailboxMessages {
+		return ErrMailboxFull
+	}
+	// A FileStore sets Seq before the message goes to the journal
+	if message.Seq == 0 {
+		m.mailboxSeq++
+		message.Seq = m.mailboxSeq
+	} else if message.Seq > m.mailboxSeq {
+		m.mailboxSeq = message.Seq
+	}
+	message.Data = append([]byte(nil), message.Data...)
+	m.mailboxes[recipient] = append(m.mailboxes[recipient], message)
+	return nil
+}
+
+func (m *MemoryStore) Mailbox(recipient string) ([]MailboxMessage, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return append([]MailboxMessage(nil), m.mailboxes[recipient]...), nil
+}
+
+func (m *MemoryStore) RemoveMailbox(recipient string, seq uint64) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	var kept []MailboxMessage
+	for _, message := range m.mailboxes[recipient] {
+		if message.Seq > seq {
+			kept = append(kept, message)
+		}
+	}
+	if len(kept) == 0 {
+		delete(m.mailboxes, recipient)
+	} else {
+		m.mailboxes[recipient] = kept
+	}
+	return nil
+}
+
+func (m *MemoryStore) PurgeMailboxes(now time.Time) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	purged := 0
+	for recipient, messages := range m.mailboxes {
+		kept := messages[:0]
+		for _, message := range messages {
+			if message.expired(now) {
+				purged++
+				continue
+			}
+			kept = append(kept, message)
+		}
+		if len(kept) == 0 {
+			delete(m.mailboxes, recipient)
+		} else {
+			m.mailboxes[recipient] = kept
+		}
+	}
+	return purged, nil
+}
+
+func (m *MemoryStore) RevokeToken(id [16]byte, expires time.Time) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	now := time.Now()
+	for revokedID, revokedUntil := range m.revoked {
+		if now.After(revokedUntil) {
+			delete(m.revoked, revokedID)
+		}
+	}
+	m.revoked[id] = expires
+	return nil
+}
+
+func (m *MemoryStore) TokenRevoked(id [16]byte) (bool, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, ok := m.revoked[id]
+	return ok, nil
+}
+
+func (m *MemoryStore) Close() error {
+	return nil
+}
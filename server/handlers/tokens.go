@@ -0,0 +1,93 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// Session tokens are 64 bytes:
+//
+//	[0]      token format version
+//	[1:8]    reserved
+//	[8:16]   expiry, unix seconds
+//	[16:32]  random token ID, used for revocation
+//	[32:64]  HMAC-SHA256 over the username and bytes [0:32]
+//
+// They are signed with the server's TokenSecret so only revoked token IDs
+// have to be remembered.
+const tokenVersion = 1
+
+// MinTokenSecretLength is the shortest TokenSecret tokens are issued and
+// accepted with
+const MinTokenSecretLength = 32
+
+var (
+	errTokenSecret  = errors.New("token secret is too short")
+	errTokenInvalid = errors.New("invalid session token")
+	errTokenExpired = errors.New("session token expired")
+	errTokenRevoked = errors.New("session token revoked")
+)
+
+// issueToken creates a signed session token for the user
+func (s *Server) issueToken(username string) ([64]byte, error) {
+	var token [64]byte
+	if len(s.TokenSecret) < MinTokenSecretLength {
+		return token, errTokenSecret
+	}
+	token[0] = tokenVersion
+	binary.BigEndian.PutUint64(token[8:16], uint64(time.Now().Add(s.SessionTTL).Unix()))
+	if _, err := rand.Read(token[16:32]); err != nil {
+		return token, err
+	}
+	copy(token[32:], s.signToken(username, token))
+	return token, nil
+}
+
+func (s *Server) signToken(username string, token [64]byte) []byte {
+	mac := hmac.New(sha256.New, s.TokenSecret)
+	mac.Write([]byte(username))
+	mac.Write(token[:32])
+	return mac.Sum(nil)
+}
+
+// verifyToken checks the signature, expiry and revocation of a session token
+func (s *Server) verifyToken(username string, token [64]byte) error {
+	// Anyone could sign tokens with an empty or short secret
+	if len(s.TokenSecret) < MinTokenSecretLength {
+		return errTokenSecret
+	}
+	if token[0] != tokenVersion || !hmac.Equal(token[32:], s.signToken(username, token)) {
+		return errTokenInvalid
+	}
+
+	expires := time.Unix(int64(binary.BigEndian.Uint64(token[8:16])), 0)
+	if time.Now().After(expires) {
+		return errTokenExpired
+	}
+
+	var id [16]byte
+	copy(id[:], token[16:32])
+
+	revoked, err := s.store.TokenRevoked(id)
+	if err != nil {
+		return err
+	}
+	if revoked {
+		return errTokenRevoked
+	}
+	return nil
+}
+
+// revokeToken stops a session token from being accepted again. The ID is
+// only remembered until the token would have expired anyway.
+func (s *Server) revokeToken(token [64]byte) error {
+	var id [16]byte
+	copy(id[:], token[16:32])
+	expires := time.Unix(int64(binary.BigEndian.Uint64(token[8:16])), 0)
+
+	return s.store.RevokeToken(id, expires)
+}
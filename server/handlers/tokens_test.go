@@ -0,0 +1,67 @@
+package server
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVerifyToken(t *testing.T) {
+	tests := []struct {
+		name string
+		// Changes the server or the token after it was issued to alice
+		change   func(t *testing.T, s *Server, token *[64]byte)
+		username string
+		err      error
+	}{
+		{"valid", func(t *testing.T, s *Server, token *[64]byte) {}, "alice", nil},
+		{"other user", func(t *testing.T, s *Server, token *[64]byte) {}, "bob", errTokenInvalid},
+		{"tampered version", func(t *testing.T, s *Server, token *[64]byte) { token[0]++ }, "alice", errTokenInvalid},
+		{"tampered expiry", func(t *testing.T, s *Server, token *[64]byte) { token[8]++ }, "alice", errTokenInvalid},
+		{"tampered ID", func(t *testing.T, s *Server, token *[64]byte) { token[16]++ }, "alice", errTokenInvalid},
+		{"tampered signature", func(t *testing.T, s *Server, token *[64]byte) { token[63]++ }, "alice", errTokenInvalid},
+		{"other secret", func(t *testing.T, s *Server, token *[64]byte) { s.TokenSecret = make([]byte, MinTokenSecretLength) }, "alice", errTokenInvalid},
+		{"short secret", func(t *testing.T, s *Server, token *[64]byte) { s.TokenSecret = s.TokenSecret[:MinTokenSecretLength-1] }, "alice", errTokenSecret},
+		{"revoked", func(t *testing.T, s *Server, token *[64]byte) {
+			if err := s.revokeToken(*token); err != nil {
+				t.Fatal(err)
+			}
+		}, "alice", errTokenRevoked},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t)
+			token, err := s.issueToken("alice")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			test.change(t, s, &token)
+			if err := s.verifyToken(test.username, token); err != test.err {
+				t.Fatalf("verifyToken = %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestVerifyTokenExpired(t *testing.T) {
+	s := newTestServer(t)
+	s.SessionTTL = -time.Second
+
+	token, err := s.issueToken("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.verifyToken("alice", token); err != errTokenExpired {
+		t.Fatalf("verifyToken = %v, want %v", err, errTokenExpired)
+	}
+}
+
+func TestIssueTokenShortSecret(t *testing.T) {
+	s := newTestServer(t)
+	s.TokenSecret = nil
+
+	if _, err := s.issueToken("alice"); err != errTokenSecret {
+		t.Fatalf("issueToken = %v, want %v", err, errTokenSecret)
+	}
+}
@@ -1,8 +1,213 @@
 package main
 
-import server "scrp/server/handlers"
+import (
+	"context"
+	"crypto/rand"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"scrp/server/config"
+	server "scrp/server/handlers"
+	"syscall"
+	"time"
+)
 
 func main() {
-	s := server.NewServer()
-	s.Listen("8080")
+	// "ca" manages a local certificate authority instead of running the
+	// server
+	if len(os.Args) > 1 && os.Args[1] == "ca" {
+		runCA(os.Args[2:])
+		return
+	}
+
+	// "passwd" sets a password for the file authentication backend
+	if len(os.Args) > 1 && os.Args[1] == "passwd" {
+		runPasswd(os.Args[2:])
+		return
+	}
+
+	cfg, err := config.Load(flag.CommandLine, os.Args[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+
+	if cfg.Logging.File != "" {
+		logFile, err := os.OpenFile(cfg.Logging.File, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			log.Fatalf("Failed to open log file: %v", err)
+		}
+		defer logFile.Close()
+		log.SetOutput(logFile)
+	}
+
+	s, err := newServer(cfg)
+	if err != nil {
+		log.Fatalf("Failed to configure server: %v", err)
+	}
+
+	if cfg.Listen.MetricsAddress != "" {
+		go func() {
+			if err := s.ServeMetrics(cfg.Listen.MetricsAddress); err != nil {
+				log.Printf("Failed to serve metrics: %v", err)
+			}
+		}()
+	}
+
+	// SIGHUP reloads the server certificate
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			log.Println("SIGHUP received, reloading server certificate")
+			s.Reload()
+		}
+	}()
+
+	// SIGINT and SIGTERM disconnect every client before exiting, a second
+	// signal exits immediately
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+
+	stopped := make(chan struct{})
+	go func() {
+		sig := <-signals
+		log.Printf("%v received, shutting down", sig)
+
+		go func() {
+			<-signals
+			log.Fatalf("Shutdown interrupted")
+		}()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Limits.ShutdownTimeout))
+		defer cancel()
+		if err := s.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown did not complete: %v", err)
+		}
+		close(stopped)
+	}()
+
+	err = s.ListenAndServe(context.Background(), cfg.Listen.Address)
+	if err != server.ErrServerClosed {
+		log.Fatalf("Server failed: %v", err)
+	}
+	<-stopped
+	log.Println("Server stopped")
+}
+
+// newServer creates a server from a validated configuration
+func newServer(cfg config.Config) (*server.Server, error) {
+	var opts []server.Option
+	if cfg.Auth.Backend == "file" {
+		auth, err := server.NewFileAuthenticator(cfg.Auth.UsersFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load users file: %v", err)
+		}
+		opts = append(opts, server.WithAuthenticator(auth))
+	}
+
+	// Accounts, keys, rooms, offline messages and revoked tokens survive
+	// restarts
+	store, err := server.OpenFileStore(cfg.Storage.Dir)
+	if err != nil {
+		return nil, fmt.Errorf("could not open store: %v", err)
+	}
+	opts = append(opts, server.WithStore(store))
+
+	s, err := server.NewServer(opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	s.CertFile = cfg.TLS.CertFile
+	s.KeyFile = cfg.TLS.KeyFile
+	if len(cfg.TLS.CertHosts) > 0 {
+		s.CertHosts = cfg.TLS.CertHosts
+	}
+	s.CertReloadInterval = time.Duration(cfg.TLS.ReloadInterval)
+	s.ClientCAFile = cfg.TLS.ClientCAFile
+	s.RequireClientCert = cfg.TLS.RequireClientCert
+
+	s.SessionTTL = time.Duration(cfg.Auth.SessionTTL)
+
+	s.WriteTimeout = time.Duration(cfg.Limits.WriteTimeout)
+	s.QueueSize = cfg.Limits.QueueSize
+	switch cfg.Limits.SlowConsumer {
+	case "drop":
+		s.SlowConsumer = server.DropMessages
+	case "spool":
+		s.SlowConsumer = server.SpoolToDisk
+	case "disconnect":
+		s.SlowConsumer = server.DisconnectClient
+	}
+	s.SpoolDir = cfg.Limits.SpoolDir
+	s.SpoolLimit = cfg.Limits.SpoolLimit
+	s.HeartbeatInterval = time.Duration(cfg.Limits.HeartbeatInterval)
+	s.HeartbeatTimeout = time.Duration(cfg.Limits.HeartbeatTimeout)
+	s.MaxClockSkew = time.Duration(cfg.Limits.MaxClockSkew)
+	s.MailboxPurgeInterval = time.Duration(cfg.Limits.MailboxPurgeInterval)
+
+	s.LogMessages = cfg.Logging.LogMessages
+
+	secret, err := loadTokenSecret(filepath.Join(cfg.Storage.Dir, "token.secret"))
+	if err != nil {
+		return nil, fmt.Errorf("could not load token secret: %v", err)
+	}
+	s.TokenSecret = secret
+
+	return s, nil
+}
+
+// loadTokenSecret reads the session token signing secret, creating it on
+// first start so that tokens stay valid across restarts
+func loadTokenSecret(path string) ([]byte, error) {
+	secret, err := os.ReadFile(path)
+	if err == nil {
+		// An empty or truncated secret would let anyone sign tokens
+		if len(secret) < server.MinTokenSecretLength {
+			return nil, fmt.Errorf("%s has %d bytes, at least %d are needed; remove it to generate a new one, which ends every session", path, len(secret), server.MinTokenSecretLength)
+		}
+		return secret, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	secret = make([]byte, server.MinTokenSecretLength)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	if err := writeSecret(path, secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// writeSecret writes to a temporary file that is synced and then renamed,
+// so a crash never leaves a truncated secret behind
+func writeSecret(path string, secret []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(secret); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
 }
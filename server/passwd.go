@@ -0,0 +1,54 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	server "scrp/server/handlers"
+	"syscall"
+
+	"golang.org/x/term"
+)
+
+// runPasswd sets a user's password in the users file of the file
+// authentication backend
+func runPasswd(args []string) {
+	flags := flag.NewFlagSet("passwd", flag.ExitOnError)
+	usersFile := flags.String("users", "./server/users.json", "users file")
+	username := flags.String("user", "", "user to set the password for")
+	flags.Parse(args)
+
+	if *username == "" {
+		log.Fatal("Usage: server passwd -user <name> [-users <file>]")
+	}
+
+	auth, err := server.NewFileAuthenticator(*usersFile)
+	if err != nil {
+		log.Fatalf("Failed to load users file: %v", err)
+	}
+
+	fmt.Printf("New password for %s: ", *username)
+	password, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		log.Fatalf("Failed to read password: %v", err)
+	}
+	if len(password) > server.MaxPasswordLength {
+		log.Fatalf("Password must be at most %d bytes", server.MaxPasswordLength)
+	}
+
+	fmt.Print("Repeat password: ")
+	repeated, err := term.ReadPassword(int(syscall.Stdin))
+	fmt.Println()
+	if err != nil {
+		log.Fatalf("Failed to read password: %v", err)
+	}
+	if string(password) != string(repeated) {
+		log.Fatal("Passwords do not match")
+	}
+
+	if err := auth.SetPassword(*username, string(password)); err != nil {
+		log.Fatalf("Failed to set password: %v", err)
+	}
+	fmt.Printf("Password for %s saved to %s\n", *username, *usersFile)
+}
@@ -6,50 +6,233 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/pem"
+	"errors"
+	"fmt"
 	"math/big"
+	"net"
 	"os"
+	"path/filepath"
 	"time"
 )
 
-func GenerateServerCert(certFile string, keyFile string) error {
+// GenerateServerCert writes a self-signed server certificate valid for the
+// given host names and IP addresses
+func GenerateServerCert(certFile string, keyFile string, hosts []string) error {
 	priv, err := rsa.GenerateKey(rand.Reader, 2048)
 	if err != nil {
 		return err
 	}
 
-	notBefore := time.Now()
-	notAfter := notBefore.Add(365 * 24 * time.Hour)
+	template, err := newTemplate(pkix.Name{Organization: []string{"SRCP"}}, 365*24*time.Hour)
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	addHosts(template, hosts)
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		return err
+	}
+	return writeCertAndKey(certFile, keyFile, derBytes, priv, false)
+}
+
+// GenerateCA writes a new certificate authority for issuing server and
+// client certificates. An existing CA is only replaced with force, as that
+// invalidates every certificate it issued.
+func GenerateCA(certFile string, keyFile string, name string, validity time.Duration, force bool) error {
+	if !force {
+		for _, file := range []string{certFile, keyFile} {
+			if _, err := os.Stat(file); err == nil {
+				return fmt.Errorf("%s: %w", file, os.ErrExist)
+			}
+		}
+	}
+
+	priv, err := rsa.GenerateKey(rand.Reader, 4096)
+	if err != nil {
+		return err
+	}
+
+	template, err := newTemplate(pkix.Name{Organization: []string{"SRCP"}, CommonName: name}, validity)
+	if err != nil {
+		return err
+	}
+	template.IsCA = true
+	template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature
+	template.MaxPathLenZero = true
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, template, &priv.PublicKey, priv)
+	if err != nil {
+		return err
+	}
+	return writeCertAndKey(certFile, keyFile, derBytes, priv, !force)
+}
+
+// IssueServerCert writes a server certificate for the given host names and
+// IP addresses, signed by the CA
+func IssueServerCert(caCertFile string, caKeyFile string, certFile string, keyFile string, hosts []string, validity time.Duration) error {
+	if len(hosts) == 0 {
+		return errors.New("a server certificate needs at least one host name or IP address")
+	}
+
+	template, err := newTemplate(pkix.Name{Organization: []string{"SRCP"}, CommonName: hosts[0]}, validity)
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth}
+	addHosts(template, hosts)
+
+	return issue(caCertFile, caKeyFile, certFile, keyFile, template)
+}
+
+// IssueClientCert writes a client certificate for the user, signed by the
+// CA. The server logs the client in as the certificate's common name.
+func IssueClientCert(caCertFile string, caKeyFile string, certFile string, keyFile string, username string, validity time.Duration) error {
+	if username == "" || len(username) > 32 {
+		return errors.New("a client certificate needs a username of 1 to 32 bytes")
+	}
+
+	template, err := newTemplate(pkix.Name{Organization: []string{"SRCP"}, CommonName: username}, validity)
+	if err != nil {
+		return err
+	}
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+
+	return issue(caCertFile, caKeyFile, certFile, keyFile, template)
+}
+
+// LoadCertPool reads PEM encoded CA certificates into a pool
+func LoadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
 
-	template := x509.Certificate{
-		SerialNumber: big.NewInt(1),
-		Subject: pkix.Name{
-			Organization: []string{"SRCP"},
-		},
-		NotBefore: notBefore,
-		NotAfter:  notAfter,
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", caFile)
+	}
+	return pool, nil
+}
+
+func newTemplate(subject pkix.Name, validity time.Duration) (*x509.Certificate, error) {
+	// Serial numbers must be unique per CA, 128 random bits make collisions
+	// practically impossible
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
 
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature,
-		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	notBefore := time.Now().Add(-5 * time.Minute)
+	return &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               subject,
+		NotBefore:             notBefore,
+		NotAfter:              notBefore.Add(validity),
 		BasicConstraintsValid: true,
+	}, nil
+}
+
+func addHosts(template *x509.Certificate, hosts []string) {
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
 	}
+}
 
-	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+func issue(caCertFile string, caKeyFile string, certFile string, keyFile string, template *x509.Certificate) error {
+	caCert, caKey, err := loadCA(caCertFile, caKeyFile)
 	if err != nil {
 		return err
 	}
 
-	certOut, err := os.Create("./server/" + certFile)
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return err
+	}
+
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, caCert, &priv.PublicKey, caKey)
+	if err != nil {
+		return err
+	}
+	return writeCertAndKey(certFile, keyFile, derBytes, priv, false)
+}
+
+func loadCA(certFile string, keyFile string) (*x509.Certificate, *rsa.PrivateKey, error) {
+	certPEM, err := os.ReadFile(certFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read CA certificate: %v", err)
+	}
+	block, _ := pem.Decode(certPEM)
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, nil, fmt.Errorf("no certificate found in %s", certFile)
+	}
+	cert, err := x509.ParseCertificate(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyPEM, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not read CA key: %v", err)
+	}
+	block, _ = pem.Decode(keyPEM)
+	if block == nil || block.Type != "RSA PRIVATE KEY" {
+		return nil, nil, fmt.Errorf("no RSA private key found in %s", keyFile)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !cert.IsCA {
+		return nil, nil, fmt.Errorf("%s is not a CA certificate", certFile)
+	}
+	return cert, key, nil
+}
+
+// writeCertAndKey writes a certificate and its key as PEM. With exclusive
+// set neither file may exist yet.
+func writeCertAndKey(certFile string, keyFile string, derBytes []byte, priv *rsa.PrivateKey, exclusive bool) error {
+	for _, file := range []string{certFile, keyFile} {
+		if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+			return err
+		}
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	if exclusive {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	}
+
+	certOut, err := os.OpenFile(certFile, flags, 0666)
 	if err != nil {
 		return err
 	}
 	defer certOut.Close()
-	pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
-	keyOut, err := os.OpenFile("./server/"+keyFile, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+
+	keyOut, err := os.OpenFile(keyFile, flags, 0600)
 	if err != nil {
+		// Do not leave a certificate without its key behind
+		if exclusive {
+			os.Remove(certFile)
+		}
 		return err
 	}
 	defer keyOut.Close()
 
+	err = pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes})
+	if err != nil {
+		return err
+	}
+
 	err = pem.Encode(keyOut, &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(priv)})
 	if err != nil {
 		return err
@@ -0,0 +1,88 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"time"
+)
+
+// TOTP parameters from RFC 6238 as used by common authenticator apps
+const (
+	TOTPPeriod = 30
+	TOTPDigits = 6
+	// Codes from this many periods before and after now are accepted to
+	// allow for clock drift
+	TOTPSkew = 1
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// GenerateTOTPSecret returns a random 160 bit TOTP secret
+func GenerateTOTPSecret() ([]byte, error) {
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	return secret, nil
+}
+
+// TOTPProvisioningURI returns the otpauth:// URI authenticator apps use to
+// enroll the secret
+func TOTPProvisioningURI(issuer string, account string, secret []byte) string {
+	values := url.Values{}
+	values.Set("secret", totpEncoding.EncodeToString(secret))
+	values.Set("issuer", issuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(TOTPDigits))
+	values.Set("period", fmt.Sprint(TOTPPeriod))
+
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+// TOTPCode returns the code for the secret at the given time
+func TOTPCode(secret []byte, t time.Time) string {
+	return hotp(secret, uint64(t.Unix()/TOTPPeriod))
+}
+
+// VerifyTOTP checks a code against the secret, allowing TOTPSkew periods of
+// clock drift, and returns the period it belongs to. Only codes of periods
+// after last are accepted, so that a code can not be used twice.
+func VerifyTOTP(secret []byte, code string, t time.Time, last int64) (int64, bool) {
+	counter := t.Unix() / TOTPPeriod
+	var step int64
+	valid := false
+	for i := int64(-TOTPSkew); i <= TOTPSkew; i++ {
+		expected := hotp(secret, uint64(counter+i))
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 && counter+i > last {
+			step = counter + i
+			valid = true
+		}
+	}
+	return step, valid
+}
+
+// hotp implements RFC 4226
+func hotp(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < TOTPDigits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", TOTPDigits, value%mod)
+}
@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"testing"
+	"time"
+)
+
+// The SHA-1 test vectors of RFC 6238 appendix B, cut to TOTPDigits
+var rfc6238Secret = []byte("12345678901234567890")
+
+var rfc6238Vectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "287082"},
+	{1111111109, "081804"},
+	{1111111111, "050471"},
+	{1234567890, "005924"},
+	{2000000000, "279037"},
+	{20000000000, "353130"},
+}
+
+func TestTOTPCode(t *testing.T) {
+	for _, vector := range rfc6238Vectors {
+		if code := TOTPCode(rfc6238Secret, time.Unix(vector.unix, 0)); code != vector.code {
+			t.Errorf("TOTPCode at %d = %s, want %s", vector.unix, code, vector.code)
+		}
+	}
+}
+
+func TestVerifyTOTP(t *testing.T) {
+	for _, vector := range rfc6238Vectors {
+		step := vector.unix / TOTPPeriod
+
+		tests := []struct {
+			name string
+			// When the code is checked and the step used last
+			at   int64
+			last int64
+			ok   bool
+		}{
+			{"in its period", vector.unix, 0, true},
+			{"one period late", vector.unix + TOTPPeriod, 0, true},
+			{"one period early", vector.unix - TOTPPeriod, 0, true},
+			{"too late", vector.unix + (TOTPSkew+1)*TOTPPeriod, 0, false},
+			{"replayed", vector.unix, step, false},
+			{"after a later code", vector.unix, step + 1, false},
+			{"after an earlier code", vector.unix, step - 1, true},
+		}
+
+		for _, test := range tests {
+			got, ok := VerifyTOTP(rfc6238Secret, vector.code, time.Unix(test.at, 0), test.last)
+			if ok != test.ok {
+				t.Errorf("code of %d %s: ok = %v, want %v", vector.unix, test.name, ok, test.ok)
+			}
+			if ok && got != step {
+				t.Errorf("code of %d %s: step = %d, want %d", vector.unix, test.name, got, step)
+			}
+		}
+	}
+}
+
+func TestVerifyTOTPWrongCode(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	for _, code := range []string{"", "000000", "50471", "0050471", "005924"} {
+		if _, ok := VerifyTOTP(rfc6238Secret, code, now, 0); ok {
+			t.Errorf("code %q accepted", code)
+		}
+	}
+}
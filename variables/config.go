@@ -1,8 +1,16 @@
 package variables
 
 const (
-	// SRCP version
-	Version = 1
+	// SRCP version, raised whenever the layout of a PDU changes. Frames of
+	// another version are rejected.
+	//
+	//  1: first version
+	//  2: session tokens of 64 bytes, TOKEN_AUTH and LOGOUT
+	//  3: Room in MESSAGE, ROOM_JOIN, ROOM_LEAVE, ROOM_MEMBERS and ROOM_LIST
+	//  4: Received in MESSAGE
+	//  5: Expires in MESSAGE
+	//  6: no TextLen in MESSAGE, the data carries its length
+	Version = 6
 
 	// Message types
 	AuthRequest  = 0x01
@@ -11,12 +19,40 @@ const (
 	Message      = 0x04
 	MessageAck   = 0x05
 	Disconnect   = 0x06
+	Ping         = 0x07
+	Pong         = 0x08
+	TokenAuth    = 0x09
+	Logout       = 0x0A
+	AuthCode     = 0x0B
+	TwoFactor    = 0x0C
+	TwoFactorAck = 0x0D
+	RoomJoin     = 0x0E
+	RoomLeave    = 0x0F
+	RoomMembers  = 0x10
+	RoomList     = 0x11
 
 	// Authentication status
-	AuthSuccess = 0x00
-	AuthFailure = 0x01
+	AuthSuccess   = 0x00
+	AuthFailure   = 0x01
+	AuthChallenge = 0x02
+
+	// Two factor actions
+	TwoFactorEnroll  = 0x00
+	TwoFactorConfirm = 0x01
+	TwoFactorDisable = 0x02
+
+	// Two factor status
+	TwoFactorSuccess = 0x00
+	TwoFactorFailure = 0x01
+
+	// Room status
+	RoomOK      = 0x00
+	RoomFull    = 0x01
+	RoomInvalid = 0x02
 
 	// Disconnection reasons
 	UserRequest   = 0x00
 	ServerRequest = 0x01
+	// The user logged in again from another session
+	SessionReplaced = 0x02
 )